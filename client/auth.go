@@ -5,6 +5,11 @@ const (
 	AUTH_OP_LOGOUT        = "logout"
 	AUTH_OP_PWD_RESET     = "pwdreset"
 	AUTH_OP_PWD_RESET_REQ = "pwdresetreq"
+	AUTH_OP_TOTP          = "totp"
+
+	//SECOND_FACTOR_PROBLEM_TYPE is the type of the problem the server sends
+	//when the login must be completed with AUTH_OP_TOTP.
+	SECOND_FACTOR_PROBLEM_TYPE = "urn:seven5:second-factor"
 )
 
 type PasswordAuthParameters struct {
@@ -13,4 +18,22 @@ type PasswordAuthParameters struct {
 	ResetRequestUdid string
 	UserUdid         string
 	Op               string
+	Code             string
+}
+
+type PasswordAuthResult struct {
+	SecondFactorRequired bool
+}
+
+type SecondFactorParameters struct {
+	Code string
+}
+
+type SecondFactorEnrollment struct {
+	Secret string
+	URI    string
+}
+
+type SecondFactorRecovery struct {
+	RecoveryCodes []string
 }
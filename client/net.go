@@ -12,9 +12,88 @@ import (
 )
 
 // AjaxError is returned on the error channel after a call to an Ajax method.
+// When the server sends an RFC 7807 problem details object (application/problem+json),
+// which it does for all errors, the members of the problem are placed in Type, Title,
+// Detail, Instance, and Extensions; Message is the Detail in that case.  When the
+// server rejects a wire type because it failed validation (code 422), Fields
+// holds the problems found, one per field.
 type AjaxError struct {
 	StatusCode int
 	Message    string
+	Type       string
+	Title      string
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+	Fields     []FieldError
+}
+
+//FieldError is a single problem with a single field of a wire type, as reported
+//by the server when validation fails. Field is the path to the field using
+//the Go names, such as Address.Street or Items[2].Name; it is empty for
+//problems that are not about a particular field.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+//problemBody is the form of the server's error responses. The extension
+//members are decoded separately.
+type problemBody struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail"`
+	Instance string       `json:"instance"`
+	Errors   []FieldError `json:"errors"`
+}
+
+const PROBLEM_CONTENT_TYPE = "application/problem+json"
+
+//These must match the server (see seven5.CSRFPolicy).  The server sends the CSRF
+//token in CSRF_COOKIE and the Ajax calls that change something (POST, PUT,
+//PATCH, DELETE) copy it into CSRF_HEADER.
+const (
+	CSRF_COOKIE       = "seven5-csrf"
+	CSRF_HEADER       = "X-CSRF-Token"
+	CSRF_PROBLEM_TYPE = "urn:seven5:csrf"
+)
+
+//parseProblem fills in the structured fields of the error from a problem
+//details object. If the text is not a problem, the error is left alone.
+func (self *AjaxError) parseProblem(contentType string, text string) {
+	if !strings.HasPrefix(contentType, PROBLEM_CONTENT_TYPE) {
+		return
+	}
+	var p problemBody
+	if err := json.Unmarshal([]byte(text), &p); err != nil {
+		return
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &all); err != nil {
+		return
+	}
+	for _, k := range []string{"type", "title", "status", "detail", "instance", "errors"} {
+		delete(all, k)
+	}
+	self.Type = p.Type
+	self.Title = p.Title
+	self.Detail = p.Detail
+	self.Instance = p.Instance
+	self.Extensions = all
+	self.Fields = p.Errors
+	self.Message = p.Detail
+}
+
+//FieldMessage returns the message for the given field path, or "" if the
+//server did not report a problem with that field.
+func (self AjaxError) FieldMessage(field string) string {
+	for _, f := range self.Fields {
+		if f.Field == field {
+			return f.Message
+		}
+	}
+	return ""
 }
 
 //AjaxPut behaves indentically to AjaxPost other than using the method PUT.
@@ -76,9 +155,40 @@ func AjaxGet(ptrToStruct interface{}, path string) (chan interface{}, chan AjaxE
 }
 
 //AjaxRawChannels is the lower level interface to the "raw" Ajax call.  Most users
-//should use AjaxGet, AjaxPost, AjaxIndex or AjaxPut.
+//should use AjaxGet, AjaxPost, AjaxIndex or AjaxPut.  The CSRF token is sent
+//with methods that change something, and if the server refuses the token (because
+//the client did not have one yet) the call is retried once with the new token.
 func AjaxRawChannels(output interface{}, body string, contentChan chan interface{}, errChan chan AjaxError,
 	method string, path string, extraHeaders map[string]interface{}) error {
+	return ajaxRaw(output, body, contentChan, errChan, method, path, extraHeaders, true)
+}
+
+//csrfToken returns the value of the CSRF cookie, or "" if there is none.
+func csrfToken() string {
+	for _, c := range strings.Split(js.Global.Get("document").Get("cookie").String(), ";") {
+		pair := strings.SplitN(strings.TrimSpace(c), "=", 2)
+		if len(pair) == 2 && pair[0] == CSRF_COOKIE {
+			return pair[1]
+		}
+	}
+	return ""
+}
+
+func ajaxRaw(output interface{}, body string, contentChan chan interface{}, errChan chan AjaxError,
+	method string, path string, extraHeaders map[string]interface{}, retry bool) error {
+
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if token := csrfToken(); token != "" {
+			headers := map[string]interface{}{}
+			for k, v := range extraHeaders {
+				headers[k] = v
+			}
+			headers[CSRF_HEADER] = token
+			extraHeaders = headers
+		}
+	}
 
 	m := map[string]interface{}{
 		"contentType": "application/json",
@@ -100,7 +210,7 @@ func AjaxRawChannels(output interface{}, body string, contentChan chan interface
 		dec := json.NewDecoder(rd)
 		if err := dec.Decode(output); err != nil {
 			go func() {
-				errChan <- AjaxError{418, err.Error()}
+				errChan <- AjaxError{StatusCode: 418, Message: err.Error()}
 			}()
 			return
 		}
@@ -110,11 +220,19 @@ func AjaxRawChannels(output interface{}, body string, contentChan chan interface
 	}).
 		Fail(func(p1 *js.Object) {
 		go func() {
-			ajaxerr := AjaxError{p1.Get("status").Int(), p1.Get("responseText").String()}
+			ajaxerr := AjaxError{StatusCode: p1.Get("status").Int(), Message: p1.Get("responseText").String()}
 			if p1.Get("status").Int() == 0 {
 				ajaxerr.StatusCode = 0
 				ajaxerr.Message = "Server not reachable"
 			}
+			ct := p1.Call("getResponseHeader", "Content-Type")
+			if ajaxerr.StatusCode != 0 && ct != nil {
+				ajaxerr.parseProblem(ct.String(), ajaxerr.Message)
+			}
+			if retry && ajaxerr.StatusCode == 403 && ajaxerr.Type == CSRF_PROBLEM_TYPE {
+				ajaxRaw(output, body, contentChan, errChan, method, path, extraHeaders, false)
+				return
+			}
 			errChan <- ajaxerr
 		}()
 	})
@@ -190,7 +308,7 @@ func putPostDel(ptrToStruct interface{}, path string, method string, sendBody bo
 		body, err = encodeBody(ptrToStruct)
 		if err != nil {
 			go func() {
-				errCh <- AjaxError{420, err.Error()}
+				errCh <- AjaxError{StatusCode: 420, Message: err.Error()}
 			}()
 			return contentCh, errCh
 		}
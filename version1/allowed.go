@@ -19,7 +19,8 @@ type Authorizer interface {
 //or types of requests are allowed on it.  This is a good place to put gross-level kinds of "policy"
 //decisions like "non staff members cannot call this method".  This does not allow for very fine-grain policies about the _content_
 //of the returned values, such as "the list returned has all elements if the user is a staff
-//member but only elements they own for normal users."  AllowReader is used for the RestIndex interface.
+//member but only elements they own for normal users."  Use ResultFilter for those, which also
+//covers Find.  AllowReader is used for the RestIndex interface.
 //Return true to allow calls to RestIndex to be made with the PBundle provided.
 type AllowReader interface {
 	AllowRead(PBundle) bool
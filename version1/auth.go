@@ -52,7 +52,8 @@ type OauthConnector interface {
 
 //OauthClientDetail is an interface for finding the specific information needed to connect to
 //an Oauth server.  If you don't want to use environment variables as the way you store
-//these, you can provide your own implementation of this class.
+//these, you can provide your own implementation of this class.  See EnvOauthClientDetail
+//and FileOauthClientDetail, and ValidateOauthClientDetail for checking at startup.
 type OauthClientDetail interface {
 	ClientId(serviceName string) string
 	ClientSecret(serviceName string) string
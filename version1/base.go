@@ -4,15 +4,18 @@ package seven5
 //* The Allow() interfaces are used for authorization checks
 //* The application will keep a single cookie on the browser (that's why the cookie mapper is passed in)
 //* The application will keep a session associated with the cookie for each "logged in" user (via the SessionManager)
-//* Json is used to encode and decode the wire types
+//* Json is used to encode and decode the wire types unless the client asks for XML, MessagePack or CBOR
 //* Rest resources dispatched by this object are mapped to /rest in the URL space.
+//* Requests with a session that change something must carry the CSRF token (DoubleSubmitCSRF);
+//set CSRF to nil to turn the check off, for example when no browser uses the resources.
 //You must pass an already created session manager into this method
 //(see NewSimpleSessionManager(...))
 func NewBaseDispatcher(sm SessionManager, cm CookieMapper) *BaseDispatcher {
 	prefix := "/rest"
 	result := &BaseDispatcher{}
-	io := &RawIOHook{&JsonDecoder{}, &JsonEncoder{}, cm}
+	io := NewNegotiatingIOHook(DefaultCodecRegistry(), cm)
 	result.RawDispatcher = NewRawDispatcher(io, sm, result, prefix)
+	result.CSRF = &DoubleSubmitCSRF{}
 	return result
 }
 
@@ -101,8 +101,9 @@ func makeRequestCheckStatusNullBody(t *testing.T, client *http.Client, method st
 	}
 	read := string(all)
 	if status == http.StatusUnauthorized {
-		if !strings.HasPrefix(read, "Not authorized") {
-			t.Errorf("expected not authorized message but got '%s'", read)
+		problem, err := ParseProblem(all)
+		if err != nil || !strings.HasPrefix(problem.Detail, "Not authorized") {
+			t.Errorf("expected not authorized problem but got '%s'", read)
 		}
 	} else {
 		if method == "POST" {
@@ -0,0 +1,152 @@
+package seven5
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+//Codec is an Encoder and Decoder pair for a particular format, along with
+//the media types that identify that format.  The first media type is the one
+//sent to the client in the Content-Type header unless the client asked for
+//one of the others by name.
+type Codec struct {
+	MediaTypes []string
+	Enc        Encoder
+	Dec        Decoder
+}
+
+//CodecRegistry is used by the RawIOHook to choose an Encoder based on the
+//Accept header of a request, and a Decoder based on the Content-Type.  The
+//first codec registered is the default, used when the client does not say
+//what it wants.
+type CodecRegistry struct {
+	codecs []*Codec
+}
+
+//NewCodecRegistry returns an empty registry.  Most applications will want
+//DefaultCodecRegistry instead.
+func NewCodecRegistry() *CodecRegistry {
+	return &CodecRegistry{}
+}
+
+//DefaultCodecRegistry returns a registry that understands JSON (the default),
+//XML, MessagePack, and CBOR.
+func DefaultCodecRegistry() *CodecRegistry {
+	result := NewCodecRegistry()
+	result.Register(&JsonEncoder{}, &JsonDecoder{}, "application/json", "text/json")
+	result.Register(&XmlEncoder{}, &XmlDecoder{}, "application/xml", "text/xml")
+	result.Register(&MsgpackEncoder{}, &MsgpackDecoder{}, "application/msgpack", "application/x-msgpack")
+	result.Register(&CborEncoder{}, &CborDecoder{}, "application/cbor")
+	return result
+}
+
+//Register adds a codec to the registry.  At least one media type must be supplied.
+func (self *CodecRegistry) Register(enc Encoder, dec Decoder, mediaTypes ...string) {
+	if len(mediaTypes) == 0 {
+		panic("codecs must have at least one media type")
+	}
+	self.codecs = append(self.codecs, &Codec{MediaTypes: mediaTypes, Enc: enc, Dec: dec})
+}
+
+//Decoder returns the decoder for the given Content-Type header value, or false
+//if there is no codec for it.  An empty content type selects the default codec.
+func (self *CodecRegistry) Decoder(contentType string) (Decoder, bool) {
+	if len(self.codecs) == 0 {
+		return nil, false
+	}
+	if strings.TrimSpace(contentType) == "" {
+		return self.codecs[0].Dec, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	for _, c := range self.codecs {
+		for _, m := range c.MediaTypes {
+			if m == mediaType {
+				return c.Dec, true
+			}
+		}
+	}
+	return nil, false
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+//matches returns how specific the range is if it matches the media type: 2 for
+//the type itself, 1 for type/* and 0 for */*; it returns -1 if it does not match.
+func (self acceptRange) matches(mediaType string) int {
+	switch {
+	case self.mediaType == mediaType:
+		return 2
+	case self.mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(self.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(self.mediaType, "*")):
+		return 1
+	}
+	return -1
+}
+
+//quality returns the quality the client gave the media type, which is that
+//of the most specific range that matches it, and the position of that range
+//in the header.  The quality is zero if no range matches.
+func quality(ranges []acceptRange, mediaType string) (float64, int) {
+	best, q, pos := -1, 0.0, len(ranges)
+	for i, r := range ranges {
+		if s := r.matches(mediaType); s > best {
+			best, q, pos = s, r.q, i
+		}
+	}
+	return q, pos
+}
+
+//Encoder returns the best encoder for the given Accept header value, and the
+//media type to send back in the Content-Type.  Each media type in the registry
+//gets the quality of the most specific range in the header that matches it, so
+//types the client refuses with q=0 are never chosen, even if a wildcard also
+//matches them.  Ties go to the range the client listed first and then to the
+//codec registered first.  If nothing the client will accept is in the
+//registry, false is returned.  An empty Accept header selects the default codec.
+func (self *CodecRegistry) Encoder(accept string) (Encoder, string, bool) {
+	if len(self.codecs) == 0 {
+		return nil, "", false
+	}
+	if strings.TrimSpace(accept) == "" {
+		return self.codecs[0].Enc, self.codecs[0].MediaTypes[0], true
+	}
+	ranges := []acceptRange{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+	var enc Encoder
+	var chosen string
+	bestQ, bestPos := 0.0, len(ranges)
+	for _, c := range self.codecs {
+		//the first media type of a codec is its usual name, so it wins ties
+		//within the codec, as when only a wildcard matches
+		for _, m := range c.MediaTypes {
+			q, pos := quality(ranges, m)
+			if q > bestQ || (q == bestQ && q > 0 && pos < bestPos) {
+				enc, chosen, bestQ, bestPos = c.Enc, m, q, pos
+			}
+		}
+	}
+	if enc == nil {
+		return nil, "", false
+	}
+	return enc, chosen, true
+}
@@ -0,0 +1,165 @@
+package seven5
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCodecRegistry(t *testing.T) {
+	reg := DefaultCodecRegistry()
+	for accept, expected := range map[string]string{
+		"":                                    "application/json",
+		"*/*":                                 "application/json",
+		"text/json":                           "text/json",
+		"application/xml, application/json":   "application/xml",
+		"application/json;q=0.5, text/xml":    "text/xml",
+		"text/plain, application/*;q=0.1":     "application/json",
+		"application/cbor;q=0.9, image/png":   "application/cbor",
+		"application/x-msgpack, */*;q=0.01":   "application/x-msgpack",
+		"application/msgpack; charset=binary": "application/msgpack",
+		"application/json;q=0, */*":           "text/json",
+		"application/*;q=0, */*":              "text/json",
+		"application/json;q=0.1, */*":         "text/json",
+	} {
+		_, mediaType, ok := reg.Encoder(accept)
+		if !ok || mediaType != expected {
+			t.Errorf("for accept '%s' expected %s but got %s (%v)", accept, expected, mediaType, ok)
+		}
+	}
+	if _, _, ok := reg.Encoder("image/png, text/plain"); ok {
+		t.Errorf("should not be able to produce an image")
+	}
+	if _, mediaType, _ := reg.Encoder("application/json;q=0, text/json;q=0, */*"); mediaType != "application/xml" {
+		t.Errorf("expected the next codec when json is refused, got %s", mediaType)
+	}
+	if _, _, ok := reg.Encoder("*/*;q=0"); ok {
+		t.Errorf("should not produce anything the client refuses")
+	}
+
+	//one xml element, with nothing after it but whitespace and comments
+	var wire someWire
+	dec := &XmlDecoder{}
+	if err := dec.DecodeStream(strings.NewReader("<someWire><Id>3</Id></someWire>\n<!-- end -->\n"), &wire); err != nil || wire.Id != 3 {
+		t.Errorf("unable to decode xml stream: %v %+v", err, wire)
+	}
+	for _, trailing := range []string{"<someWire/>", "junk"} {
+		if err := dec.DecodeStream(strings.NewReader("<someWire></someWire>"+trailing), &wire); err == nil {
+			t.Errorf("expected error for data after the xml element: %s", trailing)
+		}
+	}
+	if _, ok := reg.Decoder("application/cbor"); !ok {
+		t.Errorf("should be able to decode cbor")
+	}
+	if _, ok := reg.Decoder("text/plain; charset=utf-8"); ok {
+		t.Errorf("should not be able to decode text")
+	}
+
+	//round trip the binary formats
+	for _, ct := range []string{"application/msgpack", "application/cbor"} {
+		enc, _, _ := reg.Encoder(ct)
+		dec, _ := reg.Decoder(ct)
+		encoded, err := enc.Encode(&someWire{Id: 12, Foo: "bar"}, true)
+		if err != nil {
+			t.Fatalf("unable to encode %s: %v", ct, err)
+		}
+		var result someWire
+		if err := dec.Decode([]byte(encoded), &result); err != nil {
+			t.Fatalf("unable to decode %s: %v", ct, err)
+		}
+		checkBody(t, &result, 12, "bar")
+	}
+}
+
+//patchCounter counts the calls to Patch, to check that nothing is changed
+//when the result cannot be sent.
+type patchCounter struct {
+	someResource
+	patched int
+}
+
+func (self *patchCounter) Patch(id int64, i interface{}, p PBundle) (interface{}, error) {
+	self.patched++
+	return self.someResource.Patch(id, i, p)
+}
+
+func TestNotAcceptableBeforeWrite(t *testing.T) {
+	resource := &patchCounter{}
+	raw := NewRawDispatcher(NewNegotiatingIOHook(DefaultCodecRegistry(), nil), nil, nil, "/rest")
+	raw.Rez(&someWire{}, resource)
+	for _, method := range []string{"PATCH", "PUT", "DELETE"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "/rest/somewire/17", strings.NewReader(`{"Foo":"bar"}`))
+		r.Header.Set("Accept", "image/png")
+		raw.Dispatch(nil, w, r)
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf("expected 406 on %s, got %d", method, w.Code)
+		}
+	}
+	if resource.patched != 0 {
+		t.Errorf("patch was applied even though the result could not be sent")
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	io := NewNegotiatingIOHook(DefaultCodecRegistry(), nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.Rez(&someWire{}, &someResource{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8197", mux)
+	}()
+	client := new(http.Client)
+
+	req := makeReq(t, "GET", "http://localhost:8197/rest/somewire/17", "")
+	req.Header.Set("Accept", "application/xml")
+	resp, err := client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if resp.Header.Get("Content-Type") != "application/xml" {
+		t.Errorf("wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+	all, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body: %s", err)
+	}
+	var found someWire
+	if err := xml.Unmarshal(all, &found); err != nil {
+		t.Fatalf("unable to decode xml %s: %v", string(all), err)
+	}
+	checkBody(t, &found, 17, "find")
+
+	cbor, _, _ := DefaultCodecRegistry().Encoder("application/cbor")
+	body, err := cbor.Encode(&someWire{Id: -1, Foo: "binary"}, false)
+	if err != nil {
+		t.Fatalf("unable to encode cbor: %v", err)
+	}
+	req = makeReq(t, "POST", "http://localhost:8197/rest/somewire", body)
+	req.Header.Set("Content-Type", "application/cbor")
+	req.Header.Set("Accept", "application/json")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+	checkBody(t, readBody(t, resp.Body, false), 999, "binary")
+
+	req = makeReq(t, "GET", "http://localhost:8197/rest/somewire/17", "")
+	req.Header.Set("Accept", "image/png")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusNotAcceptable)
+
+	req = makeReq(t, "POST", "http://localhost:8197/rest/somewire", "Foo=bar")
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusUnsupportedMediaType)
+
+	req = makeReq(t, "GET", "http://localhost:8197/rest/somewire", "")
+	req.Header.Set("Accept", "text/xml")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	all, _ = ioutil.ReadAll(resp.Body)
+	if strings.Index(string(all), "<list>") == -1 {
+		t.Errorf("expected index to be wrapped in a list: %s", string(all))
+	}
+}
@@ -3,12 +3,21 @@ package seven5
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	SESSION_COOKIE = "%s-seven5-session"
+	//HOST_COOKIE_PREFIX is the prefix browsers use to lock a cookie to a single
+	//host; such cookies must be Secure, have no Domain, and have the Path "/".
+	HOST_COOKIE_PREFIX = "__Host-"
+	//MAX_COOKIE_CHUNKS is the largest number of cookies that a value may be
+	//split across when a CookiePolicy has a ChunkSize.
+	MAX_COOKIE_CHUNKS = 10
 )
 
 var (
@@ -25,55 +34,191 @@ type CookieMapper interface {
 	RemoveCookie(http.ResponseWriter)
 }
 
+//CookiePolicy controls the attributes of the cookies sent by a SimpleCookieMapper.
+//Path defaults to "/".  If HostPrefix is true, the cookie name starts with
+//HOST_COOKIE_PREFIX and the cookie is always Secure with the Path "/"; Domain
+//must be empty.
+//
+//The lifetime of the cookie follows the expiration of the session, if the
+//session is an ExpiringSession.  If MaxAge is not zero, it is used instead.  If
+//BrowserSession is true, the cookie has no lifetime and is discarded when the
+//browser is closed.
+//
+//If ChunkSize is not zero, values longer than ChunkSize are split across
+//several cookies (at most MAX_COOKIE_CHUNKS) and reassembled by Value.  This
+//is useful with CookieSessionManager, which stores the whole session in the
+//cookie.  Values that need more chunks are not sent and the cookie is removed
+//instead; CookieSessionManager refuses to create sessions that large.
+type CookiePolicy struct {
+	Secure         bool
+	HttpOnly       bool
+	SameSite       http.SameSite
+	Domain         string
+	Path           string
+	MaxAge         time.Duration
+	BrowserSession bool
+	HostPrefix     bool
+	ChunkSize      int
+}
+
 //SimpleCookieMapper is a default, cookie mapper that maps UDID strings to Session
 //objects and uses a simple cookie scheme to extract the UDIDs from requests generated by the
 //browser.
 type SimpleCookieMapper struct {
-	cook string
+	cook   string
+	policy CookiePolicy
 }
 
 //NewSimpleCookieMapper creates an instance of CookieMapper with the given application name.
+//The cookie has the Path "/" and lasts until the browser is closed.
 func NewSimpleCookieMapper(appName string) CookieMapper {
+	return NewPolicyCookieMapper(appName, &CookiePolicy{BrowserSession: true})
+}
+
+//NewPolicyCookieMapper creates an instance of CookieMapper with the given application name
+//whose cookies have the attributes in the policy.  This call panics if the policy
+//asks for HostPrefix with a Domain, because browsers will ignore the cookie, or
+//for a ChunkSize that does not fit in a cookie.
+func NewPolicyCookieMapper(appName string, policy *CookiePolicy) *SimpleCookieMapper {
+	p := *policy
+	name := fmt.Sprintf(SESSION_COOKIE, appName)
+	if p.Path == "" {
+		p.Path = "/"
+	}
+	if p.HostPrefix {
+		if p.Domain != "" {
+			panic("cookies with the " + HOST_COOKIE_PREFIX + " prefix cannot have a domain")
+		}
+		p.Secure = true
+		p.Path = "/"
+		name = HOST_COOKIE_PREFIX + name
+	}
 	result := &SimpleCookieMapper{
-		cook: fmt.Sprintf(SESSION_COOKIE, appName),
+		cook:   name,
+		policy: p,
+	}
+	if p.ChunkSize < 0 || p.ChunkSize > MAX_COOKIE_SIZE-len(result.chunkName(MAX_COOKIE_CHUNKS))-1 {
+		panic(fmt.Sprintf("cookie chunk size %d does not fit in a cookie", p.ChunkSize))
 	}
 	return result
 }
 
+//cookie returns a cookie with the given name and value and the attributes of the policy.
+func (self *SimpleCookieMapper) cookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     self.policy.Path,
+		Domain:   self.policy.Domain,
+		Secure:   self.policy.Secure,
+		HttpOnly: self.policy.HttpOnly,
+		SameSite: self.policy.SameSite,
+	}
+}
+
+//chunkName returns the name of the cookie for the i'th chunk of a value.
+func (self *SimpleCookieMapper) chunkName(i int) string {
+	return fmt.Sprintf("%s-%d", self.cook, i)
+}
+
 //AssociateCookie is used to effectively "Log in" a particular user by associating a session
 //with a response w that will be sent back to their browser.
 func (self *SimpleCookieMapper) AssociateCookie(w http.ResponseWriter, s Session) {
-	cookie := &http.Cookie{
-		Name:  self.CookieName(),
-		Value: s.SessionId(),
-		Path:  "/",
+	var expires time.Time
+	maxAge := 0
+	switch {
+	case self.policy.BrowserSession:
+	case self.policy.MaxAge > 0:
+		maxAge = int(self.policy.MaxAge / time.Second)
+		expires = time.Now().Add(self.policy.MaxAge)
+	default:
+		if es, ok := s.(ExpiringSession); ok && !es.Expires().IsZero() {
+			expires = es.Expires()
+			maxAge = int(expires.Sub(time.Now()) / time.Second)
+			if maxAge <= 0 {
+				maxAge = -1
+			}
+		}
+	}
+	value := s.SessionId()
+	var values []string
+	size := self.policy.ChunkSize
+	if size > 0 && len(value) > size {
+		for len(value) > size {
+			values = append(values, value[:size])
+			value = value[size:]
+		}
+		values = append(values, value)
+		if len(values) > MAX_COOKIE_CHUNKS {
+			//part of the value would be a different session, or none at all;
+			//session managers should have refused to create it
+			log.Printf("[COOKIE] value for %s is too large (%d chunks), not sending it", self.cook, len(values))
+			self.RemoveCookie(w)
+			return
+		}
+		//the first cookie holds the number of chunks
+		value = fmt.Sprintf("~%d", len(values))
 	}
+	cookie := self.cookie(self.CookieName(), value)
+	cookie.Expires, cookie.MaxAge = expires, maxAge
 	http.SetCookie(w, cookie)
+	for i, v := range values {
+		cookie := self.cookie(self.chunkName(i+1), v)
+		cookie.Expires, cookie.MaxAge = expires, maxAge
+		http.SetCookie(w, cookie)
+	}
 }
 
 //RemoveCookie is used to effectively "Log out" a particular user by removing the association of a session
 //with a response w that will be sent back to their browser.
 func (self *SimpleCookieMapper) RemoveCookie(w http.ResponseWriter) {
-	cookie := &http.Cookie{
-		Name:   self.CookieName(),
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	}
+	cookie := self.cookie(self.CookieName(), "")
+	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
+	if self.policy.ChunkSize > 0 {
+		for i := 1; i <= MAX_COOKIE_CHUNKS; i++ {
+			cookie := self.cookie(self.chunkName(i), "")
+			cookie.MaxAge = -1
+			http.SetCookie(w, cookie)
+		}
+	}
 }
 
 //Value returns the cookie value associated with a given request or an error if that cookie is not
-//present.  Usually the value is the UDID of the session.
+//present.  Usually the value is the UDID of the session.  Values that were split
+//into chunks are put back together; if any of the chunks is missing, the
+//cookie is treated as not present.
 func (self *SimpleCookieMapper) Value(r *http.Request) (string, error) {
 	c, err := r.Cookie(self.CookieName())
 	if err == http.ErrNoCookie {
 		return "", NO_SUCH_COOKIE
 	}
-	return strings.TrimSpace(c.Value), nil
+	value := strings.TrimSpace(c.Value)
+	if self.policy.ChunkSize == 0 || !strings.HasPrefix(value, "~") {
+		return value, nil
+	}
+	n, err := strconv.Atoi(value[1:])
+	if err != nil || n < 1 || n > MAX_COOKIE_CHUNKS {
+		return value, nil
+	}
+	var all []string
+	for i := 1; i <= n; i++ {
+		chunk, err := r.Cookie(self.chunkName(i))
+		if err == http.ErrNoCookie {
+			return "", NO_SUCH_COOKIE
+		}
+		all = append(all, strings.TrimSpace(chunk.Value))
+	}
+	return strings.Join(all, ""), nil
 }
 
 //CookieName returns the name of the cookie used for this application by this session manager.
 func (self *SimpleCookieMapper) CookieName() string {
 	return self.cook
 }
+
+//MaxValueSize returns the longest value that can be stored by AssociateCookie, or zero
+//if there is no limit other than the browser's limit on a single cookie.
+func (self *SimpleCookieMapper) MaxValueSize() int {
+	return self.policy.ChunkSize * MAX_COOKIE_CHUNKS
+}
@@ -0,0 +1,182 @@
+package seven5
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	//MAX_COOKIE_SIZE is the largest cookie, name and value, that browsers are
+	//required to accept.
+	MAX_COOKIE_SIZE = 4096
+	//COOKIE_SESSION_MARK marks session ids that carry the whole session, so they
+	//cannot be confused with the ids of other session managers.
+	COOKIE_SESSION_MARK = "c"
+)
+
+//cookieValueLimiter is implemented by cookie mappers that can store values
+//larger than a single cookie, such as a SimpleCookieMapper with a ChunkSize.
+type cookieValueLimiter interface {
+	MaxValueSize() int
+}
+
+//CookieSessionManager is an implementation of SessionManager that keeps no
+//state on the server.  The unique id, expiration time, and user data of the
+//session are sealed (encrypted and signed) with the primary key of a Keyring
+//and the result is the session id, which is sent to the browser in the
+//cookie of the CookieMapper.  Because the session is in the cookie, the user
+//data must be small; Assign and Update return an error if the cookie would be
+//larger than MAX_COOKIE_SIZE or, if the CookieMapper splits large values (see
+//CookiePolicy.ChunkSize), larger than the most it can send.
+//
+//Update changes the session id, so the cookie must be sent again.  This is done
+//automatically for requests handled by a RawDispatcher; other callers must call
+//AssociateCookie with the new session.  Destroy cannot revoke a session that
+//has been copied from the browser, so use short expiration times and remove the
+//cookie with the CookieMapper when logging out.
+type CookieSessionManager struct {
+	cm        CookieMapper
+	ring      *Keyring
+	codec     UserDataCodec
+	generator Generator
+	lifetime  time.Duration
+}
+
+//NewCookieSessionManager returns a session manager that keeps sessions in the
+//cookie named by the CookieMapper, sealed with keys from the keyring.  The
+//codec is used to encode the user data and if it is nil, a JsonUserDataCodec
+//with no example is used.  Sessions assigned without an expiration time last
+//for 24 hours.
+func NewCookieSessionManager(cm CookieMapper, ring *Keyring, codec UserDataCodec, g Generator) *CookieSessionManager {
+	if ring == nil || ring.Primary() == "" {
+		panic("session manager needs a keyring with at least one key")
+	}
+	if codec == nil {
+		codec = NewJsonUserDataCodec(nil)
+	}
+	return &CookieSessionManager{
+		cm:        cm,
+		ring:      ring,
+		codec:     codec,
+		generator: g,
+		lifetime:  24 * time.Hour,
+	}
+}
+
+//Assign creates a new session for the uniqueInfo. The semantics are the same
+//as SimpleSessionManager.Assign.
+func (self *CookieSessionManager) Assign(uniqueInfo string, userData interface{}, expires time.Time) (Session, error) {
+	if expires.IsZero() {
+		expires = time.Now().Add(self.lifetime)
+	}
+	return self.seal(uniqueInfo, userData, expires)
+}
+
+//Find opens the session id and returns the session in it.  It returns nil if
+//the session id has been tampered with, has expired, or has user data that
+//can no longer be decoded.
+func (self *CookieSessionManager) Find(id string) (*SessionReturn, error) {
+	if id == "" {
+		log.Printf("[SESSION] likely programming error, called find with id=\"\"")
+		return nil, nil
+	}
+	uniq, encoded, expires, ok := self.open(id)
+	if !ok {
+		return nil, nil
+	}
+	ud, err := self.codec.DecodeUserData(encoded)
+	if err != nil {
+		log.Printf("[SESSION] unable to decode user data for %s, ignoring session: %v", uniq, err)
+		return nil, nil
+	}
+	s := NewSimpleSession(restoredUserData(uniq, ud), id)
+	s.expires = expires
+	return &SessionReturn{Session: s}, nil
+}
+
+//Destroy does nothing, since there is no state on the server.
+func (self *CookieSessionManager) Destroy(id string) error {
+	return nil
+}
+
+//Update returns a new session, with a new session id, that holds the user data
+//provided.  The unique id and expiration time are unchanged.  It returns nil
+//if the session is no longer valid.
+func (self *CookieSessionManager) Update(session Session, i interface{}) (Session, error) {
+	uniq, _, expires, ok := self.open(session.SessionId())
+	if !ok {
+		return nil, nil
+	}
+	return self.seal(uniq, i, expires)
+}
+
+//Generate returns nil,nil if no Generator was provided at the time of this
+//object's creation. If a Generator was provided it is invoked to create
+//the user data for this session.
+func (self *CookieSessionManager) Generate(uniq string) (interface{}, error) {
+	if self.generator == nil {
+		return nil, nil
+	}
+	return self.generator.Generate(uniq)
+}
+
+//seal builds the session id from the unique id and user data.  The payload is
+//the length of the unique id, the unique id, and the encoded user data.
+func (self *CookieSessionManager) seal(uniqueInfo string, userData interface{}, expires time.Time) (Session, error) {
+	encoded, err := self.codec.EncodeUserData(storedUserData(userData))
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.MaxVarintLen64+len(uniqueInfo)+len(encoded))
+	n := binary.PutUvarint(payload, uint64(len(uniqueInfo)))
+	n += copy(payload[n:], uniqueInfo)
+	n += copy(payload[n:], encoded)
+	id := self.ring.primary + KEY_ID_SEPARATOR + COOKIE_SESSION_MARK + KEY_ID_SEPARATOR +
+		base64.RawURLEncoding.EncodeToString(sealExpiring(payload[:n], expires, cookieSessionData(self.ring.primary), self.ring.aeads[self.ring.primary]))
+	limit := MAX_COOKIE_SIZE - len(self.cm.CookieName()) - 1
+	if chunked, ok := self.cm.(cookieValueLimiter); ok && chunked.MaxValueSize() > 0 {
+		limit = chunked.MaxValueSize()
+	}
+	if len(id) > limit {
+		return nil, fmt.Errorf("session cookie for %s is too large (%d bytes, limit is %d)", uniqueInfo, len(id), limit)
+	}
+	s := NewSimpleSession(userData, id)
+	s.expires = expires
+	return s, nil
+}
+
+//open checks the session id and returns its parts, or false if the id has
+//been tampered with or has expired.
+func (self *CookieSessionManager) open(id string) (string, string, time.Time, bool) {
+	parts := strings.SplitN(id, KEY_ID_SEPARATOR, 3)
+	if len(parts) != 3 || parts[1] != COOKIE_SESSION_MARK {
+		return "", "", time.Time{}, false
+	}
+	aead, ok := self.ring.aeads[parts[0]]
+	if !ok {
+		return "", "", time.Time{}, false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	payload, expires, ok := openExpiring(sealed, cookieSessionData(parts[0]), aead)
+	if !ok {
+		return "", "", time.Time{}, false
+	}
+	l, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < l {
+		return "", "", time.Time{}, false
+	}
+	return string(payload[n : n+int(l)]), string(payload[n+int(l):]), expires, true
+}
+
+//cookieSessionData is the additional data that is authenticated with a cookie
+//session, so that it cannot be swapped with a session id.
+func cookieSessionData(keyId string) []byte {
+	return []byte(s5CookiePrefix + "-cookie:" + keyId)
+}
@@ -0,0 +1,81 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cookieUser struct {
+	Name  string
+	Admin bool
+}
+
+func TestCookieSession(t *testing.T) {
+	ring := NewKeyring()
+	ring.AddHex("a", strings.Repeat("3", 32), true)
+	cm := NewSimpleCookieMapper("cookietest")
+	mgr := NewCookieSessionManager(cm, ring, NewJsonUserDataCodec(&cookieUser{}), nil)
+
+	s, err := mgr.Assign("fred@example.com", &cookieUser{Name: "fred"}, time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign: %v", err)
+	}
+	if strings.Contains(s.SessionId(), "fred") {
+		t.Errorf("user data should not be readable in the cookie: %s", s.SessionId())
+	}
+	sr, err := mgr.Find(s.SessionId())
+	if err != nil || sr == nil || sr.Session == nil {
+		t.Fatalf("unable to find session: %v %v", sr, err)
+	}
+	if sr.Session.UserData().(*cookieUser).Name != "fred" {
+		t.Errorf("wrong user data: %+v", sr.Session.UserData())
+	}
+	if _, ok := sr.Session.(ExpiringSession); !ok {
+		t.Errorf("cookie sessions should know when they expire")
+	}
+
+	//tampering
+	id := []byte(s.SessionId())
+	id[len(id)-3] ^= 1
+	if sr, _ := mgr.Find(string(id)); sr != nil {
+		t.Errorf("tampered cookie accepted")
+	}
+	//a session id from the keyring is not a cookie session
+	if sr, _ := mgr.Find(ring.encrypt("fred@example.com", time.Now().Add(time.Hour))); sr != nil {
+		t.Errorf("session id accepted as a cookie session")
+	}
+	//expired
+	old, _ := mgr.Assign("fred@example.com", &cookieUser{Name: "fred"}, time.Now().Add(-time.Second))
+	if sr, _ := mgr.Find(old.SessionId()); sr != nil {
+		t.Errorf("expired cookie accepted")
+	}
+
+	//size check
+	if _, err := mgr.Assign("big", &cookieUser{Name: strings.Repeat("x", MAX_COOKIE_SIZE)}, time.Time{}); err == nil {
+		t.Errorf("expected error for a cookie that is too large")
+	}
+
+	//bundle hook finds the session and update causes the cookie to be sent again
+	r, _ := http.NewRequest("GET", "http://localhost/rest/foo", nil)
+	r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+	hook := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	w := httptest.NewRecorder()
+	pb, err := hook.BundleHook(w, r, mgr)
+	if err != nil || pb.Session() == nil {
+		t.Fatalf("bundle hook did not find session: %v", err)
+	}
+	updated, err := pb.UpdateSession(&cookieUser{Name: "fred", Admin: true})
+	if err != nil || updated == nil || updated.SessionId() == s.SessionId() {
+		t.Fatalf("update should change the session id: %v", err)
+	}
+	if pb.Session().SessionId() != updated.SessionId() || !pb.(*simplePBundle).reissued {
+		t.Errorf("bundle should have the updated session")
+	}
+	sr, _ = mgr.Find(updated.SessionId())
+	if sr == nil || !sr.Session.UserData().(*cookieUser).Admin {
+		t.Errorf("updated user data not found")
+	}
+}
@@ -0,0 +1,114 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//sendCookies copies the cookies set on the recorder into a new request.
+func sendCookies(t *testing.T, w *httptest.ResponseRecorder) *http.Request {
+	r, _ := http.NewRequest("GET", "http://localhost/", nil)
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.MaxAge >= 0 {
+			r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	return r
+}
+
+func TestCookiePolicy(t *testing.T) {
+	cm := NewPolicyCookieMapper("policy", &CookiePolicy{
+		HostPrefix: true,
+		HttpOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+	})
+	if cm.CookieName() != "__Host-policy-seven5-session" {
+		t.Errorf("wrong cookie name: %s", cm.CookieName())
+	}
+	s := NewSimpleSession(nil, "abc")
+	s.expires = time.Now().Add(time.Hour)
+	w := httptest.NewRecorder()
+	cm.AssociateCookie(w, s)
+	header := w.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Secure", "HttpOnly", "SameSite=Lax", "Path=/", "Max-Age=35", "Expires="} {
+		if !strings.Contains(header, attr) {
+			t.Errorf("expected %s in cookie: %s", attr, header)
+		}
+	}
+
+	//old behavior, no lifetime
+	w = httptest.NewRecorder()
+	NewSimpleCookieMapper("policy").AssociateCookie(w, s)
+	if header := w.Header().Get("Set-Cookie"); strings.Contains(header, "Max-Age") || strings.Contains(header, "Expires") {
+		t.Errorf("simple cookie mapper should send a browser session cookie: %s", header)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic for host prefix with a domain")
+		}
+	}()
+	NewPolicyCookieMapper("policy", &CookiePolicy{HostPrefix: true, Domain: "example.com"})
+}
+
+func TestCookieChunks(t *testing.T) {
+	cm := NewPolicyCookieMapper("chunky", &CookiePolicy{ChunkSize: 100})
+	value := strings.Repeat("0123456789", 35)
+	w := httptest.NewRecorder()
+	cm.AssociateCookie(w, NewSimpleSession(nil, value))
+	if n := len(w.Header()["Set-Cookie"]); n != 5 {
+		t.Errorf("expected 5 cookies (count and 4 chunks) but got %d", n)
+	}
+	r := sendCookies(t, w)
+	v, err := cm.Value(r)
+	if err != nil || v != value {
+		t.Errorf("chunked value not reassembled: %v %s", err, v)
+	}
+
+	//short values are not chunked
+	w = httptest.NewRecorder()
+	cm.AssociateCookie(w, NewSimpleSession(nil, "short"))
+	if v, _ := cm.Value(sendCookies(t, w)); v != "short" {
+		t.Errorf("wrong value: %s", v)
+	}
+
+	//missing chunk
+	r, _ = http.NewRequest("GET", "http://localhost/", nil)
+	r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: "~2"})
+	r.AddCookie(&http.Cookie{Name: cm.CookieName() + "-1", Value: "abc"})
+	if _, err := cm.Value(r); err != NO_SUCH_COOKIE {
+		t.Errorf("expected no cookie with a missing chunk: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	cm.RemoveCookie(w)
+	if n := len(w.Header()["Set-Cookie"]); n != MAX_COOKIE_CHUNKS+1 {
+		t.Errorf("expected all chunks to be removed, got %d cookies", n)
+	}
+
+	//too large values are not sent at all, rather than cut short
+	w = httptest.NewRecorder()
+	cm.AssociateCookie(w, NewSimpleSession(nil, strings.Repeat("x", cm.MaxValueSize()+1)))
+	if v, err := cm.Value(sendCookies(t, w)); err != NO_SUCH_COOKIE {
+		t.Errorf("expected no value for a value that is too large: %s", v)
+	}
+
+	//so session managers must not make them
+	ring := NewKeyring()
+	ring.AddHex("a", strings.Repeat("3", 32), true)
+	small := NewPolicyCookieMapper("chunky", &CookiePolicy{ChunkSize: 10})
+	mgr := NewCookieSessionManager(small, ring, nil, nil)
+	if _, err := mgr.Assign("fred", strings.Repeat("x", 100), time.Time{}); err == nil {
+		t.Errorf("expected an error for a session too large for the cookies")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic for a chunk size that does not fit in a cookie")
+		}
+	}()
+	NewPolicyCookieMapper("chunky", &CookiePolicy{ChunkSize: MAX_COOKIE_SIZE})
+}
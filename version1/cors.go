@@ -0,0 +1,270 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//CORSPolicy is the interface the RawDispatcher uses to decide if a cross-origin
+//request should be allowed, and what headers should be returned to the browser
+//about it.  A policy can be set for all resources on the dispatcher (see
+//RawDispatcher.CORS) or for a particular resource with SetCORSPolicy.  The
+//dispatcher answers preflight requests itself, so resources never see them.
+type CORSPolicy interface {
+	//AllowOrigin returns true if the origin provided (from the Origin header)
+	//may make requests on this resource.
+	AllowOrigin(origin string) bool
+	//ResponseHeaders adds the CORS headers to an actual (non-preflight) response.
+	ResponseHeaders(h http.Header, r *http.Request)
+	//PreflightHeaders adds the CORS headers to a preflight response. The last
+	//parameter is the set of methods that the resource supports.
+	PreflightHeaders(h http.Header, r *http.Request, allow []string)
+}
+
+//SimpleCORSPolicy is a default implementation of CORSPolicy that is configured
+//with constant values.  An AllowedOrigins that contains "*" allows any origin,
+//unless AllowCredentials is set (see NewCredentialedCORSPolicy).
+//If AllowedMethods is empty, the methods supported by the resource are sent
+//to the browser. If AllowedHeaders is empty, the headers the browser asked
+//for in the preflight are allowed.  A MaxAge of zero means the browser's
+//default is used for caching the preflight.
+type SimpleCORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+//NewSimpleCORSPolicy returns a policy that allows the given origins, such as
+//"https://staging.example.com".  The Location header is exposed to the client
+//since it is sent by the dispatcher on POST.
+func NewSimpleCORSPolicy(origins ...string) *SimpleCORSPolicy {
+	return &SimpleCORSPolicy{
+		AllowedOrigins: origins,
+		ExposedHeaders: []string{"Location"},
+	}
+}
+
+//NewCredentialedCORSPolicy returns a policy that allows the given origins to
+//make requests with cookies (AllowCredentials is set).  This call panics if
+//the origins include "*", because that would let any site act with the user's
+//session.
+func NewCredentialedCORSPolicy(origins ...string) *SimpleCORSPolicy {
+	result := NewSimpleCORSPolicy(origins...)
+	if result.anyOrigin() {
+		panic("a CORS policy that allows credentials cannot allow any origin (\"*\")")
+	}
+	result.AllowCredentials = true
+	return result
+}
+
+//AllowOrigin checks the origin against the list of AllowedOrigins, ignoring case.
+//If AllowCredentials is set, "*" is ignored and origins must be listed.
+func (self *SimpleCORSPolicy) AllowOrigin(origin string) bool {
+	for _, o := range self.AllowedOrigins {
+		if (o == "*" && !self.AllowCredentials) || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *SimpleCORSPolicy) anyOrigin() bool {
+	for _, o := range self.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//ResponseHeaders sets the Access-Control-Allow-Origin header and the others that
+//are needed on all responses.  With credentials, the origin (which has been
+//checked by AllowOrigin) is echoed back.
+func (self *SimpleCORSPolicy) ResponseHeaders(h http.Header, r *http.Request) {
+	if self.anyOrigin() && !self.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		h.Add("Vary", "Origin")
+	}
+	if self.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(self.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(self.ExposedHeaders, ", "))
+	}
+}
+
+//PreflightHeaders sets the headers for the response to an OPTIONS request that
+//has Access-Control-Request-Method set.
+func (self *SimpleCORSPolicy) PreflightHeaders(h http.Header, r *http.Request, allow []string) {
+	self.ResponseHeaders(h, r)
+	methods := allow
+	if len(self.AllowedMethods) > 0 {
+		methods = []string{}
+		for _, m := range self.AllowedMethods {
+			for _, a := range allow {
+				if strings.ToUpper(m) == a {
+					methods = append(methods, a)
+				}
+			}
+		}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(self.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(self.AllowedHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if self.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", fmt.Sprint(int64(self.MaxAge/time.Second)))
+	}
+}
+
+//SetCORSPolicy sets the CORS policy for the resource with the given name, as
+//it was registered.  Subresources are named by their path without ids, such as
+//"parent/child".  This overrides the dispatcher-wide policy in RawDispatcher.CORS
+//for that resource only.  This call panics if the resource cannot be found,
+//because this indicates that the program is misconfigured.
+func (self *RawDispatcher) SetCORSPolicy(name string, p CORSPolicy) {
+	shared := self.findRestShared(name)
+	if shared == nil {
+		panic(fmt.Sprintf("unable to find resource %s", name))
+	}
+	shared.cors = p
+}
+
+//findRestShared returns the shared portion of the resource with the given name,
+//which is a path like "parent/child" for subresources.  Names are compared
+//ignoring case, as they are in urls.
+func (self *RawDispatcher) findRestShared(name string) *restShared {
+	rez, rezUdid := self.findRest(name)
+	switch {
+	case rez != nil:
+		return &rez.restShared
+	case rezUdid != nil:
+		return &rezUdid.restShared
+	}
+	return nil
+}
+
+//findRest returns the resource with the given name, as for findRestShared;
+//one of the results is nil, or both are if it cannot be found.
+func (self *RawDispatcher) findRest(name string) (*restObj, *restObjUdid) {
+	segments := strings.Split(strings.ToLower(name), "/")
+	node := self.Root
+	for i, seg := range segments {
+		if i > 0 {
+			child, ok := node.Children[seg]
+			if !ok {
+				child, ok = node.ChildrenUdid[seg]
+				if !ok {
+					return nil, nil
+				}
+			}
+			node = child
+		}
+		if i < len(segments)-1 {
+			continue
+		}
+		//the tree is not keyed by the parents, so check them too
+		if rez, ok := node.Res[seg]; ok && rez.path == strings.ToLower(name) {
+			return rez, nil
+		}
+		if rezUdid, ok := node.ResUdid[seg]; ok && rezUdid.path == strings.ToLower(name) {
+			return nil, rezUdid
+		}
+	}
+	return nil, nil
+}
+
+//leaf finds the resource that a request is for by following the path through
+//the tree of resources, without calling Find on the parents.  It returns nil,
+//nil if the path does not name a resource.
+func (self *RawDispatcher) leaf(parts []string) (*restObj, *restObjUdid, string) {
+	current := self.Root
+	for {
+		matched, id, rez, rezUdid := self.resolve(parts, current)
+		if matched == "" {
+			return nil, nil, ""
+		}
+		count := 1
+		if id != "" {
+			count = 2
+		}
+		if len(parts) <= count {
+			return rez, rezUdid, id
+		}
+		node, ok := current.Children[parts[2]]
+		if !ok {
+			node, ok = current.ChildrenUdid[parts[2]]
+			if !ok {
+				return nil, nil, ""
+			}
+		}
+		parts = parts[2:]
+		current = node
+	}
+}
+
+//corsPolicy returns the policy in effect for a resource, or nil if there is none.
+//If shared is nil, the resource is not known and the dispatcher-wide policy is used.
+func (self *RawDispatcher) corsPolicy(shared *restShared) CORSPolicy {
+	if shared != nil && shared.cors != nil {
+		return shared.cors
+	}
+	return self.CORS
+}
+
+//handleCORS adds CORS headers to the response, if the request is cross-origin
+//and there is a policy.  This is done before the session is read or any parent
+//resource is consulted, so that errors are readable by the browser and preflight
+//requests, which never carry cookies, are not refused by an Authorizer.  It
+//returns true if the request has been completely handled, which is the case for
+//preflight requests and refused origins on preflight.
+func (self *RawDispatcher) handleCORS(w http.ResponseWriter, r *http.Request, parts []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	var shared *restShared
+	var allow []string
+	rez, rezUdid, id := self.leaf(parts)
+	if rez != nil || rezUdid != nil {
+		allow = allowedMethods(rez, rezUdid, id != "")
+		if rez != nil {
+			shared = &rez.restShared
+		} else {
+			shared = &rezUdid.restShared
+		}
+	}
+	policy := self.corsPolicy(shared)
+	if policy == nil {
+		return false
+	}
+	isPreflight := strings.ToUpper(r.Method) == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	if !policy.AllowOrigin(origin) {
+		if isPreflight {
+			sendProblem(w, fmt.Sprintf("Origin not allowed: %s", origin), http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	//unknown resources get the 404 from DispatchSegment, with headers so the
+	//browser can read it
+	if !isPreflight || shared == nil {
+		policy.ResponseHeaders(w.Header(), r)
+		return false
+	}
+	policy.PreflightHeaders(w.Header(), r, allow)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+	return true
+}
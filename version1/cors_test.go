@@ -0,0 +1,142 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//lockedResource refuses Find to everyone, so its subresources can only be
+//reached by preflight requests.
+type lockedResource struct {
+	someResource
+}
+
+type lockedWire struct {
+	Id int64
+}
+
+func (self *lockedResource) Allow(id int64, method string, pb PBundle) bool {
+	return false
+}
+
+func TestCORS(t *testing.T) {
+	resource := &someResource{}
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.Rez(&someWire{}, resource)
+	raw.ResourceSeparate("ReadOnly", &someSubWire{}, resource, nil, nil, nil, nil)
+	raw.CORS = NewSimpleCORSPolicy("http://other.example.com")
+	private := NewCredentialedCORSPolicy("http://private.example.com")
+	private.MaxAge = 10 * time.Minute
+	raw.SetCORSPolicy("ReadOnly", private)
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8195", mux)
+	}()
+	client := new(http.Client)
+
+	//preflight
+	req := makeReq(t, "OPTIONS", "http://localhost:8195/rest/somewire/12", "")
+	req.Header.Set("Origin", "http://other.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	resp, err := client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":  "http://other.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, PUT, PATCH, DELETE, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type",
+	} {
+		if resp.Header.Get(k) != v {
+			t.Errorf("expected %s to be '%s' but got '%s'", k, v, resp.Header.Get(k))
+		}
+	}
+
+	//preflight from somebody we don't know
+	req.Header.Set("Origin", "http://evil.example.com")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+
+	//actual request
+	req = makeReq(t, "GET", "http://localhost:8195/rest/somewire/12", "")
+	req.Header.Set("Origin", "http://other.example.com")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://other.example.com" {
+		t.Errorf("missing allow origin on actual request: %+v", resp.Header)
+	}
+
+	//per resource policy
+	req = makeReq(t, "OPTIONS", "http://localhost:8195/rest/readonly", "")
+	req.Header.Set("Origin", "http://private.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	for k, v := range map[string]string{
+		"Access-Control-Allow-Origin":      "http://private.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, HEAD, OPTIONS",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if resp.Header.Get(k) != v {
+			t.Errorf("expected %s to be '%s' but got '%s'", k, v, resp.Header.Get(k))
+		}
+	}
+	req.Header.Set("Origin", "http://other.example.com")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+}
+
+func TestCORSBeforeDispatch(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, &BaseDispatcher{}, "/rest")
+	raw.Resource("Locked", &lockedWire{}, &lockedResource{})
+	raw.SubResource(&lockedWire{}, "child", &someSubWire{}, &someSubResource{}, &someSubResource{}, nil, nil, nil)
+	raw.CORS = NewSimpleCORSPolicy("http://other.example.com")
+	raw.SetCORSPolicy("locked/child", NewCredentialedCORSPolicy("http://private.example.com"))
+
+	send := func(method string, url string, origin string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, nil)
+		r.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		raw.Dispatch(nil, w, r)
+		return w
+	}
+
+	//the preflight does not run the parent's Find
+	w := send("OPTIONS", "/rest/locked/1/child/2", "http://private.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("preflight for subresource failed: %d %+v", w.Code, w.Header())
+	}
+	//errors from the parent can be read by the browser
+	w = send("GET", "/rest/locked/1/child/2", "http://private.example.com")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") != "http://private.example.com" {
+		t.Errorf("expected refusal with CORS headers: %d %+v", w.Code, w.Header())
+	}
+	w = send("GET", "/rest/nothere", "http://other.example.com")
+	if w.Code != http.StatusNotFound || w.Header().Get("Access-Control-Allow-Origin") != "http://other.example.com" {
+		t.Errorf("expected not found with CORS headers: %d %+v", w.Code, w.Header())
+	}
+
+	//credentials are never allowed for any origin
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic for wildcard origin with credentials")
+			}
+		}()
+		NewCredentialedCORSPolicy("*")
+	}()
+	wild := NewSimpleCORSPolicy("*")
+	wild.AllowCredentials = true
+	if wild.AllowOrigin("http://evil.example.com") {
+		t.Errorf("wildcard origin allowed with credentials")
+	}
+}
@@ -0,0 +1,187 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	//CSRF_HEADER is the header the client uses to send the CSRF token.
+	CSRF_HEADER = "X-CSRF-Token"
+	//CSRF_COOKIE is the cookie used to send the CSRF token to the client.  It is
+	//readable by javascript, so the client can copy it into CSRF_HEADER.
+	CSRF_COOKIE = "seven5-csrf"
+	//CSRF_PROBLEM_TYPE is the type of the problem sent when a request fails
+	//the CSRF check.  The response carries a new token, so the client may retry.
+	CSRF_PROBLEM_TYPE = "urn:seven5:csrf"
+)
+
+//CSRFPolicy is the interface the RawDispatcher uses to protect resources from
+//cross-site request forgery.  Since requests are authenticated by the session
+//cookie, which the browser sends with any request to the site, a request that
+//changes something (POST, PUT, PATCH, DELETE) must also prove that it came from
+//a page that could read the CSRF token.  Requests without a session are not
+//checked.  Set a policy with the CSRF field of RawDispatcher.
+type CSRFPolicy interface {
+	//Check returns true if the request has the right token for the session.
+	Check(r *http.Request, pb PBundle) bool
+	//Issue sends the token for the session to the client, if it does not
+	//already have it.  The RawDispatcher calls it on requests with safe
+	//methods (GET, HEAD) and on requests that fail Check.
+	Issue(w http.ResponseWriter, r *http.Request, pb PBundle)
+}
+
+//DoubleSubmitCSRF is a CSRFPolicy that gives the client a random token in a
+//cookie and expects the same value in the CSRF_HEADER of unsafe requests.  Pages
+//on other sites cannot read the cookie, so they cannot set the header.  The
+//zero value uses CSRF_COOKIE and CSRF_HEADER.
+type DoubleSubmitCSRF struct {
+	CookieName string
+	HeaderName string
+	Secure     bool
+}
+
+//Check compares the header to the cookie.
+func (self *DoubleSubmitCSRF) Check(r *http.Request, pb PBundle) bool {
+	c, err := r.Cookie(csrfCookieName(self.CookieName))
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return compareCSRF(r.Header.Get(csrfHeaderName(self.HeaderName)), c.Value)
+}
+
+//Issue sets the cookie with a new random token if the request did not have one.
+func (self *DoubleSubmitCSRF) Issue(w http.ResponseWriter, r *http.Request, pb PBundle) {
+	if c, err := r.Cookie(csrfCookieName(self.CookieName)); err == nil && c.Value != "" {
+		return
+	}
+	buff := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buff); err != nil {
+		log.Printf("[CSRF] failed to read the random stream: %v", err)
+		return
+	}
+	setCSRFCookie(w, self.CookieName, hex.EncodeToString(buff), self.Secure)
+}
+
+//SessionCSRF is a CSRFPolicy whose token is computed from the session id with
+//a server key, so the token is tied to the session and cannot be planted by
+//another site (or a subdomain) that is able to set cookies.  The token is sent
+//to the client in a cookie, just as with DoubleSubmitCSRF, so the client is the
+//same for both.  Use NewSessionCSRF to create one; without a key, no token
+//is issued and every check fails.
+type SessionCSRF struct {
+	CookieName string
+	HeaderName string
+	Secure     bool
+	key        []byte
+}
+
+//NewSessionCSRF returns a policy that uses the key to compute tokens.  All
+//the servers that share sessions must use the same key.  This call panics
+//if the key is empty, since anyone could compute the tokens.
+func NewSessionCSRF(key []byte) *SessionCSRF {
+	if len(key) == 0 {
+		panic("session CSRF policy needs a key")
+	}
+	return &SessionCSRF{key: key}
+}
+
+//token returns the token for the session id, or "" if there is no key.
+func (self *SessionCSRF) token(sessionId string) string {
+	if len(self.key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(sessionId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Check compares the header to the token for the session.
+func (self *SessionCSRF) Check(r *http.Request, pb PBundle) bool {
+	if pb.Session() == nil {
+		return true
+	}
+	return compareCSRF(r.Header.Get(csrfHeaderName(self.HeaderName)), self.token(pb.Session().SessionId()))
+}
+
+//Issue sets the cookie to the token for the session if the client does not
+//already have it.
+func (self *SessionCSRF) Issue(w http.ResponseWriter, r *http.Request, pb PBundle) {
+	if pb.Session() == nil {
+		return
+	}
+	token := self.token(pb.Session().SessionId())
+	if token == "" {
+		log.Printf("[CSRF] no key for session CSRF policy, use NewSessionCSRF")
+		return
+	}
+	if c, err := r.Cookie(csrfCookieName(self.CookieName)); err == nil && c.Value == token {
+		return
+	}
+	setCSRFCookie(w, self.CookieName, token, self.Secure)
+}
+
+//unsafeMethod returns true for the methods that can change something.
+func unsafeMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+//handleCSRF checks unsafe requests that have a session against the CSRF
+//policy.  The token is issued to the client on safe requests and with a
+//refusal, so the client can retry.  It returns true if the request has been
+//refused.
+func (self *RawDispatcher) handleCSRF(w http.ResponseWriter, r *http.Request, bundle PBundle) bool {
+	if self.CSRF == nil || bundle == nil {
+		return false
+	}
+	if !unsafeMethod(r.Method) {
+		self.CSRF.Issue(w, r, bundle)
+		return false
+	}
+	if bundle.Session() == nil || self.CSRF.Check(r, bundle) {
+		return false
+	}
+	self.CSRF.Issue(w, r, bundle)
+	WriteError(w, Problem(http.StatusForbidden, CSRF_PROBLEM_TYPE, "CSRF check failed",
+		"Missing or invalid "+CSRF_HEADER))
+	return true
+}
+
+func compareCSRF(sent string, expected string) bool {
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) == 1
+}
+
+func csrfCookieName(name string) string {
+	if name == "" {
+		return CSRF_COOKIE
+	}
+	return name
+}
+
+func csrfHeaderName(name string) string {
+	if name == "" {
+		return CSRF_HEADER
+	}
+	return name
+}
+
+func setCSRFCookie(w http.ResponseWriter, name string, value string, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName(name),
+		Value:    value,
+		Path:     "/",
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
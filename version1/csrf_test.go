@@ -0,0 +1,123 @@
+package seven5
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCSRF(t *testing.T) {
+	cm, sm, raw := setupTestDispatcher("csrftest")
+	raw.CSRF = &DoubleSubmitCSRF{}
+	raw.Rez(&someWire{}, &someResource{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8201", mux)
+	}()
+	client := new(http.Client)
+	url := "http://localhost:8201/rest/somewire"
+	body := `{"Id":0, "Foo":"bar"}`
+
+	session, err := sm.Assign("fred", "fred", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign session: %v", err)
+	}
+	sessionCookie := &http.Cookie{Name: cm.CookieName(), Value: session.SessionId()}
+
+	//no session, nothing to forge
+	resp, err := client.Do(makeReq(t, "POST", url, body))
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+
+	//session but no token, the refusal carries a token
+	req := makeReq(t, "POST", url, body)
+	req.AddCookie(sessionCookie)
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+	var token string
+	for _, c := range resp.Cookies() {
+		if c.Name == CSRF_COOKIE {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatalf("no csrf cookie sent to client")
+	}
+
+	//safe methods are not checked
+	req = makeReq(t, "GET", url+"/1", "")
+	req.AddCookie(sessionCookie)
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+
+	//wrong token
+	req = makeReq(t, "PUT", url+"/1", body)
+	req.AddCookie(sessionCookie)
+	req.AddCookie(&http.Cookie{Name: CSRF_COOKIE, Value: token})
+	req.Header.Set(CSRF_HEADER, "x"+token[1:])
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusForbidden)
+
+	//right token, which is not sent again
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		u := url
+		if method != "POST" {
+			u = url + "/1"
+		}
+		req = makeReq(t, method, u, body)
+		req.AddCookie(sessionCookie)
+		req.AddCookie(&http.Cookie{Name: CSRF_COOKIE, Value: token})
+		req.Header.Set(CSRF_HEADER, token)
+		resp, err = client.Do(req)
+		if method == "POST" {
+			checkHttpStatus(t, resp, err, http.StatusCreated)
+		} else {
+			checkHttpStatus(t, resp, err, http.StatusOK)
+		}
+		if len(resp.Cookies()) != 0 {
+			t.Errorf("unexpected cookies on %s: %+v", method, resp.Cookies())
+		}
+	}
+
+	//base dispatchers check by default
+	if _, ok := NewBaseDispatcher(sm, cm).CSRF.(*DoubleSubmitCSRF); !ok {
+		t.Errorf("expected base dispatcher to have a CSRF policy")
+	}
+}
+
+func TestSessionCSRF(t *testing.T) {
+	policy := NewSessionCSRF([]byte("secret"))
+	s := NewSimpleSession(nil, "abc")
+	pb := NewTestPBundle(nil, nil, s, nil, nil, nil)
+	token := policy.token("abc")
+	if token == policy.token("abd") {
+		t.Errorf("tokens should depend on the session")
+	}
+	r := makeReq(t, "POST", "http://localhost/rest/foo", "")
+	if policy.Check(r, pb) {
+		t.Errorf("request without token accepted")
+	}
+	r.Header.Set(CSRF_HEADER, policy.token("abd"))
+	if policy.Check(r, pb) {
+		t.Errorf("token for another session accepted")
+	}
+	r.Header.Set(CSRF_HEADER, token)
+	if !policy.Check(r, pb) {
+		t.Errorf("good token refused")
+	}
+
+	//without a key, nothing is accepted
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic for empty key")
+			}
+		}()
+		NewSessionCSRF(nil)
+	}()
+	zero := &SessionCSRF{}
+	r.Header.Set(CSRF_HEADER, zero.token("abc"))
+	if zero.Check(r, pb) {
+		t.Errorf("policy without a key accepted a token")
+	}
+}
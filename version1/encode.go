@@ -3,11 +3,17 @@ package seven5
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	_ "fmt"
+	"io"
 	"log"
 	"net/http"
+	"reflect"
 	"strings"
+
+	"github.com/ugorji/go/codec"
 )
 
 type Encoder interface {
@@ -36,9 +42,28 @@ type Decoder interface {
 	Decode([]byte, interface{}) error
 }
 
+//StreamDecoder is an optional interface for Decoders that can decode directly
+//from the request body, rather than needing the entire body in memory.
+type StreamDecoder interface {
+	DecodeStream(io.Reader, interface{}) error
+}
+
 type JsonDecoder struct {
 }
 
+//DecodeStream is the streaming version of Decode.  Like Decode, it refuses a
+//body with anything but white space after the first value.
+func (self *JsonDecoder) DecodeStream(r io.Reader, wireType interface{}) error {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(wireType); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the json value")
+	}
+	return nil
+}
+
 //Decode is called to turn a body supplied by the client into an object of the appropriate
 //wire type.  Note that the interface{} passed here _must_ be pointer.
 func (self *JsonDecoder) Decode(body []byte, wireType interface{}) error {
@@ -46,6 +71,117 @@ func (self *JsonDecoder) Decode(body []byte, wireType interface{}) error {
 	return err
 }
 
+//XmlEncoder encodes wire types with encoding/xml.  Since a slice of wire types
+//has no single root element, slices are wrapped in an element called "list".
+type XmlEncoder struct {
+}
+
+type xmlList struct {
+	XMLName xml.Name `xml:"list"`
+	Items   interface{}
+}
+
+func (self *XmlEncoder) Encode(wireType interface{}, prettyPrint bool) (string, error) {
+	v := wireType
+	if wireType != nil && reflect.TypeOf(wireType).Kind() == reflect.Slice {
+		v = &xmlList{Items: wireType}
+	}
+	var buff []byte
+	var err error
+	if prettyPrint {
+		buff, err = xml.MarshalIndent(v, "", " ")
+	} else {
+		buff, err = xml.Marshal(v)
+	}
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(buff), nil
+}
+
+type XmlDecoder struct {
+}
+
+func (self *XmlDecoder) Decode(body []byte, wireType interface{}) error {
+	return xml.Unmarshal(body, wireType)
+}
+
+//DecodeStream decodes one element from the reader.  Like JsonDecoder, it
+//returns an error if anything other than whitespace, comments and processing
+//instructions follows the element.
+func (self *XmlDecoder) DecodeStream(r io.Reader, wireType interface{}) error {
+	dec := xml.NewDecoder(r)
+	if err := dec.Decode(wireType); err != nil {
+		return err
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.Comment, xml.ProcInst:
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				return errors.New("unexpected data after the xml element")
+			}
+		default:
+			return errors.New("unexpected data after the xml element")
+		}
+	}
+}
+
+//MsgpackEncoder encodes wire types as MessagePack. The result is binary, so
+//the returned string should not be treated as text.  prettyPrint is ignored.
+type MsgpackEncoder struct {
+}
+
+func (self *MsgpackEncoder) Encode(wireType interface{}, prettyPrint bool) (string, error) {
+	return encodeWithHandle(wireType, &codec.MsgpackHandle{})
+}
+
+type MsgpackDecoder struct {
+}
+
+func (self *MsgpackDecoder) Decode(body []byte, wireType interface{}) error {
+	return codec.NewDecoderBytes(body, &codec.MsgpackHandle{}).Decode(wireType)
+}
+
+func (self *MsgpackDecoder) DecodeStream(r io.Reader, wireType interface{}) error {
+	return codec.NewDecoder(r, &codec.MsgpackHandle{}).Decode(wireType)
+}
+
+//CborEncoder encodes wire types as CBOR (RFC 7049). The result is binary, so
+//the returned string should not be treated as text.  prettyPrint is ignored.
+type CborEncoder struct {
+}
+
+func (self *CborEncoder) Encode(wireType interface{}, prettyPrint bool) (string, error) {
+	return encodeWithHandle(wireType, &codec.CborHandle{})
+}
+
+type CborDecoder struct {
+}
+
+func (self *CborDecoder) Decode(body []byte, wireType interface{}) error {
+	return codec.NewDecoderBytes(body, &codec.CborHandle{}).Decode(wireType)
+}
+
+func (self *CborDecoder) DecodeStream(r io.Reader, wireType interface{}) error {
+	return codec.NewDecoder(r, &codec.CborHandle{}).Decode(wireType)
+}
+
+func encodeWithHandle(wireType interface{}, h codec.Handle) (string, error) {
+	var buff []byte
+	if err := codec.NewEncoderBytes(&buff, h).Encode(wireType); err != nil {
+		return "", err
+	}
+	return string(buff), nil
+}
+
 //Utility routine to send a json blob to the client side.  Encoding errors
 //are logged to the terminal and the client will recv a 500 error.
 func SendJson(w http.ResponseWriter, i interface{}) error {
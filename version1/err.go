@@ -1,17 +1,34 @@
 package seven5
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 )
 
+//PROBLEM_CONTENT_TYPE is the media type of the RFC 7807 problem details
+//documents that are sent to the client for all errors.
+const PROBLEM_CONTENT_TYPE = "application/problem+json"
+
 //Error is a type that can be used by a resource that wants to send a particular
 //HTTP response back to the client.  If a resource returns any error _other_ than
 //this one, it is considered an internal server error.  This should not be used
 //to return 200 "OK" results, use nil instead.
+//
+//Errors are sent to the client as RFC 7807 problem details (application/problem+json).
+//Type is a URI identifying the kind of problem and defaults to "about:blank".
+//Title is a short summary of the kind of problem and defaults to the text for the
+//status code.  Detail is the explanation of this particular occurrence and defaults
+//to Msg.  Instance is a URI identifying this occurrence, and Extensions holds any
+//other members that should be sent, such as the field errors from validation.
 type Error struct {
 	StatusCode int
 	Msg        string
+	Type       string
+	Title      string
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
 }
 
 //error() makes this an implementation of the type error
@@ -20,18 +37,113 @@ func (self *Error) Error() string {
 }
 
 func HTTPError(code int, msg string) *Error {
-	return &Error{code, msg}
+	return &Error{StatusCode: code, Msg: msg}
+}
+
+//Problem returns an error with the type (a URI), title, and detail provided.
+//Use this rather than HTTPError when the client needs to tell different kinds
+//of problem apart.
+func Problem(code int, typ string, title string, detail string) *Error {
+	return &Error{StatusCode: code, Msg: detail, Type: typ, Title: title, Detail: detail}
+}
+
+//With adds an extension member to the problem and returns the error, so it can
+//be chained after HTTPError or Problem.
+func (self *Error) With(name string, value interface{}) *Error {
+	if self.Extensions == nil {
+		self.Extensions = make(map[string]interface{})
+	}
+	self.Extensions[name] = value
+	return self
 }
 
-//WriteError returns an error to the client side.  If the err is of type
-//Error, we decode the fields to produce the correct message and response
-//code.  Otherwise, we return the string of the error content plus the code
-//http.StatusInternalServerError.
+//MarshalJSON encodes the error as a problem details object.  Extensions cannot
+//replace the standard members.
+func (self *Error) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{})
+	for k, v := range self.Extensions {
+		m[k] = v
+	}
+	m["type"] = self.Type
+	if self.Type == "" {
+		m["type"] = "about:blank"
+	}
+	m["title"] = self.Title
+	if self.Title == "" {
+		m["title"] = http.StatusText(self.StatusCode)
+	}
+	m["status"] = self.StatusCode
+	m["detail"] = self.Detail
+	if self.Detail == "" {
+		m["detail"] = self.Msg
+	}
+	if self.Instance != "" {
+		m["instance"] = self.Instance
+	} else {
+		delete(m, "instance")
+	}
+	return json.Marshal(m)
+}
+
+//ParseProblem decodes a problem details object, such as one sent by WriteError,
+//back into an Error.  Members other than the standard ones are placed in
+//Extensions.
+func ParseProblem(data []byte) (*Error, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	result := &Error{}
+	for k, v := range m {
+		switch k {
+		case "status":
+			if f, ok := v.(float64); ok {
+				result.StatusCode = int(f)
+			}
+		case "type":
+			result.Type, _ = v.(string)
+		case "title":
+			result.Title, _ = v.(string)
+		case "detail":
+			result.Detail, _ = v.(string)
+		case "instance":
+			result.Instance, _ = v.(string)
+		default:
+			result.With(k, v)
+		}
+	}
+	result.Msg = result.Detail
+	return result, nil
+}
+
+//WriteError returns an error to the client side as a problem details object.  If
+//the err is of type Error, we use its fields to produce the correct problem and
+//response code.  Otherwise, we return the string of the error content as the
+//detail with the code http.StatusInternalServerError.  Some resources use Error
+//to send other codes, such as http.StatusAccepted with a location; these are
+//not problems, so Msg is sent as plain text as it always has been.
 func WriteError(w http.ResponseWriter, err error) {
 	ourError, ok := err.(*Error)
-	if ok {
+	if !ok {
+		ourError = HTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if ourError.StatusCode < http.StatusBadRequest {
 		http.Error(w, ourError.Msg, ourError.StatusCode)
-	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buff, err := json.Marshal(ourError)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to encode error: %s", err), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", PROBLEM_CONTENT_TYPE)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(ourError.StatusCode)
+	w.Write(buff)
+}
+
+//sendProblem has the same signature as http.Error but sends a problem details
+//object.
+func sendProblem(w http.ResponseWriter, msg string, code int) {
+	WriteError(w, HTTPError(code, msg))
 }
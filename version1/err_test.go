@@ -0,0 +1,40 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblemRoundTrip(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, Problem(http.StatusConflict, "http://example.com/probs/stale", "Stale", "version 3 is old").With("current", 4))
+	if w.Code != http.StatusConflict {
+		t.Errorf("wrong status code %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != PROBLEM_CONTENT_TYPE {
+		t.Errorf("wrong content type %s", ct)
+	}
+	p, err := ParseProblem(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("unable to parse problem: %v", err)
+	}
+	if p.StatusCode != http.StatusConflict || p.Type != "http://example.com/probs/stale" || p.Title != "Stale" ||
+		p.Detail != "version 3 is old" || p.Extensions["current"] != float64(4) {
+		t.Errorf("problem did not survive the round trip: %+v", p)
+	}
+
+	w = httptest.NewRecorder()
+	WriteError(w, HTTPError(http.StatusNotFound, "no such thing"))
+	var m map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("unable to decode problem: %v", err)
+	}
+	if m["type"] != "about:blank" || m["title"] != "Not Found" || m["detail"] != "no such thing" {
+		t.Errorf("wrong defaults for problem: %v", m)
+	}
+	if _, ok := m["instance"]; ok {
+		t.Errorf("should not send an empty instance")
+	}
+}
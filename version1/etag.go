@@ -0,0 +1,207 @@
+package seven5
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//ETagger is an optional interface for wire types that know their own entity
+//tag, typically because they carry a version number.  The value returned
+//must be a complete, quoted entity tag such as the result of VersionETag and
+//is used for every encoding of the object.  Wire types that do not implement
+//this get an entity tag computed from a hash of their json encoding and the
+//media type they are sent as.
+type ETagger interface {
+	ETag() string
+}
+
+//VersionETag returns the entity tag for a version number.  Wire types with a
+//version field can use this to implement ETagger.
+func VersionETag(version int64) string {
+	return fmt.Sprintf("\"v%d\"", version)
+}
+
+//ParseVersionETag returns the version number from an entity tag created
+//by VersionETag.  The second result is false if the tag is not a version.
+func ParseVersionETag(etag string) (int64, bool) {
+	etag = strings.TrimSpace(etag)
+	if !strings.HasPrefix(etag, "\"v") || !strings.HasSuffix(etag, "\"") || len(etag) < 4 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(etag[2:len(etag)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+//ComputeETag returns the entity tag for a wire object sent as the given media
+//type.  Since the tag is strong, it differs between media types even if the
+//wire objects have the same values.  It returns "" for a nil object.
+func ComputeETag(wire interface{}, mediaType string) (string, error) {
+	if wire == nil {
+		return "", nil
+	}
+	if tagger, ok := wire.(ETagger); ok {
+		return tagger.ETag(), nil
+	}
+	buff, err := json.Marshal(wire)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(append([]byte(mediaType+"\n"), buff...))
+	return "\"" + hex.EncodeToString(sum[:]) + "\"", nil
+}
+
+//mediaType returns the media type the response to r will be sent as, if the
+//IOHook chooses it per request, otherwise "".
+func (self *RawDispatcher) mediaType(r *http.Request) string {
+	if checker, ok := self.IO.(AcceptChecker); ok {
+		if mediaType, err := checker.CheckAccept(r); err == nil {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+//matchETag returns true if the header, which is a list of entity tags or "*",
+//matches the etag provided.  Weak tags are never matched if strong is true.
+func matchETag(header string, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+//setETag adds the entity tag of the wire object to the headers that will be
+//returned to the client.
+func (self *RawDispatcher) setETag(r *http.Request, bundle PBundle, wire interface{}) {
+	if etag, err := ComputeETag(wire, self.mediaType(r)); err == nil && etag != "" {
+		bundle.SetReturnHeader("ETag", etag)
+	}
+}
+
+//notModified sets the entity tag of the result of a Find and then checks the
+//If-None-Match header of the request.  If the client already has this version
+//of the object, the 304 (Not Modified) response is sent, with the headers the
+//resource set, and this returns true.
+func (self *RawDispatcher) notModified(w http.ResponseWriter, r *http.Request, bundle PBundle, wire interface{}) bool {
+	mediaType := self.mediaType(r)
+	etag, err := ComputeETag(wire, mediaType)
+	if err != nil || etag == "" {
+		return false
+	}
+	bundle.SetReturnHeader("ETag", etag)
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !matchETag(header, etag, false) {
+		return false
+	}
+	writeReturnHeaders(w, bundle, self.IO.CookieMapper())
+	if mediaType != "" {
+		w.Header().Add("Vary", "Accept")
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+//ifMatch enforces the If-Match header on requests that change an object.  The
+//find function fetches the current value of the object, as filtered for the
+//client, and is nil if the resource cannot Find.  If the precondition fails,
+//the 412 (Precondition Failed) response is sent and this returns false.  If the
+//resource has a ResultFilter, the object is fetched even without If-Match so
+//that objects the client cannot see are a 404.
+func (self *RawDispatcher) ifMatch(w http.ResponseWriter, r *http.Request, find func() (interface{}, error), filtered bool) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" && (!filtered || find == nil) {
+		return true
+	}
+	if find == nil {
+		sendProblem(w, "Unable to check If-Match on a resource without Find", http.StatusPreconditionFailed)
+		return false
+	}
+	current, err := find()
+	if err != nil {
+		if ours, ok := err.(*Error); ok && ours.StatusCode == http.StatusNotFound && header != "" {
+			sendProblem(w, "Precondition failed, no current value", http.StatusPreconditionFailed)
+			return false
+		}
+		self.SendError(err, w, "Internal error on Find (If-Match)")
+		return false
+	}
+	return self.checkIfMatch(w, r, current)
+}
+
+//checkIfMatch compares the If-Match header to the entity tag of the current
+//value of the object.  If the precondition fails, the 412 (Precondition Failed)
+//response is sent and this returns false.
+func (self *RawDispatcher) checkIfMatch(w http.ResponseWriter, r *http.Request, current interface{}) bool {
+	if err := self.ifMatchError(r, current); err != nil {
+		self.SendError(err, w, "Internal error computing ETag")
+		return false
+	}
+	return true
+}
+
+//ifMatchError is checkIfMatch for callers that cannot send the response, it
+//returns the error instead.
+func (self *RawDispatcher) ifMatchError(r *http.Request, current interface{}) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	etag, err := ComputeETag(current, self.mediaType(r))
+	if err != nil {
+		return err
+	}
+	if etag == "" || !matchETag(header, etag, true) {
+		return HTTPError(http.StatusPreconditionFailed,
+			"Precondition failed, the value has been changed").With("etag", etag)
+	}
+	return nil
+}
+
+//finder returns a function that finds the object with the given id and passes
+//it through the ResultFilter, or nil if the resource does not implement Find.
+func finder(rez *restObj, id int64, bundle PBundle) func() (interface{}, error) {
+	if rez.find == nil {
+		return nil
+	}
+	return func() (interface{}, error) {
+		result, err := rez.find.Find(id, bundle)
+		if err != nil {
+			return nil, err
+		}
+		return filterFindResult(&rez.restShared, rez.find, result, bundle)
+	}
+}
+
+//finderUdid is the UDID version of finder.
+func finderUdid(rez *restObjUdid, id string, bundle PBundle) func() (interface{}, error) {
+	if rez.find == nil {
+		return nil
+	}
+	return func() (interface{}, error) {
+		result, err := rez.find.Find(id, bundle)
+		if err != nil {
+			return nil, err
+		}
+		return filterFindResult(&rez.restShared, rez.find, result, bundle)
+	}
+}
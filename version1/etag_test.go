@@ -0,0 +1,153 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type versionedWire struct {
+	Id      int64
+	Version int64
+	Text    string
+}
+
+func (self *versionedWire) ETag() string {
+	return VersionETag(self.Version)
+}
+
+type versionedResource struct {
+	current *versionedWire
+}
+
+func (self *versionedResource) Find(id int64, p PBundle) (interface{}, error) {
+	copy := *self.current
+	return &copy, nil
+}
+
+func (self *versionedResource) Put(id int64, i interface{}, p PBundle) (interface{}, error) {
+	v := i.(*versionedWire)
+	v.Version = self.current.Version + 1
+	self.current = v
+	return v, nil
+}
+
+func (self *versionedResource) Delete(id int64, p PBundle) (interface{}, error) {
+	return self.current, nil
+}
+
+func TestETags(t *testing.T) {
+	if !matchETag(`"a", W/"b"`, `"b"`, false) || matchETag(`"a", W/"b"`, `"b"`, true) || !matchETag("*", `"c"`, true) {
+		t.Errorf("weak and strong comparison of etags is wrong")
+	}
+	if v, ok := ParseVersionETag(VersionETag(42)); !ok || v != 42 {
+		t.Errorf("unable to parse version etag")
+	}
+	if _, ok := ParseVersionETag(`"abc"`); ok {
+		t.Errorf("should not be able to parse a non version etag")
+	}
+	a, _ := ComputeETag(&someWire{Id: 1, Foo: "x"}, "application/json")
+	b, _ := ComputeETag(&someWire{Id: 1, Foo: "y"}, "application/json")
+	c, _ := ComputeETag(&someWire{Id: 1, Foo: "x"}, "application/xml")
+	if a == b || a == c || !strings.HasPrefix(a, "\"") {
+		t.Errorf("bad computed etags %s, %s and %s", a, b, c)
+	}
+}
+
+//cachedResource sets a header on the result of Find, which must be sent with
+//a 304 as well.
+type cachedResource struct {
+	someResource
+}
+
+func (self *cachedResource) Find(id int64, p PBundle) (interface{}, error) {
+	p.SetReturnHeader("Cache-Control", "max-age=60")
+	return self.someResource.Find(id, p)
+}
+
+func TestNotModifiedHeaders(t *testing.T) {
+	raw := NewRawDispatcher(NewNegotiatingIOHook(DefaultCodecRegistry(), nil), nil, nil, "/rest")
+	raw.Rez(&someWire{}, &cachedResource{})
+	get := func(accept string, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/rest/somewire/7", nil)
+		r.Header.Set("Accept", accept)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		raw.Dispatch(nil, w, r)
+		return w
+	}
+	etag := get("application/json", "").Header().Get("ETag")
+	if w := get("application/xml", etag); w.Code != http.StatusOK {
+		t.Errorf("etag for json matched xml: %d", w.Code)
+	}
+	w := get("application/json", etag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected not modified, got %d", w.Code)
+	}
+	if w.Header().Get("Cache-Control") != "max-age=60" || w.Header().Get("Vary") != "Accept" || w.Header().Get("ETag") != etag {
+		t.Errorf("missing headers on not modified: %+v", w.Header())
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	rez := &versionedResource{&versionedWire{Id: 12, Version: 3, Text: "first"}}
+	raw.ResourceSeparate("versionedwire", &versionedWire{}, nil, rez, nil, rez, rez)
+	raw.Rez(&someWire{}, &someResource{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8200", mux)
+	}()
+	client := new(http.Client)
+	url := "http://localhost:8200/rest/versionedwire/12"
+
+	req := makeReq(t, "GET", url, "")
+	resp, err := client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if etag := resp.Header.Get("ETag"); etag != VersionETag(3) {
+		t.Errorf("wrong etag on GET: %s", etag)
+	}
+	req = makeReq(t, "GET", url, "")
+	req.Header.Set("If-None-Match", VersionETag(3))
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusNotModified)
+
+	//computed etags work the same way
+	resp, err = client.Do(makeReq(t, "GET", "http://localhost:8200/rest/somewire/7", ""))
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	req = makeReq(t, "GET", "http://localhost:8200/rest/somewire/7", "")
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusNotModified)
+
+	//two tabs both have version 3, the first one wins
+	body := `{"Id":12, "Version":3, "Text":"second"}`
+	req = makeReq(t, "PUT", url, body)
+	req.Header.Set("If-Match", VersionETag(3))
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if etag := resp.Header.Get("ETag"); etag != VersionETag(4) {
+		t.Errorf("wrong etag on PUT: %s", etag)
+	}
+	req = makeReq(t, "PUT", url, body)
+	req.Header.Set("If-Match", VersionETag(3))
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusPreconditionFailed)
+	if rez.current.Text != "second" || rez.current.Version != 4 {
+		t.Errorf("value was overwritten: %+v", rez.current)
+	}
+
+	req = makeReq(t, "DELETE", url, "")
+	req.Header.Set("If-Match", VersionETag(3))
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusPreconditionFailed)
+	req = makeReq(t, "DELETE", url, "")
+	req.Header.Set("If-Match", "*")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+}
@@ -0,0 +1,148 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+//ResultFilter is an optional interface for the RestIndex implementation of a
+//resource (or sub-resource) that decides, for each element the Index returned,
+//whether the user of the bundle may see it and what parts of it.  This is the
+//place for policies like "normal users only see the elements they own" that
+//AllowReader cannot express.  FilterResult returns false to drop the element,
+//or true and the element to send, which may be a copy with some fields
+//removed (see Redact).  The element sent must be the same type as the one
+//given.  The filter runs after the Index and before the SendHook encodes the
+//result, so pages may be shorter than the limit requested and X-Total-Count
+//counts elements before filtering; when it is cheap to do so, the Index itself
+//should leave out elements the user cannot see.
+//
+//The same filter is applied to the result of Find, for GET of a single element
+//and for the parent elements of a sub-resource, and a dropped element is a 404.
+//PUT, PATCH and DELETE first Find the element and refuse with a 404 if it is
+//dropped, and the results of POST, PUT, PATCH and DELETE are filtered before
+//they are sent.  Entity tags are computed from the filtered element, and a
+//PATCH is applied to the filtered element, with fields the filter removed put
+//back unless the patch changed them.
+//If the resource has no RestIndex, the filter can be implemented by its
+//RestFind.  Resources wrapped with the QbsWrap* functions are filtered if the
+//wrapped value implements ResultFilter.
+type ResultFilter interface {
+	FilterResult(wire interface{}, bundle PBundle) (interface{}, bool)
+}
+
+//filterWrapper is implemented by types, like the qbs wrappers, that hold the
+//implementation of a resource and so need to expose its ResultFilter.
+type filterWrapper interface {
+	resultFilter() (ResultFilter, bool)
+}
+
+//resultFilter returns the ResultFilter of the resource, from its index or, if
+//that does not have one, from its find.
+func resultFilter(shared *restShared, find interface{}) (ResultFilter, bool) {
+	for _, impl := range []interface{}{shared.index, find} {
+		if w, ok := impl.(filterWrapper); ok {
+			if filter, ok := w.resultFilter(); ok {
+				return filter, true
+			}
+			continue
+		}
+		if filter, ok := impl.(ResultFilter); ok {
+			return filter, true
+		}
+	}
+	return nil, false
+}
+
+//filterIndexResult passes each element of the result of the Index through the
+//resource's ResultFilter, if it has one.
+func filterIndexResult(shared *restShared, find interface{}, result interface{}, bundle PBundle) (interface{}, error) {
+	filter, ok := resultFilter(shared, find)
+	if !ok || result == nil {
+		return result, nil
+	}
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("unable to filter the result of the index for %s, expected a slice but got %T",
+			shared.name, result)
+	}
+	elemType := v.Type().Elem()
+	filtered := reflect.MakeSlice(v.Type(), 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		kept, ok := filter.FilterResult(v.Index(i).Interface(), bundle)
+		if !ok {
+			continue
+		}
+		k := reflect.ValueOf(kept)
+		if !k.IsValid() || !k.Type().AssignableTo(elemType) {
+			return nil, fmt.Errorf("ResultFilter for %s returned %T, expected %v", shared.name, kept, elemType)
+		}
+		filtered = reflect.Append(filtered, k)
+	}
+	return filtered.Interface(), nil
+}
+
+//hasResultFilter returns true if the resource has a ResultFilter.
+func hasResultFilter(shared *restShared, find interface{}) bool {
+	_, ok := resultFilter(shared, find)
+	return ok
+}
+
+//unredact puts back the fields of a patched element that the filter removed
+//from the element the patch was applied to, so that a PATCH does not erase
+//what the client cannot see.  All three must be pointers to the same kind
+//of struct, otherwise this does nothing.
+func unredact(original interface{}, visible interface{}, patched interface{}) {
+	o, v, p := reflect.ValueOf(original), reflect.ValueOf(visible), reflect.ValueOf(patched)
+	if o.Kind() != reflect.Ptr || o.Elem().Kind() != reflect.Struct || o.Type() != v.Type() || o.Type() != p.Type() {
+		return
+	}
+	o, v, p = o.Elem(), v.Elem(), p.Elem()
+	for i := 0; i < o.NumField(); i++ {
+		if !p.Field(i).CanSet() {
+			continue
+		}
+		of, vf, pf := o.Field(i).Interface(), v.Field(i).Interface(), p.Field(i).Interface()
+		if !reflect.DeepEqual(of, vf) && reflect.DeepEqual(pf, vf) {
+			p.Field(i).Set(o.Field(i))
+		}
+	}
+}
+
+//filterFindResult passes the result of a Find through the resource's
+//ResultFilter, if it has one.  It returns a 404 error if the filter drops it.
+func filterFindResult(shared *restShared, find interface{}, result interface{}, bundle PBundle) (interface{}, error) {
+	filter, ok := resultFilter(shared, find)
+	if !ok || result == nil {
+		return result, nil
+	}
+	kept, ok := filter.FilterResult(result, bundle)
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no such %s", shared.name))
+	}
+	if reflect.TypeOf(kept) != reflect.TypeOf(result) {
+		return nil, fmt.Errorf("ResultFilter for %s returned %T, expected %T", shared.name, kept, result)
+	}
+	return kept, nil
+}
+
+//Redact returns a copy of the wire object, which must be a pointer to a
+//struct, with the fields named set to their zero values.  The wire object is
+//not changed.  It panics if there is no field with one of the names.
+func Redact(wire interface{}, fields ...string) interface{} {
+	v := reflect.ValueOf(wire)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("Redact needs a pointer to a struct, not %T", wire))
+	}
+	result := reflect.New(v.Elem().Type())
+	result.Elem().Set(v.Elem())
+	for _, name := range fields {
+		f := result.Elem().FieldByName(name)
+		if !f.IsValid() || !f.CanSet() {
+			panic(fmt.Sprintf("%T has no exported field %s to redact", wire, name))
+		}
+		f.Set(reflect.Zero(f.Type()))
+	}
+	return result.Interface()
+}
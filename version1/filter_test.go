@@ -0,0 +1,216 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+type noteWire struct {
+	Id     int64
+	Owner  string
+	Secret string
+}
+
+type noteResource struct {
+	badFilter bool
+}
+
+func (self *noteResource) Index(pb PBundle) (interface{}, error) {
+	return []*noteWire{{1, "fred", "a"}, {2, "barney", "b"}, {3, "fred", "c"}}, nil
+}
+
+func (self *noteResource) Find(id int64, pb PBundle) (interface{}, error) {
+	return &noteWire{id, "barney", "x"}, nil
+}
+
+//FilterResult shows admins everything, and others only their own notes without
+//the secret.
+func (self *noteResource) FilterResult(wire interface{}, pb PBundle) (interface{}, bool) {
+	if self.badFilter {
+		return "wrong", true
+	}
+	user := ""
+	if pb.Session() != nil {
+		user = pb.Session().UserData().(string)
+	}
+	if user == "admin" {
+		return wire, true
+	}
+	note := wire.(*noteWire)
+	if note.Owner != user {
+		return nil, false
+	}
+	return Redact(note, "Secret"), true
+}
+
+//qbsNotes is the qbs form of noteResource, for checking that the filter is
+//found through the wrapper.
+type qbsNotes struct {
+	*noteResource
+}
+
+func (self *qbsNotes) IndexQbs(pb PBundle, tx *qbs.Qbs) (interface{}, error) {
+	return self.Index(pb)
+}
+
+func (self *qbsNotes) FindQbs(id int64, pb PBundle, tx *qbs.Qbs) (interface{}, error) {
+	return self.Find(id, pb)
+}
+
+func TestResultFilter(t *testing.T) {
+	cm, sm, raw := setupTestDispatcher("filtertest")
+	notes := &noteResource{}
+	raw.ResourceSeparate("note", &noteWire{}, notes, notes, nil, nil, nil)
+	raw.Rez(&someWire{}, &someResource{})
+	raw.SubResource(&someWire{}, "note", &noteWire{}, notes, notes, nil, nil, nil)
+
+	fred, _ := sm.Assign("fred", "fred", time.Time{})
+	admin, _ := sm.Assign("admin", "admin", time.Time{})
+	index := func(session Session, url string) ([]*noteWire, int) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		if session != nil {
+			r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: session.SessionId()})
+		}
+		raw.Dispatch(nil, w, r)
+		var result []*noteWire
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return result, w.Code
+	}
+	for _, url := range []string{"/rest/note", "/rest/somewire/7/note"} {
+		result, code := index(fred, url)
+		if code != http.StatusOK || len(result) != 2 || result[0].Id != 1 || result[1].Id != 3 {
+			t.Fatalf("%s: expected fred's notes, got %d %+v", url, code, result)
+		}
+		if result[0].Secret != "" || result[0].Owner != "fred" {
+			t.Errorf("%s: secret not redacted: %+v", url, result[0])
+		}
+		if result, _ := index(nil, url); len(result) != 0 {
+			t.Errorf("%s: expected no notes without a session, got %+v", url, result)
+		}
+		if result, _ := index(admin, url); len(result) != 3 || result[2].Secret != "c" {
+			t.Errorf("%s: expected all notes for admin, got %+v", url, result)
+		}
+	}
+
+	//finds are filtered too, a dropped element does not exist
+	find := func(session Session, url string) (*noteWire, int) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: session.SessionId()})
+		raw.Dispatch(nil, w, r)
+		var result noteWire
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return &result, w.Code
+	}
+	if _, code := find(fred, "/rest/note/2"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a note fred cannot see, got %d", code)
+	}
+	if note, code := find(admin, "/rest/note/2"); code != http.StatusOK || note.Secret != "x" {
+		t.Errorf("expected admin to see the note, got %d %+v", code, note)
+	}
+
+	//resources wrapped for qbs use the filter of the wrapped value
+	wrapped := &restShared{name: "note", index: QbsWrapIndex(&qbsNotes{notes}, nil)}
+	r, _ := http.NewRequest("GET", "/rest/note", nil)
+	pb, _ := NewSimplePBundle(r, fred, sm)
+	all, _ := notes.Index(pb)
+	filtered, err := filterIndexResult(wrapped, nil, all, pb)
+	if err != nil || len(filtered.([]*noteWire)) != 2 {
+		t.Errorf("qbs wrapped index was not filtered: %v %+v", err, filtered)
+	}
+	if _, err := filterFindResult(wrapped, QbsWrapFind(&qbsNotes{notes}, nil), &noteWire{2, "barney", "x"}, pb); err == nil {
+		t.Errorf("qbs wrapped find was not filtered")
+	}
+
+	//the notes are not changed by redaction
+	all, _ = notes.Index(nil)
+	if all.([]*noteWire)[0].Secret != "a" {
+		t.Errorf("redaction changed the original")
+	}
+	notes.badFilter = true
+	if _, code := index(fred, "/rest/note"); code != http.StatusInternalServerError {
+		t.Errorf("expected error from filter with wrong type, got %d", code)
+	}
+}
+
+//noteStore keeps notes so they can be changed, and filters them as
+//noteResource does.
+type noteStore struct {
+	noteResource
+	notes map[int64]*noteWire
+}
+
+func (self *noteStore) Find(id int64, pb PBundle) (interface{}, error) {
+	note, ok := self.notes[id]
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, "no such note")
+	}
+	copy := *note
+	return &copy, nil
+}
+
+func (self *noteStore) Put(id int64, i interface{}, pb PBundle) (interface{}, error) {
+	self.notes[id] = i.(*noteWire)
+	return self.Find(id, pb)
+}
+
+func (self *noteStore) Patch(id int64, i interface{}, pb PBundle) (interface{}, error) {
+	return self.Put(id, i, pb)
+}
+
+func (self *noteStore) Delete(id int64, pb PBundle) (interface{}, error) {
+	result, err := self.Find(id, pb)
+	delete(self.notes, id)
+	return result, err
+}
+
+func TestResultFilterWrites(t *testing.T) {
+	cm, sm, raw := setupTestDispatcher("filtertest")
+	store := &noteStore{notes: map[int64]*noteWire{1: {1, "fred", "a"}, 2: {2, "barney", "b"}}}
+	raw.ResourceSeparate("note", &noteWire{}, nil, store, nil, store, store)
+	fred, _ := sm.Assign("fred", "fred", time.Time{})
+	send := func(method string, url string, body string, ifMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: fred.SessionId()})
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		raw.Dispatch(nil, w, r)
+		return w
+	}
+
+	//an empty patch does not reveal the secret, or erase it
+	w := send("PATCH", "/rest/note/1", "{}", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"a"`) {
+		t.Errorf("patch result not filtered: %d %s", w.Code, w.Body.String())
+	}
+	if store.notes[1].Secret != "a" {
+		t.Errorf("patch erased the redacted field: %+v", store.notes[1])
+	}
+
+	//the etag from GET can be used with If-Match
+	etag := send("GET", "/rest/note/1", "", "").Header().Get("ETag")
+	if w := send("PUT", "/rest/note/1", `{"Id":1,"Owner":"fred","Secret":"z"}`, etag); w.Code != http.StatusOK {
+		t.Errorf("etag from GET refused by If-Match: %d %s", w.Code, w.Body.String())
+	} else if strings.Contains(w.Body.String(), `"z"`) {
+		t.Errorf("put result not filtered: %s", w.Body.String())
+	}
+
+	//notes fred cannot see cannot be changed
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		if w := send(method, "/rest/note/2", `{"Id":2,"Owner":"fred"}`, ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s of a hidden note, got %d", method, w.Code)
+		}
+	}
+	if store.notes[2] == nil || store.notes[2].Owner != "barney" {
+		t.Errorf("hidden note was changed: %+v", store.notes[2])
+	}
+}
@@ -0,0 +1,282 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	INDEX_LIMIT_PARAM  = "limit"
+	INDEX_OFFSET_PARAM = "offset"
+	INDEX_CURSOR_PARAM = "cursor"
+	INDEX_SORT_PARAM   = "sort"
+	INDEX_FILTER_PARAM = "filter"
+
+	//DEFAULT_INDEX_LIMIT is the limit used for an Index when the client does
+	//not give one, unless it is changed with SetIndexLimits.
+	DEFAULT_INDEX_LIMIT = 100
+	//MAX_INDEX_LIMIT is the largest limit a client may ask for, unless it is
+	//changed with SetIndexLimits.
+	MAX_INDEX_LIMIT = 1000
+)
+
+//SortField is one of the fields that the client asked to sort an index by.
+//Clients send these as sort=Name,-Created where a leading - means descending.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+//Filter is a constraint on the results of an index that the client asked for.
+//Clients send these as filter[Field]=value, which is an equality check, or
+//filter[Field][op]=value for the other operations.  The operations are eq, ne,
+//lt, lte, gt, gte, like and in; the value for "in" is a comma separated list.
+//Args holds the value (or values) converted to the type of the wire field, and
+//is filled in when the query is checked against the wire type.
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+	Args  []interface{}
+}
+
+//IndexQuery is the standard query contract for RestIndex implementations.  It is
+//parsed from the query parameters of the request and is available from the
+//PBundle via IndexQuery().  The dispatcher sets the Limit to the resource's
+//default if the client did not give one and lowers it to the resource's
+//maximum (see SetIndexLimits); a Limit of zero means there is no limit. Index
+//implementations that know the total number of items matching the filters
+//should set Total so the dispatcher can send X-Total-Count and Link headers; a
+//Total of -1 means unknown. Implementations that page by cursor rather than
+//offset should set NextCursor to the value the client should send to get the
+//next page, or leave it empty when there are no more items.
+type IndexQuery struct {
+	Limit      int
+	Offset     int
+	Cursor     string
+	Sort       []SortField
+	Filters    []Filter
+	Total      int64
+	NextCursor string
+}
+
+var filterOps = map[string]string{
+	"eq":   "=",
+	"ne":   "<>",
+	"lt":   "<",
+	"lte":  "<=",
+	"gt":   ">",
+	"gte":  ">=",
+	"like": "LIKE",
+	"in":   "IN",
+}
+
+//ParseIndexQuery creates an IndexQuery from a set of (single valued) query
+//parameters.  The returned error is an *Error with the code http.StatusBadRequest
+//if the parameters are not understood.
+func ParseIndexQuery(q map[string]string) (*IndexQuery, error) {
+	result := &IndexQuery{Total: -1}
+	for k, v := range q {
+		var err error
+		switch {
+		case k == INDEX_LIMIT_PARAM:
+			result.Limit, err = strconv.Atoi(v)
+			if err == nil && result.Limit < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case k == INDEX_OFFSET_PARAM:
+			result.Offset, err = strconv.Atoi(v)
+			if err == nil && result.Offset < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case k == INDEX_CURSOR_PARAM:
+			result.Cursor = v
+		case k == INDEX_SORT_PARAM:
+			for _, f := range strings.Split(v, ",") {
+				f = strings.TrimSpace(f)
+				if f == "" {
+					continue
+				}
+				sf := SortField{Field: strings.TrimPrefix(f, "-"), Desc: strings.HasPrefix(f, "-")}
+				result.Sort = append(result.Sort, sf)
+			}
+		case strings.HasPrefix(k, INDEX_FILTER_PARAM+"["):
+			var f Filter
+			f, err = parseFilter(k, v)
+			result.Filters = append(result.Filters, f)
+		}
+		if err != nil {
+			return nil, HTTPError(http.StatusBadRequest, fmt.Sprintf("bad query parameter %s: %v", k, err))
+		}
+	}
+	return result, nil
+}
+
+//parseFilter understands filter[Field] and filter[Field][op].
+func parseFilter(k string, v string) (Filter, error) {
+	rest := strings.TrimPrefix(k, INDEX_FILTER_PARAM+"[")
+	end := strings.Index(rest, "]")
+	if end <= 0 {
+		return Filter{}, fmt.Errorf("expected filter[field]")
+	}
+	f := Filter{Field: rest[:end], Op: "eq", Value: v}
+	rest = rest[end+1:]
+	if rest != "" {
+		if !strings.HasPrefix(rest, "[") || !strings.HasSuffix(rest, "]") {
+			return Filter{}, fmt.Errorf("expected filter[field][op]")
+		}
+		f.Op = strings.ToLower(rest[1 : len(rest)-1])
+	}
+	if _, ok := filterOps[f.Op]; !ok {
+		return Filter{}, fmt.Errorf("unknown filter operation %s", f.Op)
+	}
+	return f, nil
+}
+
+//Check verifies that all the sort and filter fields are exported fields of the
+//wire type provided, which must be a pointer to a struct.  Field names are
+//matched without regard to case and are replaced by the name of the struct
+//field.  Filter values are converted to the type of the field. The returned
+//error is an *Error with the code http.StatusBadRequest.
+func (self *IndexQuery) Check(wire reflect.Type) error {
+	strukt := wire.Elem()
+	lookup := func(name string) (reflect.StructField, bool) {
+		for i := 0; i < strukt.NumField(); i++ {
+			f := strukt.Field(i)
+			if f.PkgPath == "" && strings.EqualFold(f.Name, name) {
+				return f, true
+			}
+		}
+		return reflect.StructField{}, false
+	}
+	for i, s := range self.Sort {
+		f, ok := lookup(s.Field)
+		if !ok {
+			return HTTPError(http.StatusBadRequest, fmt.Sprintf("cannot sort by unknown field %s", s.Field))
+		}
+		self.Sort[i].Field = f.Name
+	}
+	for i, filter := range self.Filters {
+		f, ok := lookup(filter.Field)
+		if !ok {
+			return HTTPError(http.StatusBadRequest, fmt.Sprintf("cannot filter by unknown field %s", filter.Field))
+		}
+		raw := []string{filter.Value}
+		if filter.Op == "in" {
+			raw = strings.Split(filter.Value, ",")
+		}
+		args := []interface{}{}
+		for _, r := range raw {
+			arg, err := convertFilterValue(f.Type, r)
+			if err != nil {
+				return HTTPError(http.StatusBadRequest, fmt.Sprintf("bad value for filter on %s: %v", f.Name, err))
+			}
+			args = append(args, arg)
+		}
+		self.Filters[i].Field = f.Name
+		self.Filters[i].Args = args
+	}
+	return nil
+}
+
+func convertFilterValue(t reflect.Type, raw string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(raw, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(raw, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(raw, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	}
+	return raw, nil
+}
+
+//Operator returns the SQL operator for the filter's operation.
+func (self Filter) Operator() string {
+	return filterOps[self.Op]
+}
+
+//SetIndexLimits changes the limit used for the Index of the resource with the
+//given name (see SetCORSPolicy for the names of subresources) when the client
+//does not give one, and the largest limit the client may ask for.  Zero means
+//there is no limit.  This call panics if the resource cannot be found, because
+//this indicates that the program is misconfigured.
+func (self *RawDispatcher) SetIndexLimits(name string, defaultLimit int, maxLimit int) {
+	shared := self.findRestShared(name)
+	if shared == nil {
+		panic(fmt.Sprintf("unable to find resource %s", name))
+	}
+	shared.defaultLimit = defaultLimit
+	shared.maxLimit = maxLimit
+}
+
+//indexQuery fetches the query from the bundle, checks it against the resource
+//and applies the resource's limits.
+func (self *RawDispatcher) indexQuery(bundle PBundle, obj *restShared) (*IndexQuery, error) {
+	query, err := bundle.IndexQuery()
+	if err != nil {
+		return nil, err
+	}
+	if err := query.Check(obj.typ); err != nil {
+		return nil, err
+	}
+	if query.Limit == 0 {
+		query.Limit = obj.defaultLimit
+	}
+	if obj.maxLimit > 0 && (query.Limit == 0 || query.Limit > obj.maxLimit) {
+		query.Limit = obj.maxLimit
+	}
+	return query, nil
+}
+
+//paginationHeaders adds the X-Total-Count and Link headers to the bundle's
+//return headers based on what the Index implementation left in the query.
+func (self *RawDispatcher) paginationHeaders(r *http.Request, query *IndexQuery, bundle PBundle) {
+	if query.Total >= 0 {
+		bundle.SetReturnHeader("X-Total-Count", fmt.Sprint(query.Total))
+	}
+	link := func(rel string, params map[string]string) string {
+		v := url.Values{}
+		for k, values := range r.URL.Query() {
+			v[k] = values
+		}
+		v.Del(INDEX_OFFSET_PARAM)
+		v.Del(INDEX_CURSOR_PARAM)
+		for k, p := range params {
+			v.Set(k, p)
+		}
+		return fmt.Sprintf("<%s?%s>; rel=\"%s\"", r.URL.Path, v.Encode(), rel)
+	}
+	links := []string{}
+	if query.NextCursor != "" {
+		links = append(links, link("next", map[string]string{INDEX_CURSOR_PARAM: query.NextCursor}))
+	} else if query.Limit > 0 && query.Cursor == "" {
+		offset := func(o int) map[string]string {
+			return map[string]string{INDEX_OFFSET_PARAM: fmt.Sprint(o)}
+		}
+		links = append(links, link("first", offset(0)))
+		if query.Offset > 0 {
+			prev := query.Offset - query.Limit
+			if prev < 0 {
+				prev = 0
+			}
+			links = append(links, link("prev", offset(prev)))
+		}
+		if query.Total < 0 || int64(query.Offset+query.Limit) < query.Total {
+			links = append(links, link("next", offset(query.Offset+query.Limit)))
+		}
+		if query.Total > 0 {
+			last := int((query.Total - 1) / int64(query.Limit) * int64(query.Limit))
+			links = append(links, link("last", offset(last)))
+		}
+	}
+	if len(links) > 0 {
+		bundle.SetReturnHeader("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,162 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type pagedResource struct {
+}
+
+func (self *pagedResource) Index(pb PBundle) (interface{}, error) {
+	query, err := pb.IndexQuery()
+	if err != nil {
+		return nil, err
+	}
+	query.Total = 25
+	return []*someWire{&someWire{int64(query.Offset), "paged"}}, nil
+}
+
+//limitResource remembers the limit it was asked for.
+type limitResource struct {
+	limit int
+}
+
+func (self *limitResource) Index(pb PBundle) (interface{}, error) {
+	query, err := pb.IndexQuery()
+	if err != nil {
+		return nil, err
+	}
+	self.limit = query.Limit
+	return []*someWire{}, nil
+}
+
+func TestParseIndexQuery(t *testing.T) {
+	q, err := ParseIndexQuery(map[string]string{
+		"limit":            "10",
+		"offset":           "20",
+		"sort":             "foo,-Id",
+		"filter[foo]":      "bar",
+		"filter[id][gte]":  "3",
+		"filter[id][in]":   "1,2,3",
+		"somethingelse":    "ignored",
+		"filter[foo][lte]": "zzz",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing query: %v", err)
+	}
+	if q.Limit != 10 || q.Offset != 20 || q.Total != -1 {
+		t.Errorf("bad limit/offset/total: %+v", q)
+	}
+	if !reflect.DeepEqual(q.Sort, []SortField{{"foo", false}, {"Id", true}}) {
+		t.Errorf("bad sort fields: %+v", q.Sort)
+	}
+	if len(q.Filters) != 4 {
+		t.Fatalf("expected 4 filters but got %d", len(q.Filters))
+	}
+	if err := q.Check(reflect.TypeOf(&someWire{})); err != nil {
+		t.Fatalf("unexpected error checking query: %v", err)
+	}
+	if q.Sort[0].Field != "Foo" {
+		t.Errorf("field name not normalized: %s", q.Sort[0].Field)
+	}
+	for _, f := range q.Filters {
+		switch f.Op {
+		case "gte":
+			if f.Field != "Id" || f.Operator() != ">=" || !reflect.DeepEqual(f.Args, []interface{}{int64(3)}) {
+				t.Errorf("bad gte filter: %+v", f)
+			}
+		case "in":
+			if len(f.Args) != 3 {
+				t.Errorf("bad in filter: %+v", f)
+			}
+		}
+	}
+
+	for _, bad := range []map[string]string{
+		{"limit": "ten"},
+		{"offset": "-1"},
+		{"filter[foo][frob]": "1"},
+		{"filter[": "1"},
+	} {
+		if _, err := ParseIndexQuery(bad); err == nil {
+			t.Errorf("expected error from %+v", bad)
+		}
+	}
+	q, _ = ParseIndexQuery(map[string]string{"filter[id]": "notanumber"})
+	if err := q.Check(reflect.TypeOf(&someWire{})); err == nil {
+		t.Errorf("expected error from non-numeric id filter")
+	}
+	q, _ = ParseIndexQuery(map[string]string{"sort": "nope"})
+	if err := q.Check(reflect.TypeOf(&someWire{})); err == nil {
+		t.Errorf("expected error from unknown sort field")
+	}
+}
+
+func TestPaginationHeaders(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.ResourceSeparate("Paged", &someWire{}, &pagedResource{}, nil, nil, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8196", mux)
+	}()
+
+	resp, err := http.Get("http://localhost:8196/rest/paged?limit=10&offset=10")
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	if resp.Header.Get("X-Total-Count") != "25" {
+		t.Errorf("bad total count: %s", resp.Header.Get("X-Total-Count"))
+	}
+	link := resp.Header.Get("Link")
+	for _, expected := range []string{
+		`</rest/paged?limit=10&offset=0>; rel="first"`,
+		`</rest/paged?limit=10&offset=0>; rel="prev"`,
+		`</rest/paged?limit=10&offset=20>; rel="next"`,
+		`</rest/paged?limit=10&offset=20>; rel="last"`,
+	} {
+		if strings.Index(link, expected) == -1 {
+			t.Errorf("expected to find %s in link header %s", expected, link)
+		}
+	}
+
+	resp, err = http.Get("http://localhost:8196/rest/paged?sort=bogus")
+	checkHttpStatus(t, resp, err, http.StatusBadRequest)
+}
+
+func TestIndexLimits(t *testing.T) {
+	_, _, raw := setupTestDispatcher("limittest")
+	rez := &limitResource{}
+	raw.ResourceSeparate("limited", &someWire{}, rez, nil, nil, nil, nil)
+	limit := func(url string) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		raw.Dispatch(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", url, w.Code)
+		}
+		return rez.limit
+	}
+	for url, expected := range map[string]int{
+		"/rest/limited":            DEFAULT_INDEX_LIMIT,
+		"/rest/limited?limit=0":    DEFAULT_INDEX_LIMIT,
+		"/rest/limited?limit=10":   10,
+		"/rest/limited?limit=5000": MAX_INDEX_LIMIT,
+	} {
+		if l := limit(url); l != expected {
+			t.Errorf("%s: expected limit %d but got %d", url, expected, l)
+		}
+	}
+
+	raw.SetIndexLimits("limited", 0, 50)
+	if l := limit("/rest/limited"); l != 50 {
+		t.Errorf("expected the maximum without a limit, got %d", l)
+	}
+	raw.SetIndexLimits("limited", 0, 0)
+	if l := limit("/rest/limited?limit=5000"); l != 5000 {
+		t.Errorf("expected no maximum, got %d", l)
+	}
+}
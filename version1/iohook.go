@@ -1,15 +1,21 @@
 package seven5
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"reflect"
 	"time"
 )
 
+//BODY_TOO_LARGE is returned from reads of a request body that has gone past
+//the limit for its resource.
+var BODY_TOO_LARGE = errors.New("Body is too large")
+
 //IOHook is an interface provided as a convenience to those who want to override
 //the behavior of some aspect of reading and writing web content.  This can be used
 //to change the format of http input/output (such as ignoring parts of the body
@@ -24,10 +30,13 @@ type IOHook interface {
 }
 
 //RawIOHook is the default implementation of the IOHook used by the RawDispatcher.
+//If Codecs is not nil, the encoder and decoder are chosen from it based on the
+//Accept and Content-Type headers of each request and Dec and Enc are ignored.
 type RawIOHook struct {
 	Dec       Decoder
 	Enc       Encoder
 	CookieMap CookieMapper
+	Codecs    *CodecRegistry
 }
 
 //CookieMapper is exposed because other parts of the system may need access to the
@@ -46,40 +55,123 @@ func NewRawIOHook(d Decoder, e Encoder, c CookieMapper) *RawIOHook {
 	return &RawIOHook{Dec: d, Enc: e, CookieMap: c}
 }
 
+//NewNegotiatingIOHook returns a new RawIOHook ptr that picks the format used
+//for each request from the codecs provided (see DefaultCodecRegistry). Clients
+//that send a body the registry does not understand get a 415 (Unsupported Media
+//Type) and clients that accept nothing the registry can produce get a 406 (Not
+//Acceptable).
+func NewNegotiatingIOHook(codecs *CodecRegistry, c CookieMapper) *RawIOHook {
+	return &RawIOHook{Codecs: codecs, CookieMap: c}
+}
+
+//AcceptChecker is an optional interface for an IOHook.  If the dispatcher's IOHook
+//has it, CheckAccept is called before any method of a resource is run so that
+//a request whose result cannot be sent is refused without changing anything.
+//The media type returned is the one the result will be sent as, or "" if the
+//IOHook always uses the same one; it is part of computed entity tags.
+type AcceptChecker interface {
+	CheckAccept(r *http.Request) (string, error)
+}
+
+//CheckAccept returns an error with the code http.StatusNotAcceptable if this
+//object has Codecs and none of them can produce what the client accepts.
+func (self *RawIOHook) CheckAccept(r *http.Request) (string, error) {
+	if self.Codecs == nil {
+		return "", nil
+	}
+	_, mediaType, ok := self.Codecs.Encoder(r.Header.Get("Accept"))
+	if !ok {
+		return "", HTTPError(http.StatusNotAcceptable,
+			fmt.Sprintf("unable to produce any of %s", r.Header.Get("Accept")))
+	}
+	return mediaType, nil
+}
+
 //BodyHook is called to create a wire object of the appopriate type and fill in the values
 //in that object from the request body.  BodyHook calls the decoder provided at creation time
 //take the bytes provided by the body and initialize the object that is ultimately returned.
+//If the decoder is a StreamDecoder, the body is decoded as it is read rather than being
+//read into memory first.  Bodies larger than the resource's limit (see SetBodyLimit)
+//result in an error with the code http.StatusRequestEntityTooLarge.
 func (self *RawIOHook) BodyHook(r *http.Request, obj *restShared) (interface{}, error) {
-	limitedData := make([]byte, MAX_FORM_SIZE)
-	curr := 0
-	gotEof := false
-	for curr < len(limitedData) {
-		n, err := r.Body.Read(limitedData[curr:])
-		curr += n
-		if err != nil && err == io.EOF {
-			gotEof = true
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+	dec := self.Dec
+	limit := obj.bodyLimit()
+	if r.ContentLength > limit {
+		return nil, bodyTooLarge(limit)
 	}
-	//if curr==0 then we are done because there is no body
-	if curr == 0 {
+	if r.Body == nil {
 		return nil, nil
 	}
-	if !gotEof {
-		return nil, errors.New(fmt.Sprintf("Body is too large! max is %d", MAX_FORM_SIZE))
+	body := &limitedBody{r: r.Body, max: limit}
+	buffered := bufio.NewReader(body)
+	//if there is nothing to read, we are done because there is no body
+	if _, err := buffered.Peek(1); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if self.Codecs != nil {
+		var ok bool
+		dec, ok = self.Codecs.Decoder(r.Header.Get("Content-Type"))
+		if !ok {
+			return nil, HTTPError(http.StatusUnsupportedMediaType,
+				fmt.Sprintf("unable to understand %s", r.Header.Get("Content-Type")))
+		}
 	}
 	//we have a body of data, need to decode it... first allocate one
 	strukt := obj.typ.Elem() //we have checked that this is a ptr to struct at insert
 	wireObj := reflect.New(strukt)
-	if err := self.Dec.Decode(limitedData[:curr], wireObj.Interface()); err != nil {
+	var err error
+	if stream, ok := dec.(StreamDecoder); ok {
+		err = stream.DecodeStream(buffered, wireObj.Interface())
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadAll(buffered); err == nil {
+			err = dec.Decode(data, wireObj.Interface())
+		}
+	}
+	if body.exceeded() {
+		return nil, bodyTooLarge(limit)
+	}
+	if err != nil {
 		return nil, err
 	}
 	return wireObj.Interface(), nil
 }
 
+//limitedBody is a reader that fails once more than max bytes have been read
+//from the underlying reader.
+type limitedBody struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (self *limitedBody) Read(p []byte) (int, error) {
+	if self.exceeded() {
+		return 0, BODY_TOO_LARGE
+	}
+	//never read more than one byte past the limit
+	if remaining := self.max - self.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := self.r.Read(p)
+	self.read += int64(n)
+	if self.exceeded() {
+		return n, BODY_TOO_LARGE
+	}
+	return n, err
+}
+
+func (self *limitedBody) exceeded() bool {
+	return self.read > self.max
+}
+
+func bodyTooLarge(limit int64) *Error {
+	return HTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Body is too large! max is %d", limit))
+}
+
 //BundleHook is called to create the bundle of parameters from the request. It often will be
 //using cookies and sessions to compute the bundle.  Note that the ResponseWriter is passed
 //here but the BundleHook _must_ be careful to not force it out the server--it should only
@@ -87,6 +179,7 @@ func (self *RawIOHook) BodyHook(r *http.Request, obj *restShared) (interface{},
 //of the pbundle does Update().
 func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm SessionManager) (PBundle, error) {
 	var session Session
+	renewed := false
 	if self.CookieMap != nil {
 		var err error
 		id, err := self.CookieMap.Value(r)
@@ -105,7 +198,11 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 					self.CookieMap.RemoveCookie(w)
 				}
 				if sr != nil {
-					if sr.UniqueId != "" {
+					if isPendingUniqueId(sr.UniqueId) {
+						//partial sessions are not recreated, the user
+						//has to log in again
+						self.CookieMap.RemoveCookie(w)
+					} else if sr.UniqueId != "" {
 						//create a new one?
 						ud, genErr := sm.Generate(sr.UniqueId)
 						if genErr != nil {
@@ -116,10 +213,14 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 							if assignErr != nil {
 								return nil, assignErr
 							}
+							//the new session has a new id, so the client
+							//must be told or every request will regenerate
+							self.CookieMap.AssociateCookie(w, session)
 						}
 					} else {
 						//we have a session
 						session = sr.Session
+						renewed = sr.Renewed
 					}
 				}
 			}
@@ -129,29 +230,44 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 	if err != nil {
 		return nil, err
 	}
+	if spb, ok := pb.(*simplePBundle); ok && renewed {
+		//the cookie's lifetime follows the session, so it must be sent
+		//again with the new expiration time
+		spb.reissued = true
+	}
 	return pb, nil
 }
 
 //SendHook is called to encode and write the object provided onto the output via the response
 //writer.  The last parameter if not "" is assumed to be a location header.  If the location
 //parameter is provided, then the response code is "Created" otherwise "OK" is returned.
-//SendHook calls the encoder for the encoding of the object into a sequence of bytes for transmission.
+//SendHook calls the encoder for the encoding of the object into a sequence of bytes for transmission;
+//the encoder is chosen by the client's Accept header if this object has Codecs.
 //If the pb is not null, then the SendHook should examine it for outgoing headers, trailers, and
 //transmit them.
 func (self *RawIOHook) SendHook(d *restShared, w http.ResponseWriter, pb PBundle, i interface{}, location string) {
 	if err := self.verifyReturnType(d, i); err != nil {
-		http.Error(w, fmt.Sprintf("%s", err), http.StatusExpectationFailed)
+		sendProblem(w, fmt.Sprintf("%s", err), http.StatusExpectationFailed)
 		return
 	}
-	encoded, err := self.Enc.Encode(i, true)
+	enc, mediaType := self.Enc, "text/json"
+	if self.Codecs != nil {
+		accept, _ := pb.Header("Accept")
+		var ok bool
+		enc, mediaType, ok = self.Codecs.Encoder(accept)
+		if !ok {
+			sendProblem(w, fmt.Sprintf("unable to produce any of %s", accept), http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+	}
+	encoded, err := enc.Encode(i, true)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to encode: %s", err), http.StatusInternalServerError)
+		sendProblem(w, fmt.Sprintf("unable to encode: %s", err), http.StatusInternalServerError)
 		return
 	}
-	for _, k := range pb.ReturnHeaders() {
-		w.Header().Add(k, pb.ReturnHeader(k))
-	}
-	w.Header().Add("Content-Type", "text/json")
+	writeReturnHeaders(w, pb, self.CookieMap)
+	w.Header().Add("Content-Type", mediaType)
 	if location != "" {
 		w.Header().Add("Location", location)
 		w.WriteHeader(http.StatusCreated)
@@ -164,6 +280,17 @@ func (self *RawIOHook) SendHook(d *restShared, w http.ResponseWriter, pb PBundle
 	}
 }
 
+//writeReturnHeaders copies the headers set by the resource into the response,
+//along with the session cookie if the session was reissued or renewed.
+func writeReturnHeaders(w http.ResponseWriter, pb PBundle, cm CookieMapper) {
+	for _, k := range pb.ReturnHeaders() {
+		w.Header().Add(k, pb.ReturnHeader(k))
+	}
+	if spb, ok := pb.(*simplePBundle); ok && spb.reissued && cm != nil {
+		cm.AssociateCookie(w, spb.s)
+	}
+}
+
 func (self *RawIOHook) verifyReturnType(obj *restShared, w interface{}) error {
 	if w == nil {
 		return nil
@@ -0,0 +1,248 @@
+package seven5
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+//KEY_ID_SEPARATOR separates the key id from the encrypted part of a session id.
+const KEY_ID_SEPARATOR = "."
+
+//SESSION_ID_AEAD marks session ids that are sealed with AES-GCM.  These have the
+//form keyid.g.hex; older ids have the form keyid.hex or just hex.
+const SESSION_ID_AEAD = "g"
+
+//Keyring holds the keys used to encrypt session ids.  Each key has an id that
+//is placed in front of the session ids it encrypts, so that session ids issued
+//under an older key can still be decrypted after a new primary key is added.
+//New session ids are always encrypted with the primary key.  To rotate keys,
+//add a new primary key and keep the old one in the keyring until all the
+//sessions issued under it have expired.
+//
+//Session ids are sealed with AES-GCM, so any change to an id is detected.
+//Ids in the older, unauthenticated format are refused unless
+//AcceptLegacyUntil has been called.
+type Keyring struct {
+	primary     string
+	blocks      map[string]cipher.Block
+	aeads       map[string]cipher.AEAD
+	order       []string
+	legacyUntil time.Time
+}
+
+//KeySource is the interface for loading a Keyring from somewhere, such as the
+//environment (EnvKeySource) or a file (FileKeySource).  Applications that keep
+//their keys in a secret store can implement this interface.
+type KeySource interface {
+	Keyring() (*Keyring, error)
+}
+
+//NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		blocks: make(map[string]cipher.Block),
+		aeads:  make(map[string]cipher.AEAD),
+	}
+}
+
+//Add puts a key in the keyring with the given id.  The key must be 16, 24, or 32
+//bytes for AES-128, AES-192, or AES-256.  The id must not be empty or contain
+//KEY_ID_SEPARATOR.  The first key added is the primary key unless another
+//key is added with primary set to true.
+func (self *Keyring) Add(id string, key []byte, primary bool) error {
+	if id == "" || strings.Contains(id, KEY_ID_SEPARATOR) {
+		return fmt.Errorf("bad key id '%s'", id)
+	}
+	if _, ok := self.blocks[id]; ok {
+		return fmt.Errorf("duplicate key id '%s'", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("bad key %s: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("bad key %s: %v", id, err)
+	}
+	self.blocks[id] = block
+	self.aeads[id] = aead
+	self.order = append(self.order, id)
+	if primary || self.primary == "" {
+		self.primary = id
+	}
+	return nil
+}
+
+//AddHex is the same as Add, but the key is given as a hex string.
+func (self *Keyring) AddHex(id string, keyHex string, primary bool) error {
+	key, err := hex.DecodeString(strings.TrimSpace(keyHex))
+	if err != nil {
+		return fmt.Errorf("unable to decode key %s, maybe it's not in hex? %v", id, err)
+	}
+	return self.Add(id, key, primary)
+}
+
+//Primary returns the id of the primary key, or "" if the keyring is empty.
+func (self *Keyring) Primary() string {
+	return self.primary
+}
+
+//Ids returns the ids of all the keys in the order they were added.
+func (self *Keyring) Ids() []string {
+	return append([]string{}, self.order...)
+}
+
+//AcceptLegacyUntil allows session ids in the older, unauthenticated format
+//until the cutoff, so that sessions stored by the session manager before an
+//upgrade are still found.  Since these ids can be changed by the client
+//without detection, they are only used to find a session that is already
+//stored, never to recreate one with a Generator, and the cutoff should be no
+//later than the expiration of the last session issued before the upgrade.
+//The zero time, the default, refuses them.
+func (self *Keyring) AcceptLegacyUntil(cutoff time.Time) {
+	self.legacyUntil = cutoff
+}
+
+//sessionIdInfo is what can be recovered from a session id.  Legacy is true
+//if the id is in the older format; the expiration time of these is not known.
+type sessionIdInfo struct {
+	uniq    string
+	expires time.Time
+	legacy  bool
+}
+
+//encrypt seals the unique id and expiration time with the primary key and
+//returns the session id, which is the key id, SESSION_ID_AEAD, and the hex
+//of the sealed bytes.
+func (self *Keyring) encrypt(uniqueInfo string, expires time.Time) string {
+	return self.primary + KEY_ID_SEPARATOR + SESSION_ID_AEAD + KEY_ID_SEPARATOR +
+		sealSessionId(uniqueInfo, expires, self.primary, self.aeads[self.primary])
+}
+
+//decrypt recovers the unique id from a session id created with encrypt.  It
+//refuses legacy ids, so the unique id can be trusted to recreate a session.
+func (self *Keyring) decrypt(sessionId string) (string, bool) {
+	info, ok := self.open(sessionId)
+	if !ok || info.legacy {
+		return "", false
+	}
+	return info.uniq, true
+}
+
+//open recovers what it can from a session id.  If legacy ids are accepted,
+//ids from before there were key ids are tried with each key in turn.
+func (self *Keyring) open(sessionId string) (*sessionIdInfo, bool) {
+	parts := strings.SplitN(sessionId, KEY_ID_SEPARATOR, 3)
+	if len(parts) == 3 {
+		aead, ok := self.aeads[parts[0]]
+		if !ok || parts[1] != SESSION_ID_AEAD {
+			return nil, false
+		}
+		uniq, expires, ok := openSessionId(parts[2], parts[0], aead)
+		if !ok {
+			return nil, false
+		}
+		return &sessionIdInfo{uniq: uniq, expires: expires}, true
+	}
+	if !time.Now().Before(self.legacyUntil) {
+		return nil, false
+	}
+	if len(parts) == 2 {
+		block, ok := self.blocks[parts[0]]
+		if !ok {
+			return nil, false
+		}
+		uniq, ok := decryptSessionId(parts[1], block)
+		if !ok {
+			return nil, false
+		}
+		return &sessionIdInfo{uniq: uniq, legacy: true}, true
+	}
+	for _, id := range self.order {
+		if uniq, ok := decryptSessionId(sessionId, self.blocks[id]); ok {
+			return &sessionIdInfo{uniq: uniq, legacy: true}, true
+		}
+	}
+	return nil, false
+}
+
+//EnvKeySource loads keys from the environment.  SERVER_SESSION_KEYS, if set, is
+//a comma separated list of id:hexkey pairs and the first one is the primary
+//key.  Otherwise, SERVER_SESSION_KEY is a single hex key that is given the id "0".
+type EnvKeySource struct {
+}
+
+//Keyring reads the keys from the environment.
+func (self *EnvKeySource) Keyring() (*Keyring, error) {
+	result := NewKeyring()
+	if all := strings.TrimSpace(os.Getenv("SERVER_SESSION_KEYS")); all != "" {
+		for _, pair := range strings.Split(all, ",") {
+			idAndKey := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+			if len(idAndKey) != 2 {
+				return nil, fmt.Errorf("expected id:key in SERVER_SESSION_KEYS but got '%s'", pair)
+			}
+			if err := result.AddHex(idAndKey[0], idAndKey[1], false); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	keyRaw := strings.TrimSpace(os.Getenv("SERVER_SESSION_KEY"))
+	if keyRaw == "" {
+		return nil, fmt.Errorf("unable to find environment variable SERVER_SESSION_KEY")
+	}
+	if len(keyRaw) != aes.BlockSize*2 {
+		return nil, fmt.Errorf("expected SERVER_SESSION_KEY length to be %d, but was %d", aes.BlockSize*2, len(keyRaw))
+	}
+	if err := result.AddHex("0", keyRaw, true); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//FileKeySource loads keys from a file.  Each line of the file has a key id and
+//a hex key separated by white space; blank lines and lines starting with # are
+//ignored.  The first key is the primary key unless another line has a third
+//field of "primary".
+type FileKeySource struct {
+	Path string
+}
+
+//Keyring reads the keys from the file.
+func (self *FileKeySource) Keyring() (*Keyring, error) {
+	f, err := os.Open(self.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := NewKeyring()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "primary") {
+			return nil, fmt.Errorf("%s:%d: expected 'id key [primary]'", self.Path, line)
+		}
+		if err := result.AddHex(fields[0], fields[1], len(fields) == 3); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", self.Path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if result.Primary() == "" {
+		return nil, fmt.Errorf("no keys found in %s", self.Path)
+	}
+	return result, nil
+}
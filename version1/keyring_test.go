@@ -0,0 +1,145 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	old := NewKeyring()
+	if err := old.AddHex("2015", strings.Repeat("1", 32), true); err != nil {
+		t.Fatalf("unable to add key: %v", err)
+	}
+	mgr := NewKeyringSessionManager(&testGen{}, &SessionPolicy{}, old)
+	s, err := mgr.Assign("fred", "fred", time.Time{})
+	if err != nil {
+		t.Fatalf("unable to assign session: %v", err)
+	}
+	if !strings.HasPrefix(s.SessionId(), "2015"+KEY_ID_SEPARATOR) {
+		t.Errorf("session id should start with the key id: %s", s.SessionId())
+	}
+
+	//new primary key, the old one is still accepted
+	rotated := NewKeyring()
+	rotated.AddHex("2015", strings.Repeat("1", 32), false)
+	rotated.AddHex("2016", strings.Repeat("2", 32), true)
+	if rotated.Primary() != "2016" || len(rotated.Ids()) != 2 {
+		t.Fatalf("wrong keys in keyring: %s %v", rotated.Primary(), rotated.Ids())
+	}
+	uniq, ok := rotated.decrypt(s.SessionId())
+	if !ok || uniq != "fred" {
+		t.Errorf("unable to decrypt session id from the old key: %s %v", uniq, ok)
+	}
+	if !strings.HasPrefix(rotated.encrypt("x", time.Now().Add(time.Hour)), "2016"+KEY_ID_SEPARATOR) {
+		t.Errorf("new session ids should use the primary key")
+	}
+
+	//old key removed
+	onlyNew := NewKeyring()
+	onlyNew.AddHex("2016", strings.Repeat("2", 32), true)
+	if _, ok := onlyNew.decrypt(s.SessionId()); ok {
+		t.Errorf("should not decrypt session id after the key is removed")
+	}
+
+	//session ids from before key ids are refused unless there is a cutoff,
+	//and even then cannot be used to recreate a session
+	legacy := encryptSessionId(computeRawSessionId("barney", time.Now().Add(time.Hour)), old.blocks["2015"])
+	if _, ok := rotated.open(legacy); ok {
+		t.Errorf("should not accept legacy session id by default")
+	}
+	rotated.AcceptLegacyUntil(time.Now().Add(time.Hour))
+	if info, ok := rotated.open(legacy); !ok || info.uniq != "barney" || !info.legacy {
+		t.Errorf("unable to open legacy session id: %+v %v", info, ok)
+	}
+	if _, ok := rotated.decrypt(legacy); ok {
+		t.Errorf("legacy session id should not give a unique id to regenerate")
+	}
+	rotated.AcceptLegacyUntil(time.Now().Add(-time.Second))
+	if _, ok := rotated.open(legacy); ok {
+		t.Errorf("should not accept legacy session id after the cutoff")
+	}
+
+	if err := rotated.AddHex("2016", strings.Repeat("3", 32), false); err == nil {
+		t.Errorf("expected error for duplicate key id")
+	}
+	if err := rotated.AddHex("a.b", strings.Repeat("3", 32), false); err == nil {
+		t.Errorf("expected error for key id with separator")
+	}
+}
+
+func TestKeySources(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEYS", "a:"+strings.Repeat("4", 32)+", b:"+strings.Repeat("5", 64))
+	ring, err := (&EnvKeySource{}).Keyring()
+	os.Unsetenv("SERVER_SESSION_KEYS")
+	if err != nil {
+		t.Fatalf("unable to read keys from environment: %v", err)
+	}
+	if ring.Primary() != "a" || len(ring.Ids()) != 2 {
+		t.Errorf("wrong keys from environment: %s %v", ring.Primary(), ring.Ids())
+	}
+
+	f, err := ioutil.TempFile("", "seven5keys")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# session keys\n\nold " + strings.Repeat("6", 32) + "\nnew " + strings.Repeat("7", 32) + " primary\n")
+	f.Close()
+	ring, err = (&FileKeySource{Path: f.Name()}).Keyring()
+	if err != nil {
+		t.Fatalf("unable to read keys from file: %v", err)
+	}
+	if ring.Primary() != "new" || strings.Join(ring.Ids(), ",") != "old,new" {
+		t.Errorf("wrong keys from file: %s %v", ring.Primary(), ring.Ids())
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("bad\n"), 0600)
+	if _, err = (&FileKeySource{Path: f.Name()}).Keyring(); err == nil {
+		t.Errorf("expected error for malformed key file")
+	}
+}
+
+func TestSessionIdTamper(t *testing.T) {
+	ring := NewKeyring()
+	ring.AddHex("k1", strings.Repeat("8", 32), true)
+	ring.AddHex("k2", strings.Repeat("9", 32), false)
+	sid := ring.encrypt("wilma", time.Now().Add(time.Hour))
+	parts := strings.Split(sid, KEY_ID_SEPARATOR)
+	if len(parts) != 3 || parts[0] != "k1" || parts[1] != SESSION_ID_AEAD {
+		t.Fatalf("unexpected session id format: %s", sid)
+	}
+	if uniq, ok := ring.decrypt(sid); !ok || uniq != "wilma" {
+		t.Fatalf("unable to decrypt session id: %s %v", uniq, ok)
+	}
+
+	//flip each hex digit in turn
+	for i := range parts[2] {
+		b := []byte(parts[2])
+		if b[i] == '0' {
+			b[i] = '1'
+		} else {
+			b[i] = '0'
+		}
+		if _, ok := ring.decrypt(parts[0] + "." + parts[1] + "." + string(b)); ok {
+			t.Fatalf("tampered session id accepted (digit %d)", i)
+		}
+	}
+	//moved to another key
+	if _, ok := ring.decrypt("k2." + parts[1] + "." + parts[2]); ok {
+		t.Errorf("session id accepted under the wrong key id")
+	}
+	//truncated
+	if _, ok := ring.decrypt(sid[:len(sid)-2]); ok {
+		t.Errorf("truncated session id accepted")
+	}
+	if _, ok := ring.decrypt("k1.g.00"); ok {
+		t.Errorf("short session id accepted")
+	}
+	//expired
+	if _, ok := ring.decrypt(ring.encrypt("wilma", time.Now().Add(-time.Second))); ok {
+		t.Errorf("expired session id accepted")
+	}
+}
@@ -0,0 +1,117 @@
+package seven5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MailMessage is a plain text email.
+type MailMessage struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+//Bytes returns the message in the form sent over SMTP, with headers.
+func (self *MailMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", self.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(self.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", strings.Replace(self.Subject, "\n", " ", -1))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.Replace(self.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+//Mailer delivers email.  The application supplies one to the parts of seven5
+//that send mail, such as PasswordReset.
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+//SMTPMailer sends mail through an SMTP server, such as "smtp.example.com:587".
+//Auth may be nil if the server does not need it; otherwise it is typically
+//smtp.PlainAuth.  The connection is upgraded with STARTTLS if the server offers it.
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+}
+
+//NewSMTPMailer returns a mailer that uses plain authentication with the server
+//at addr (host:port).  If username is "", no authentication is used.
+func NewSMTPMailer(addr string, username string, password string) *SMTPMailer {
+	result := &SMTPMailer{Addr: addr}
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		result.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return result
+}
+
+//Send delivers the message to the SMTP server.
+func (self *SMTPMailer) Send(msg *MailMessage) error {
+	return smtp.SendMail(self.Addr, self.Auth, msg.From, msg.To, msg.Bytes())
+}
+
+//WriterMailer does not deliver mail, it writes each message to a writer.  It
+//is for development and tests: use os.Stdout to see the messages in the server's
+//output or NewFileMailer to keep them in a file.  The messages are also kept in
+//Sent so a test can look at them.
+type WriterMailer struct {
+	W    io.Writer
+	Sent []*MailMessage
+	lock sync.Mutex
+}
+
+//NewWriterMailer returns a mailer that writes messages to w.
+func NewWriterMailer(w io.Writer) *WriterMailer {
+	return &WriterMailer{W: w}
+}
+
+//NewFileMailer returns a mailer that appends messages to the file at path,
+//creating it if necessary.
+func NewFileMailer(path string) (*WriterMailer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterMailer(f), nil
+}
+
+//Send writes the message, followed by a separator line.
+func (self *WriterMailer) Send(msg *MailMessage) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Sent = append(self.Sent, msg)
+	if self.W == nil {
+		return nil
+	}
+	if _, err := self.W.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	_, err := io.WriteString(self.W, "\r\n-----\r\n")
+	return err
+}
+
+//Last returns the most recent message sent, or nil.
+func (self *WriterMailer) Last() *MailMessage {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.Sent) == 0 {
+		return nil
+	}
+	return self.Sent[len(self.Sent)-1]
+}
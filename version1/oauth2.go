@@ -0,0 +1,366 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	//OAUTH_STATE_COOKIE holds the state of a login that is in progress, so the
+	//callback can check that it was started by the same browser.
+	OAUTH_STATE_COOKIE = "seven5-oauth-state"
+	//OAUTH_STATE_LIFETIME is how long the user has to complete a login with
+	//the provider.
+	OAUTH_STATE_LIFETIME = 10 * time.Minute
+)
+
+//Oauth2Provider describes an OAuth2 authorization server.  Scopes are the
+//scopes requested by default.  UserInfoURL is the endpoint for details about
+//the logged in user and may be empty.
+type Oauth2Provider struct {
+	Name        string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	Scopes      []string
+}
+
+var (
+	//GITHUB_OAUTH2 is the provider for logging in with github.
+	GITHUB_OAUTH2 = &Oauth2Provider{
+		Name:        "github",
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+	}
+	//GOOGLE_OAUTH2 is the provider for logging in with google.
+	GOOGLE_OAUTH2 = &Oauth2Provider{
+		Name:        "google",
+		AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:    "https://oauth2.googleapis.com/token",
+		UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		Scopes:      []string{"openid", "email", "profile"},
+	}
+)
+
+//Oauth2Connector is an OauthConnector for the OAuth2 authorization code flow
+//with PKCE.  The PKCE verifier is computed from the state and the client secret,
+//so the connector keeps nothing between the phases and any server process can
+//finish a login started by another.  The state must therefore be unguessable,
+//which is the case for the state created by OauthHandler.
+//
+//The provider requires the same redirect URI in both phases, so the callback
+//path passed to Phase1 and UserInteractionURL must be the path of the redirect
+//URL given at creation time, or empty.  The first parameter of Phase2 is the
+//state (see ClientTokenValueName).
+type Oauth2Connector struct {
+	provider *Oauth2Provider
+	detail   OauthClientDetail
+	redirect *url.URL
+	key      []byte
+	Client   *http.Client
+}
+
+//NewOauth2Connector returns a connector for the provider.  The client id and
+//secret are taken from the detail using the provider's name, and redirectURL
+//is the full URL of the callback, such as https://example.com/auth/github/callback.
+func NewOauth2Connector(provider *Oauth2Provider, detail OauthClientDetail, redirectURL string) (*Oauth2Connector, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("redirect url must be absolute: %s", redirectURL)
+	}
+	key := []byte(detail.ClientSecret(provider.Name))
+	if len(key) == 0 {
+		//public client, verifiers do not survive a restart
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+	}
+	return &Oauth2Connector{
+		provider: provider,
+		detail:   detail,
+		redirect: u,
+		key:      key,
+		Client:   http.DefaultClient,
+	}, nil
+}
+
+//Name returns the name of the provider.
+func (self *Oauth2Connector) Name() string {
+	return self.provider.Name
+}
+
+//Provider returns the provider this connector talks to.
+func (self *Oauth2Connector) Provider() *Oauth2Provider {
+	return self.provider
+}
+
+//CallbackPath returns the path of the redirect URL.
+func (self *Oauth2Connector) CallbackPath() string {
+	return self.redirect.Path
+}
+
+//ClientTokenValueName is "state", since OAuth2 has no client token and the
+//state is what Phase2 needs.
+func (self *Oauth2Connector) ClientTokenValueName() string {
+	return "state"
+}
+
+func (self *Oauth2Connector) CodeValueName() string {
+	return "code"
+}
+
+func (self *Oauth2Connector) ErrorValueName() string {
+	return "error"
+}
+
+func (self *Oauth2Connector) StateValueName() string {
+	return "state"
+}
+
+//Phase1 has nothing to do for OAuth2 other than checking the callback path.
+func (self *Oauth2Connector) Phase1(state string, callbackPath string) (OauthCred, error) {
+	if callbackPath != "" && callbackPath != self.redirect.Path {
+		return nil, fmt.Errorf("callback path %s does not match redirect url %s", callbackPath, self.redirect)
+	}
+	return nil, nil
+}
+
+//verifier returns the PKCE code verifier for the state.
+func (self *Oauth2Connector) verifier(state string) string {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte("pkce:" + state))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//UserInteractionURL returns the URL of the provider's page where the user
+//grants access.  The PKCE challenge is the S256 hash of the verifier for the
+//state.
+func (self *Oauth2Connector) UserInteractionURL(p1creds OauthCred, state string, callbackPath string) string {
+	sum := sha256.Sum256([]byte(self.verifier(state)))
+	v := url.Values{
+		"response_type":         []string{"code"},
+		"client_id":             []string{self.detail.ClientId(self.provider.Name)},
+		"redirect_uri":          []string{self.redirect.String()},
+		"state":                 []string{state},
+		"code_challenge":        []string{base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": []string{"S256"},
+	}
+	if len(self.provider.Scopes) > 0 {
+		v.Set("scope", strings.Join(self.provider.Scopes, " "))
+	}
+	sep := "?"
+	if strings.Contains(self.provider.AuthURL, "?") {
+		sep = "&"
+	}
+	return self.provider.AuthURL + sep + v.Encode()
+}
+
+//oauth2Token is the response from the token endpoint.
+type oauth2Token struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+//Phase2 exchanges the code for an access token.  The first parameter is the
+//state that was given to UserInteractionURL.
+func (self *Oauth2Connector) Phase2(state string, code string) (OauthConnection, error) {
+	v := url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+		"redirect_uri":  []string{self.redirect.String()},
+		"client_id":     []string{self.detail.ClientId(self.provider.Name)},
+		"client_secret": []string{self.detail.ClientSecret(self.provider.Name)},
+		"code_verifier": []string{self.verifier(state)},
+	}
+	req, err := http.NewRequest("POST", self.provider.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := self.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var tok oauth2Token
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, fmt.Errorf("unable to understand token from %s (%d): %v", self.provider.Name, resp.StatusCode, err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("%s refused the code: %s %s", self.provider.Name, tok.Error, tok.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tok.AccessToken == "" {
+		return nil, fmt.Errorf("no access token from %s (%d)", self.provider.Name, resp.StatusCode)
+	}
+	result := &Oauth2Connection{
+		AccessToken:  tok.AccessToken,
+		TokenType:    tok.TokenType,
+		RefreshToken: tok.RefreshToken,
+		client:       self.Client,
+	}
+	if tok.ExpiresIn > 0 {
+		result.Expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return result, nil
+}
+
+//Oauth2Connection is the OauthConnection returned by Oauth2Connector.  It sends
+//the access token as a bearer token.
+type Oauth2Connection struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	Expires      time.Time
+	client       *http.Client
+}
+
+//SendAuthenticated adds the access token to the request and sends it.
+func (self *Oauth2Connection) SendAuthenticated(r *http.Request) (*http.Response, error) {
+	r.Header.Set("Authorization", "Bearer "+self.AccessToken)
+	if r.Header.Get("Accept") == "" {
+		r.Header.Set("Accept", "application/json")
+	}
+	return self.client.Do(r)
+}
+
+//OauthHandler drives the login with an OauthConnector.  Bind LoginHandler to
+//the path that starts a login (such as /auth/github/login) and CallbackHandler
+//to the callback path of the connector.  The login may have a "state" query
+//parameter, which is given back to the LoginLandingPage of the PageMapper.
+//Connected, if not nil, is called once the connection to the provider is made
+//and before the browser is sent to the landing page; if it returns an error,
+//the browser is sent to the ErrorPage instead.
+type OauthHandler struct {
+	conn      OauthConnector
+	pm        PageMapper
+	callback  string
+	secure    bool
+	Connected func(OauthConnector, OauthConnection, http.ResponseWriter, *http.Request) error
+}
+
+//NewOauthHandler returns a handler for logins with the connector that land on
+//the pages of the PageMapper.  The callbackPath is passed to the connector
+//and must be where the CallbackHandler is bound.  If secure is true, the state
+//cookie is only sent over https.
+func NewOauthHandler(conn OauthConnector, pm PageMapper, callbackPath string, secure bool) *OauthHandler {
+	return &OauthHandler{
+		conn:     conn,
+		pm:       pm,
+		callback: callbackPath,
+		secure:   secure,
+	}
+}
+
+//stateCookie returns the cookie for the login state.
+func (self *OauthHandler) stateCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     OAUTH_STATE_COOKIE + "-" + self.conn.Name(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   self.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+//LoginHandler starts a login by sending the browser to the provider.
+func (self *OauthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	nonce := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		http.Redirect(w, r, self.pm.ErrorPage(self.conn, "unable to create state"), http.StatusFound)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(nonce)
+	appState := base64.RawURLEncoding.EncodeToString([]byte(r.URL.Query().Get("state")))
+	cred, err := self.conn.Phase1(state, self.callback)
+	if err != nil {
+		log.Printf("[OAUTH] phase 1 failed for %s: %v", self.conn.Name(), err)
+		http.Redirect(w, r, self.pm.ErrorPage(self.conn, err.Error()), http.StatusFound)
+		return
+	}
+	http.SetCookie(w, self.stateCookie(state+"."+appState, int(OAUTH_STATE_LIFETIME/time.Second)))
+	http.Redirect(w, r, self.conn.UserInteractionURL(cred, state, self.callback), http.StatusFound)
+}
+
+//CallbackHandler finishes a login when the provider sends the browser back.
+//The state from the provider must match the state cookie of the browser.
+func (self *OauthHandler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	http.SetCookie(w, self.stateCookie("", -1))
+	if e := q.Get(self.conn.ErrorValueName()); e != "" {
+		http.Redirect(w, r, self.pm.ErrorPage(self.conn, e), http.StatusFound)
+		return
+	}
+	state, appState, ok := self.checkState(r, q.Get(self.conn.StateValueName()))
+	if !ok {
+		http.Redirect(w, r, self.pm.ErrorPage(self.conn, "login state does not match"), http.StatusFound)
+		return
+	}
+	code := q.Get(self.conn.CodeValueName())
+	clientToken := q.Get(self.conn.ClientTokenValueName())
+	if clientToken == "" {
+		clientToken = state
+	}
+	conn, err := self.conn.Phase2(clientToken, code)
+	if err != nil {
+		log.Printf("[OAUTH] phase 2 failed for %s: %v", self.conn.Name(), err)
+		http.Redirect(w, r, self.pm.ErrorPage(self.conn, "unable to connect to "+self.conn.Name()), http.StatusFound)
+		return
+	}
+	if self.Connected != nil {
+		if err := self.Connected(self.conn, conn, w, r); err != nil {
+			log.Printf("[OAUTH] login with %s refused: %v", self.conn.Name(), err)
+			http.Redirect(w, r, self.pm.ErrorPage(self.conn, err.Error()), http.StatusFound)
+			return
+		}
+	}
+	http.Redirect(w, r, self.pm.LoginLandingPage(self.conn, appState, code), http.StatusFound)
+}
+
+//checkState compares the state from the provider to the state cookie and
+//returns the state and the application's state.
+func (self *OauthHandler) checkState(r *http.Request, state string) (string, string, bool) {
+	c, err := r.Cookie(self.stateCookie("", 0).Name)
+	if err != nil || state == "" {
+		return "", "", false
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(state)) != 1 {
+		return "", "", false
+	}
+	appState, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return state, string(appState), true
+}
+
+//LogoutHandler sends the browser to the LogoutLandingPage.
+func (self *OauthHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, self.pm.LogoutLandingPage(self.conn), http.StatusFound)
+}
@@ -0,0 +1,151 @@
+package seven5
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testClientDetail struct {
+}
+
+func (self *testClientDetail) ClientId(serviceName string) string {
+	return serviceName + "-id"
+}
+
+func (self *testClientDetail) ClientSecret(serviceName string) string {
+	return serviceName + "-secret"
+}
+
+//fakeAuthServer issues the code "good" and checks the PKCE verifier against
+//the challenge it was given.
+type fakeAuthServer struct {
+	challenge string
+}
+
+func (self *fakeAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/token":
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "good" || r.Form.Get("client_secret") != "fake-secret" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != self.challenge {
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"tok123","token_type":"bearer","expires_in":3600}`))
+	case "/user":
+		if r.Header.Get("Authorization") != "Bearer tok123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"login":"fred"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestOauth2(t *testing.T) {
+	fake := &fakeAuthServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	provider := &Oauth2Provider{
+		Name:        "fake",
+		AuthURL:     server.URL + "/authorize",
+		TokenURL:    server.URL + "/token",
+		UserInfoURL: server.URL + "/user",
+		Scopes:      []string{"email"},
+	}
+	conn, err := NewOauth2Connector(provider, &testClientDetail{}, "http://localhost/auth/fake/callback")
+	if err != nil {
+		t.Fatalf("unable to create connector: %v", err)
+	}
+	pm := NewSimplePageMapper("/error", "/welcome", "/bye")
+	handler := NewOauthHandler(conn, pm, conn.CallbackPath(), false)
+	var connected OauthConnection
+	handler.Connected = func(c OauthConnector, oc OauthConnection, w http.ResponseWriter, r *http.Request) error {
+		connected = oc
+		return nil
+	}
+
+	//start the login
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/auth/fake/login?state=inbox", nil)
+	handler.LoginHandler(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider but got %d", w.Code)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if !strings.HasPrefix(loc.String(), provider.AuthURL) || loc.Query().Get("code_challenge_method") != "S256" ||
+		loc.Query().Get("client_id") != "fake-id" || loc.Query().Get("redirect_uri") != "http://localhost/auth/fake/callback" {
+		t.Fatalf("bad authorization url: %s", loc)
+	}
+	fake.challenge = loc.Query().Get("code_challenge")
+	state := loc.Query().Get("state")
+	stateCookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(stateCookies) != 1 {
+		t.Fatalf("expected state cookie")
+	}
+
+	callback := func(query string, cookie bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost/auth/fake/callback?"+query, nil)
+		if cookie {
+			r.AddCookie(stateCookies[0])
+		}
+		handler.CallbackHandler(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected redirect from callback but got %d", w.Code)
+		}
+		return w
+	}
+
+	//state from another browser
+	w = callback("code=good&state="+state, false)
+	if !strings.HasPrefix(w.Header().Get("Location"), "/error?") {
+		t.Errorf("login without state cookie should fail: %s", w.Header().Get("Location"))
+	}
+	w = callback("code=good&state=forged", true)
+	if !strings.HasPrefix(w.Header().Get("Location"), "/error?") {
+		t.Errorf("login with wrong state should fail: %s", w.Header().Get("Location"))
+	}
+	//provider refused
+	w = callback("error=access_denied&state="+state, true)
+	if !strings.Contains(w.Header().Get("Location"), "access_denied") {
+		t.Errorf("error from provider not passed to error page: %s", w.Header().Get("Location"))
+	}
+	//bad code
+	w = callback("code=bad&state="+state, true)
+	if !strings.HasPrefix(w.Header().Get("Location"), "/error?") || connected != nil {
+		t.Errorf("bad code should fail: %s", w.Header().Get("Location"))
+	}
+
+	w = callback("code=good&state="+state, true)
+	landing, _ := url.Parse(w.Header().Get("Location"))
+	if landing.Path != "/welcome" || landing.Query().Get("state") != "inbox" || landing.Query().Get("service") != "fake" {
+		t.Errorf("wrong landing page: %s", landing)
+	}
+	if connected == nil {
+		t.Fatalf("connected was not called")
+	}
+	req, _ := http.NewRequest("GET", provider.UserInfoURL, nil)
+	resp, err := connected.SendAuthenticated(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("authenticated request failed: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.LogoutHandler(w, r)
+	if !strings.HasPrefix(w.Header().Get("Location"), "/bye?") {
+		t.Errorf("wrong logout page: %s", w.Header().Get("Location"))
+	}
+
+	if GITHUB_OAUTH2.Name != "github" || GOOGLE_OAUTH2.Name != "google" {
+		t.Errorf("bad presets")
+	}
+}
@@ -0,0 +1,319 @@
+package seven5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//EnvOauthClientDetail is an OauthClientDetail that reads the client id and
+//secret from environment variables named after the service: the service name is
+//upper-cased, any character that is not a letter or digit becomes an
+//underscore, and _CLIENT_ID or _CLIENT_SECRET is added.  So the credentials for
+//"github" are in GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET.  If Prefix is not
+//empty, it is put in front of every name, such as MYAPP_GITHUB_CLIENT_ID for
+//the prefix "MYAPP_".
+type EnvOauthClientDetail struct {
+	Prefix string
+}
+
+//EnvName returns the environment variable for the item ("CLIENT_ID" or
+//"CLIENT_SECRET") of the service.
+func (self *EnvOauthClientDetail) EnvName(serviceName string, item string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, serviceName)
+	return self.Prefix + name + "_" + item
+}
+
+func (self *EnvOauthClientDetail) ClientId(serviceName string) string {
+	return strings.TrimSpace(os.Getenv(self.EnvName(serviceName, "CLIENT_ID")))
+}
+
+func (self *EnvOauthClientDetail) ClientSecret(serviceName string) string {
+	return strings.TrimSpace(os.Getenv(self.EnvName(serviceName, "CLIENT_SECRET")))
+}
+
+func (self *EnvOauthClientDetail) locate(serviceName string, item string) string {
+	return self.EnvName(serviceName, item)
+}
+
+//fileCredentials are the credentials for one service in a FileOauthClientDetail.
+type fileCredentials struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+//FileOauthClientDetail is an OauthClientDetail that reads the credentials from
+//a file of secrets, which should not be checked in with the source code.  Files
+//ending in .toml have a table for each service:
+//
+//	[github]
+//	client_id = "abc"
+//	client_secret = 'xyz'
+//
+//Only this much of TOML is understood: tables, strings on one line and comments.
+//Other keys and values are reported as errors.
+//
+//Other files are json with an object for each service:
+//
+//	{"github": {"client_id": "abc", "client_secret": "xyz"}}
+type FileOauthClientDetail struct {
+	path     string
+	services map[string]*fileCredentials
+}
+
+//NewFileOauthClientDetail reads the credentials from the file.
+func NewFileOauthClientDetail(path string) (*FileOauthClientDetail, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &FileOauthClientDetail{path: path, services: make(map[string]*fileCredentials)}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		err = result.parseToml(data)
+	} else {
+		err = json.Unmarshal(data, &result.services)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read oauth credentials from %s: %v", path, err)
+	}
+	return result, nil
+}
+
+//parseToml understands the part of TOML that is needed for the credentials:
+//comments, tables with a bare or quoted name, and keys set to basic ("...")
+//or literal ('...') strings on one line.  Anything else, including dotted
+//names, arrays of tables, other kinds of value, keys other than client_id and
+//client_secret, and repeated tables or keys, is an error rather than being
+//ignored, since it would not mean what the author intended.
+func (self *FileOauthClientDetail) parseToml(data []byte) error {
+	var current *fileCredentials
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[[") {
+			return fmt.Errorf("line %d: arrays of tables are not supported", line)
+		}
+		if strings.HasPrefix(text, "[") {
+			name, rest, err := tomlKey(strings.TrimSpace(text[1:]))
+			if err == nil && !strings.HasPrefix(rest, "]") {
+				err = fmt.Errorf("expected ] after the table name")
+			}
+			if err == nil {
+				err = tomlEnd(rest[1:])
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			if _, ok := self.services[name]; ok {
+				return fmt.Errorf("line %d: table %s is defined twice", line, name)
+			}
+			current = &fileCredentials{}
+			self.services[name] = current
+			seen = make(map[string]bool)
+			continue
+		}
+		if current == nil {
+			return fmt.Errorf("line %d: keys must be in a table for the service", line)
+		}
+		key, rest, err := tomlKey(text)
+		if err == nil && !strings.HasPrefix(rest, "=") {
+			err = fmt.Errorf("expected key = \"value\"")
+		}
+		var value string
+		if err == nil {
+			value, rest, err = tomlString(strings.TrimSpace(rest[1:]))
+		}
+		if err == nil {
+			err = tomlEnd(rest)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if seen[key] {
+			return fmt.Errorf("line %d: %s is set twice", line, key)
+		}
+		seen[key] = true
+		switch key {
+		case "client_id":
+			current.ClientId = value
+		case "client_secret":
+			current.ClientSecret = value
+		default:
+			return fmt.Errorf("line %d: unknown key %s", line, key)
+		}
+	}
+	return scanner.Err()
+}
+
+//tomlKey reads a bare or quoted key from the start of text and returns it
+//with the rest of the text, without leading spaces.  Dotted keys are an error.
+func tomlKey(text string) (string, string, error) {
+	var key, rest string
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		var err error
+		key, rest, err = tomlString(text)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		end := strings.IndexFunc(text, func(r rune) bool {
+			return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '_' || r == '-')
+		})
+		if end < 0 {
+			end = len(text)
+		}
+		key, rest = text[:end], text[end:]
+		if key == "" {
+			return "", "", fmt.Errorf("expected a name")
+		}
+	}
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, ".") {
+		return "", "", fmt.Errorf("dotted names are not supported")
+	}
+	return key, rest, nil
+}
+
+//tomlString reads a basic or literal string from the start of text and returns
+//its value and the rest of the text.  Multi-line strings are not supported.
+func tomlString(text string) (string, string, error) {
+	if strings.HasPrefix(text, "\"\"\"") || strings.HasPrefix(text, "'''") {
+		return "", "", fmt.Errorf("multi-line strings are not supported")
+	}
+	if strings.HasPrefix(text, "'") {
+		end := strings.Index(text[1:], "'")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return text[1 : end+1], text[end+2:], nil
+	}
+	if !strings.HasPrefix(text, "\"") {
+		return "", "", fmt.Errorf("expected a quoted string")
+	}
+	var result bytes.Buffer
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"':
+			return result.String(), text[i+1:], nil
+		case c != '\\':
+			result.WriteByte(c)
+			continue
+		case i+1 == len(text):
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		i++
+		switch text[i] {
+		case 'b':
+			result.WriteByte('\b')
+		case 't':
+			result.WriteByte('\t')
+		case 'n':
+			result.WriteByte('\n')
+		case 'f':
+			result.WriteByte('\f')
+		case 'r':
+			result.WriteByte('\r')
+		case '"', '\\':
+			result.WriteByte(text[i])
+		case 'u', 'U':
+			size := 4
+			if text[i] == 'U' {
+				size = 8
+			}
+			if i+size >= len(text) {
+				return "", "", fmt.Errorf("bad unicode escape")
+			}
+			r, err := strconv.ParseUint(text[i+1:i+1+size], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", "", fmt.Errorf("bad unicode escape")
+			}
+			result.WriteRune(rune(r))
+			i += size
+		default:
+			return "", "", fmt.Errorf("unknown escape \\%c", text[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+//tomlEnd checks that nothing but a comment follows a value.
+func tomlEnd(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %s", rest)
+	}
+	return nil
+}
+
+func (self *FileOauthClientDetail) ClientId(serviceName string) string {
+	if c, ok := self.services[serviceName]; ok {
+		return c.ClientId
+	}
+	return ""
+}
+
+func (self *FileOauthClientDetail) ClientSecret(serviceName string) string {
+	if c, ok := self.services[serviceName]; ok {
+		return c.ClientSecret
+	}
+	return ""
+}
+
+func (self *FileOauthClientDetail) locate(serviceName string, item string) string {
+	return fmt.Sprintf("%s: %s.%s", self.path, serviceName, strings.ToLower(item))
+}
+
+//credentialLocator is implemented by the OauthClientDetails in this package to
+//say where a missing credential should be.
+type credentialLocator interface {
+	locate(serviceName string, item string) string
+}
+
+//ValidateOauthClientDetail checks that the detail has a client id and secret for
+//each of the services.  Call this at startup.  The error returned is a
+//*ValidationError with every missing credential, not just the first.
+func ValidateOauthClientDetail(detail OauthClientDetail, serviceNames ...string) error {
+	result := &ValidationError{}
+	for _, service := range serviceNames {
+		for _, item := range []string{"CLIENT_ID", "CLIENT_SECRET"} {
+			var value string
+			if item == "CLIENT_ID" {
+				value = detail.ClientId(service)
+			} else {
+				value = detail.ClientSecret(service)
+			}
+			if value != "" {
+				continue
+			}
+			where := fmt.Sprintf("%s %s", service, strings.ToLower(item))
+			if locator, ok := detail.(credentialLocator); ok {
+				where = locator.locate(service, item)
+			}
+			result.Add(where, "missing oauth credential")
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+	return nil
+}
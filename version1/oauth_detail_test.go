@@ -0,0 +1,102 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvOauthClientDetail(t *testing.T) {
+	detail := &EnvOauthClientDetail{Prefix: "S5TEST_"}
+	if name := detail.EnvName("google-apps", "CLIENT_ID"); name != "S5TEST_GOOGLE_APPS_CLIENT_ID" {
+		t.Errorf("wrong environment variable name: %s", name)
+	}
+	os.Setenv("S5TEST_GITHUB_CLIENT_ID", "abc")
+	os.Setenv("S5TEST_GITHUB_CLIENT_SECRET", "xyz")
+	defer os.Unsetenv("S5TEST_GITHUB_CLIENT_ID")
+	defer os.Unsetenv("S5TEST_GITHUB_CLIENT_SECRET")
+	if detail.ClientId("github") != "abc" || detail.ClientSecret("github") != "xyz" {
+		t.Errorf("wrong credentials from environment")
+	}
+	if err := ValidateOauthClientDetail(detail, "github"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := ValidateOauthClientDetail(detail, "github", "google", "twitter")
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 4 {
+		t.Fatalf("expected all four missing credentials: %v", err)
+	}
+	if !strings.Contains(err.Error(), "S5TEST_GOOGLE_CLIENT_SECRET") || !strings.Contains(err.Error(), "S5TEST_TWITTER_CLIENT_ID") {
+		t.Errorf("missing credentials should name the variables: %v", err)
+	}
+}
+
+func TestFileOauthClientDetail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seven5oauth")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tomlPath := filepath.Join(dir, "secrets.toml")
+	ioutil.WriteFile(tomlPath, []byte(`# oauth secrets
+[github]
+client_id = "abc"
+client_secret = "x#yz" # not a comment inside the quotes
+
+[google]
+client_id = "def"
+`), 0600)
+	jsonPath := filepath.Join(dir, "secrets.json")
+	ioutil.WriteFile(jsonPath, []byte(`{"github":{"client_id":"abc","client_secret":"x#yz"},"google":{"client_id":"def"}}`), 0600)
+
+	for _, path := range []string{tomlPath, jsonPath} {
+		detail, err := NewFileOauthClientDetail(path)
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", path, err)
+		}
+		if detail.ClientId("github") != "abc" || detail.ClientSecret("github") != "x#yz" || detail.ClientId("google") != "def" {
+			t.Errorf("wrong credentials from %s", path)
+		}
+		err = ValidateOauthClientDetail(detail, "github", "google", "twitter")
+		verr, ok := err.(*ValidationError)
+		if !ok || len(verr.Errors) != 3 || !strings.Contains(err.Error(), path+": google.client_secret") {
+			t.Errorf("expected three missing credentials from %s: %v", path, err)
+		}
+	}
+
+	//literal strings and escapes
+	ioutil.WriteFile(tomlPath, []byte(`["git hub"]
+client_id = 'C:\no\escapes'
+"client_secret" = "tab\there \u00e9"
+`), 0600)
+	detail, err := NewFileOauthClientDetail(tomlPath)
+	if err != nil {
+		t.Fatalf("unable to read toml strings: %v", err)
+	}
+	if detail.ClientId("git hub") != `C:\no\escapes` || detail.ClientSecret("git hub") != "tab\there \u00e9" {
+		t.Errorf("wrong strings from toml: %q %q", detail.ClientId("git hub"), detail.ClientSecret("git hub"))
+	}
+
+	for _, bad := range []string{
+		"client_id = abc\n",
+		"[github]\nclient_id = abc\n",
+		"[github]\nclient_id = `abc`\n",
+		"[github]\nclient_id = \"a\\x41\"\n",
+		"[github]\nclientid = \"abc\"\n",
+		"[github]\nclient.id = \"abc\"\n",
+		"[github.enterprise]\nclient_id = \"abc\"\n",
+		"[[github]]\nclient_id = \"abc\"\n",
+		"[github]\nclient_id = \"abc\" extra\n",
+		"[github]\nclient_id = \"abc\"\nclient_id = \"def\"\n",
+		"[github]\n[github]\n",
+		"[github]\nclient_id = \"\"\"abc\"\"\"\n",
+	} {
+		ioutil.WriteFile(tomlPath, []byte(bad), 0600)
+		if _, err := NewFileOauthClientDetail(tomlPath); err == nil {
+			t.Errorf("expected error for bad toml %q", bad)
+		}
+	}
+}
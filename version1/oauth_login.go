@@ -0,0 +1,105 @@
+package seven5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	//OAUTH_USER_REFUSED is sent to the error page when the OauthUserResolver
+	//does not accept the user.
+	OAUTH_USER_REFUSED = errors.New("user not allowed")
+)
+
+//OauthUserResolver is supplied by the application to turn a connection to an
+//oauth provider into a user of the application.  It typically calls the
+//provider to find out who the user is (see FetchUserInfo) and then looks the
+//user up in the database, creating them if needed.  The results are the same
+//as ValidatingSessionManager.ValidateCredentials: a unique id of "" means the user
+//is refused and the error is for something more serious.  The unique id and
+//user data are passed to the session manager's Assign.
+type OauthUserResolver interface {
+	ResolveUser(connector OauthConnector, conn OauthConnection) (string, interface{}, error)
+}
+
+//OauthLoginHandler is an OauthHandler that logs the user in to the application
+//when the login with the provider succeeds.  A session is created with the
+//SessionManager for the user found by the OauthUserResolver and the cookie is
+//set with the CookieMapper before the browser is sent to the login landing page.
+type OauthLoginHandler struct {
+	*OauthHandler
+	sm       SessionManager
+	cm       CookieMapper
+	resolver OauthUserResolver
+}
+
+//NewOauthLoginHandler returns a handler that logs users in with the connector.
+//Bind LoginHandler, CallbackHandler, and LogoutHandler as with NewOauthHandler.
+func NewOauthLoginHandler(conn OauthConnector, pm PageMapper, callbackPath string, secure bool,
+	sm SessionManager, cm CookieMapper, resolver OauthUserResolver) *OauthLoginHandler {
+	result := &OauthLoginHandler{
+		OauthHandler: NewOauthHandler(conn, pm, callbackPath, secure),
+		sm:           sm,
+		cm:           cm,
+		resolver:     resolver,
+	}
+	result.Connected = result.connected
+	return result
+}
+
+//connected resolves the user and creates the session.  Internal errors are
+//logged rather than shown on the error page.
+func (self *OauthLoginHandler) connected(connector OauthConnector, conn OauthConnection, w http.ResponseWriter, r *http.Request) error {
+	uniq, userData, err := self.resolver.ResolveUser(connector, conn)
+	if err != nil {
+		log.Printf("[OAUTH] unable to resolve user from %s: %v", connector.Name(), err)
+		return fmt.Errorf("unable to find user")
+	}
+	if uniq == "" {
+		return OAUTH_USER_REFUSED
+	}
+	session, err := self.sm.Assign(uniq, userData, time.Time{})
+	if err != nil {
+		log.Printf("[OAUTH] unable to assign session for %s: %v", uniq, err)
+		return fmt.Errorf("unable to create session")
+	}
+	log.Printf("[OAUTH] user %s is authenticated with %s", uniq, connector.Name())
+	self.cm.AssociateCookie(w, session)
+	return nil
+}
+
+//LogoutHandler destroys the session, if there is one, removes the cookie and
+//sends the browser to the LogoutLandingPage.
+func (self *OauthLoginHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := self.cm.Value(r)
+	if err == nil && id != "" {
+		if err := self.sm.Destroy(id); err != nil {
+			log.Printf("[OAUTH] unable to destroy session: %v", err)
+		}
+	}
+	self.cm.RemoveCookie(w)
+	self.OauthHandler.LogoutHandler(w, r)
+}
+
+//FetchUserInfo sends an authenticated GET to the url, such as the UserInfoURL
+//of an Oauth2Provider, and decodes the json response into the value provided.
+func FetchUserInfo(conn OauthConnection, url string, into interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := conn.SendAuthenticated(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch user info (%d)", resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(into)
+}
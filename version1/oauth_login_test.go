@@ -0,0 +1,106 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testUserResolver struct {
+	provider *Oauth2Provider
+}
+
+func (self *testUserResolver) ResolveUser(connector OauthConnector, conn OauthConnection) (string, interface{}, error) {
+	var info struct {
+		Login string `json:"login"`
+	}
+	if err := FetchUserInfo(conn, self.provider.UserInfoURL, &info); err != nil {
+		return "", nil, err
+	}
+	if info.Login == "banned" {
+		return "", nil, nil
+	}
+	return info.Login, "data for " + info.Login, nil
+}
+
+func TestOauthLogin(t *testing.T) {
+	cm, sm := setupTestSession("oauthtest")
+	fake := &fakeAuthServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	provider := &Oauth2Provider{
+		Name:        "fake",
+		AuthURL:     server.URL + "/authorize",
+		TokenURL:    server.URL + "/token",
+		UserInfoURL: server.URL + "/user",
+	}
+	conn, err := NewOauth2Connector(provider, &testClientDetail{}, "http://localhost/auth/fake/callback")
+	if err != nil {
+		t.Fatalf("unable to create connector: %v", err)
+	}
+	handler := NewOauthLoginHandler(conn, NewSimplePageMapper("/error", "/welcome", "/bye"),
+		conn.CallbackPath(), false, sm, cm, &testUserResolver{provider})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/auth/fake/login", nil)
+	handler.LoginHandler(w, r)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	fake.challenge = loc.Query().Get("code_challenge")
+	stateCookie := (&http.Response{Header: w.Header()}).Cookies()[0]
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost/auth/fake/callback?code=good&state="+loc.Query().Get("state"), nil)
+	r.AddCookie(stateCookie)
+	handler.CallbackHandler(w, r)
+	if !strings.HasPrefix(w.Header().Get("Location"), "/welcome?") {
+		t.Fatalf("login failed: %s", w.Header().Get("Location"))
+	}
+	var sessionId string
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.Name == cm.CookieName() {
+			sessionId = c.Value
+		}
+	}
+	sr, err := sm.Find(sessionId)
+	if err != nil || sr == nil || sr.Session == nil || sr.Session.UserData() != "data for fred" {
+		t.Fatalf("session not created: %+v %v", sr, err)
+	}
+
+	//logout
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost/auth/fake/logout", nil)
+	r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: sessionId})
+	handler.LogoutHandler(w, r)
+	if !strings.HasPrefix(w.Header().Get("Location"), "/bye?") {
+		t.Errorf("wrong logout page: %s", w.Header().Get("Location"))
+	}
+	if sr, _ := sm.Find(sessionId); sr != nil && sr.Session != nil {
+		t.Errorf("session not destroyed on logout")
+	}
+	removed := false
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.Name == cm.CookieName() && c.MaxAge < 0 {
+			removed = true
+		}
+	}
+	if !removed {
+		t.Errorf("cookie not removed on logout")
+	}
+
+	//refused user
+	conn2 := &refusingConnection{}
+	if err := handler.connected(conn, conn2, httptest.NewRecorder(), r); err != OAUTH_USER_REFUSED {
+		t.Errorf("expected user to be refused: %v", err)
+	}
+}
+
+type refusingConnection struct {
+}
+
+func (self *refusingConnection) SendAuthenticated(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	w.Write([]byte(`{"login":"banned"}`))
+	return w.Result(), nil
+}
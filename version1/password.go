@@ -0,0 +1,137 @@
+package seven5
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//PasswordHasher turns passwords into hashes that are safe to store.  The hashes
+//are self-describing, so CheckPassword can check any of them.  NeedsRehash
+//returns true if the hash was made with a different algorithm or different
+//parameters than this hasher would use now; the password should be hashed
+//again the next time the user logs in.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	NeedsRehash(hash string) bool
+}
+
+//BcryptHasher hashes passwords with bcrypt.  A Cost of zero means bcrypt.DefaultCost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (self *BcryptHasher) cost() int {
+	if self.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return self.Cost
+}
+
+//Hash returns the bcrypt hash of the password.
+func (self *BcryptHasher) Hash(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), self.cost())
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+//NeedsRehash returns true if the hash is not bcrypt with the current cost.
+func (self *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != self.cost()
+}
+
+//Argon2idHasher hashes passwords with argon2id and encodes them in the usual
+//form: $argon2id$v=19$m=65536,t=1,p=4$salt$hash.  Memory is in KiB.
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+//NewArgon2idHasher returns a hasher with the parameters recommended by the
+//argon2 package.
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLen: 32, SaltLen: 16}
+}
+
+//Hash returns the argon2id hash of the password with a random salt.
+func (self *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, self.SaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, self.Time, self.Memory, self.Threads, self.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, self.Memory, self.Time, self.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//NeedsRehash returns true if the hash is not argon2id with the current parameters.
+func (self *Argon2idHasher) NeedsRehash(hash string) bool {
+	p, _, key, err := parseArgon2id(hash)
+	return err != nil || p.Time != self.Time || p.Memory != self.Memory || p.Threads != self.Threads ||
+		uint32(len(key)) != self.KeyLen
+}
+
+//parseArgon2id returns the parameters, salt, and key of an argon2id hash.
+func parseArgon2id(hash string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+	p := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, nil, nil, fmt.Errorf("bad argon2id parameters: %s", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
+
+//normalizeUsername makes usernames case-insensitive.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+//CheckPassword returns true if the password matches the hash, which may have
+//been made by any of the hashers in this package.  The error is for hashes
+//that cannot be understood, not for wrong passwords.
+func CheckPassword(hash string, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
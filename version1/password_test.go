@@ -0,0 +1,45 @@
+package seven5
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	fast := &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	hashers := []PasswordHasher{&BcryptHasher{Cost: 4}, fast}
+	for _, h := range hashers {
+		hash, err := h.Hash("sekrit")
+		if err != nil {
+			t.Fatalf("unable to hash: %v", err)
+		}
+		if ok, err := CheckPassword(hash, "sekrit"); !ok || err != nil {
+			t.Errorf("password did not match hash %s: %v", hash, err)
+		}
+		if ok, _ := CheckPassword(hash, "Sekrit"); ok {
+			t.Errorf("wrong password matched hash %s", hash)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("fresh hash should not need rehash: %s", hash)
+		}
+	}
+	other, _ := hashers[0].Hash("sekrit")
+	if !fast.NeedsRehash(other) {
+		t.Errorf("bcrypt hash should need rehash for argon2id")
+	}
+	if !(&BcryptHasher{Cost: 5}).NeedsRehash(other) {
+		t.Errorf("bcrypt hash should need rehash when the cost changes")
+	}
+	stronger := *fast
+	stronger.Time = 2
+	hash, _ := fast.Hash("sekrit")
+	if !stronger.NeedsRehash(hash) {
+		t.Errorf("argon2id hash should need rehash when the parameters change")
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("unexpected argon2id encoding: %s", hash)
+	}
+	if _, err := CheckPassword("$argon2id$bogus", "sekrit"); err == nil {
+		t.Errorf("expected error for a bad hash")
+	}
+}
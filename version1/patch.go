@@ -0,0 +1,421 @@
+package seven5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MERGE_PATCH_CONTENT_TYPE = "application/merge-patch+json"
+	JSON_PATCH_CONTENT_TYPE  = "application/json-patch+json"
+)
+
+//jsonPatchOp is a single operation in an RFC 6902 JSON Patch document.  Value
+//is left raw so we can tell the difference between a missing value and a null.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+//ApplyMergePatch applies the RFC 7396 merge patch in patch to the json document
+//doc and returns the resulting document.  Keys with a null value in the patch
+//are removed from the result, objects are merged recursively, and anything
+//else in the patch replaces the corresponding value in doc.
+func ApplyMergePatch(doc []byte, patch []byte) ([]byte, error) {
+	target, err := decodeJsonTree(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeJsonTree(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+//ApplyJsonPatch applies the RFC 6902 JSON Patch in patch to the json document
+//doc and returns the resulting document. The operations add, remove, replace,
+//move, copy, and test are supported.  The patch is applied atomically in the
+//sense that if any operation fails, an error is returned and no document is
+//returned.  A failed test operation returns an error of type *Error with
+//the status code http.StatusConflict.
+func ApplyJsonPatch(doc []byte, patch []byte) ([]byte, error) {
+	root, err := decodeJsonTree(doc)
+	if err != nil {
+		return nil, err
+	}
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("json patch must be an array of operations: %v", err)
+	}
+	for i, op := range ops {
+		root, err = applyJsonPatchOp(root, op)
+		if err != nil {
+			if ours, ok := err.(*Error); ok {
+				return nil, ours
+			}
+			return nil, fmt.Errorf("json patch operation %d (%s %s): %v", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+func applyJsonPatchOp(root interface{}, op jsonPatchOp) (interface{}, error) {
+	path, err := splitJsonPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%s requires a value", op.Op)
+		}
+		value, err := decodeJsonTree(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			return jsonPointerAdd(root, path, value)
+		case "replace":
+			return jsonPointerReplace(root, path, value)
+		}
+		current, err := jsonPointerGet(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, HTTPError(http.StatusConflict, fmt.Sprintf("json patch test failed at %s", op.Path))
+		}
+		return root, nil
+	case "remove":
+		root, _, err = jsonPointerRemove(root, path)
+		return root, err
+	case "move", "copy":
+		from, err := splitJsonPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fmt.Errorf("cannot move %s into one of its children", op.From)
+			}
+			var value interface{}
+			root, value, err = jsonPointerRemove(root, from)
+			if err != nil {
+				return nil, err
+			}
+			return jsonPointerAdd(root, path, value)
+		}
+		value, err := jsonPointerGet(root, from)
+		if err != nil {
+			return nil, err
+		}
+		//deep copy so the two locations don't share structure
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		value, err = decodeJsonTree(raw)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(root, path, value)
+	}
+	return nil, fmt.Errorf("unknown operation '%s'", op.Op)
+}
+
+//decodeJsonTree decodes into the generic map/slice representation, keeping
+//numbers as json.Number so that int64 ids survive the round trip.
+func decodeJsonTree(raw []byte) (interface{}, error) {
+	var result interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//splitJsonPointer breaks an RFC 6901 pointer into its (unescaped) tokens.
+func splitJsonPointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("json pointer must start with / (was %s)", p)
+	}
+	parts := strings.Split(p[1:], "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+	}
+	return parts, nil
+}
+
+func jsonArrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("bad array index %s", token)
+	}
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func jsonPointerGet(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch c := node.(type) {
+		case map[string]interface{}:
+			child, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("no such member %s", token)
+			}
+			node = child
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			node = c[i]
+		default:
+			return nil, fmt.Errorf("cannot index into a scalar with %s", token)
+		}
+	}
+	return node, nil
+}
+
+//jsonPointerUpdate walks to the container that holds the last token in path
+//and calls fn on it.  Whatever fn returns replaces that container in its parent,
+//since slices may be reallocated by an insertion or removal.
+func jsonPointerUpdate(node interface{}, path []string, fn func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+	switch c := node.(type) {
+	case map[string]interface{}:
+		child, ok := c[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("no such member %s", path[0])
+		}
+		n, err := jsonPointerUpdate(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[path[0]] = n
+		return c, nil
+	case []interface{}:
+		i, err := jsonArrayIndex(path[0], len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		n, err := jsonPointerUpdate(c[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = n
+		return c, nil
+	}
+	return nil, fmt.Errorf("cannot index into a scalar with %s", path[0])
+}
+
+func jsonPointerAdd(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(root, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add %s to a scalar", token)
+	})
+}
+
+func jsonPointerReplace(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(root, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("no such member %s", token)
+			}
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot replace %s in a scalar", token)
+	})
+}
+
+func jsonPointerRemove(root interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	var removed interface{}
+	result, err := jsonPointerUpdate(root, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			v, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("no such member %s", token)
+			}
+			removed = v
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %s from a scalar", token)
+	})
+	return result, removed, err
+}
+
+//readPatch reads the patch document in the body of r and applies it to current,
+//which should be the result of a Find on the same resource.  A new wire object
+//of the resource's type is returned with the patch applied. The Content-Type
+//of the request selects between RFC 7396 merge patches and RFC 6902 JSON Patch
+//documents; plain json is treated as a merge patch.  Errors returned are of type
+//*Error and carry an appropriate status code.
+func readPatch(r *http.Request, obj *restShared, current interface{}) (interface{}, error) {
+	isJsonPatch := false
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, HTTPError(http.StatusBadRequest, fmt.Sprintf("bad content type: %s", err))
+		}
+		switch mediaType {
+		case JSON_PATCH_CONTENT_TYPE:
+			isJsonPatch = true
+		case MERGE_PATCH_CONTENT_TYPE, "application/json", "text/json":
+		default:
+			return nil, HTTPError(http.StatusUnsupportedMediaType,
+				fmt.Sprintf("PATCH does not understand %s", mediaType))
+		}
+	}
+	limit := obj.bodyLimit()
+	if r.ContentLength > limit {
+		return nil, bodyTooLarge(limit)
+	}
+	body := &limitedBody{r: r.Body, max: limit}
+	patch, err := ioutil.ReadAll(body)
+	if body.exceeded() {
+		return nil, bodyTooLarge(limit)
+	}
+	if err != nil {
+		return nil, HTTPError(http.StatusBadRequest, fmt.Sprintf("unable to read patch: %s", err))
+	}
+	if len(bytes.TrimSpace(patch)) == 0 {
+		return nil, HTTPError(http.StatusBadRequest, "PATCH requires a patch document")
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	var patched []byte
+	if isJsonPatch {
+		patched, err = ApplyJsonPatch(doc, patch)
+	} else {
+		patched, err = ApplyMergePatch(doc, patch)
+	}
+	if err != nil {
+		if ours, ok := err.(*Error); ok {
+			return nil, ours
+		}
+		return nil, HTTPError(http.StatusBadRequest, fmt.Sprintf("unable to apply patch: %s", err))
+	}
+	wireObj := reflect.New(obj.typ.Elem())
+	if err := json.Unmarshal(patched, wireObj.Interface()); err != nil {
+		return nil, HTTPError(http.StatusBadRequest, fmt.Sprintf("patched value is not a %v: %s", obj.typ, err))
+	}
+	return wireObj.Interface(), nil
+}
+
+//patcher returns the function that makes the patched value for a PATCH
+//request from the current value of the object.  The current value is passed
+//through the ResultFilter (objects the client cannot see are a 404), checked
+//against If-Match, patched with the document in the request and validated.
+//Fields the filter hides from the client keep their current values.  Errors
+//returned are of type *Error, except for those from the ResultFilter or
+//ETag computation.
+func (self *RawDispatcher) patcher(r *http.Request, shared *restShared, find interface{}, bundle PBundle) PatchFunc {
+	return func(current interface{}) (interface{}, error) {
+		visible, err := filterFindResult(shared, find, current, bundle)
+		if err != nil {
+			return nil, err
+		}
+		if err := self.ifMatchError(r, visible); err != nil {
+			return nil, err
+		}
+		patched, err := readPatch(r, shared, visible)
+		if err != nil {
+			return nil, err
+		}
+		unredact(current, visible, patched)
+		if err := ValidateWire(patched); err != nil {
+			if verr, ok := err.(*ValidationError); ok {
+				return nil, validationProblem(verr)
+			}
+			return nil, err
+		}
+		return patched, nil
+	}
+}
@@ -0,0 +1,74 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func checkJsonEqual(t *testing.T, expected string, actual []byte) {
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatalf("bad expected json %s: %v", expected, err)
+	}
+	if err := json.Unmarshal(actual, &a); err != nil {
+		t.Fatalf("bad result json %s: %v", string(actual), err)
+	}
+	if !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %s but got %s", expected, string(actual))
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	doc := `{"Id":12,"Foo":"bar","Nested":{"A":1,"B":2}}`
+	result, err := ApplyMergePatch([]byte(doc), []byte(`{"Foo":"baz","Nested":{"A":null,"C":3}}`))
+	if err != nil {
+		t.Fatalf("unexpected error from merge patch: %v", err)
+	}
+	checkJsonEqual(t, `{"Id":12,"Foo":"baz","Nested":{"B":2,"C":3}}`, result)
+
+	//big ids should not be mangled by passing through float64
+	result, err = ApplyMergePatch([]byte(`{"Id":9007199254740993}`), []byte(`{}`))
+	if err != nil {
+		t.Fatalf("unexpected error from merge patch: %v", err)
+	}
+	if string(result) != `{"Id":9007199254740993}` {
+		t.Errorf("id was changed by the merge patch: %s", string(result))
+	}
+}
+
+func TestJsonPatch(t *testing.T) {
+	doc := `{"Id":12,"Foo":"bar","List":[1,2,3]}`
+	patch := `[
+		{"op":"test","path":"/Foo","value":"bar"},
+		{"op":"replace","path":"/Foo","value":"baz"},
+		{"op":"add","path":"/List/1","value":7},
+		{"op":"add","path":"/List/-","value":9},
+		{"op":"remove","path":"/List/0"},
+		{"op":"copy","from":"/Foo","path":"/Copy"},
+		{"op":"move","from":"/Copy","path":"/Moved"}
+	]`
+	result, err := ApplyJsonPatch([]byte(doc), []byte(patch))
+	if err != nil {
+		t.Fatalf("unexpected error from json patch: %v", err)
+	}
+	checkJsonEqual(t, `{"Id":12,"Foo":"baz","List":[7,2,3,9],"Moved":"baz"}`, result)
+
+	_, err = ApplyJsonPatch([]byte(doc), []byte(`[{"op":"test","path":"/Foo","value":"nope"}]`))
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusConflict {
+		t.Errorf("expected a conflict from a failed test but got %v", err)
+	}
+	for _, bad := range []string{
+		`[{"op":"replace","path":"/Nope","value":1}]`,
+		`[{"op":"remove","path":"/List/3"}]`,
+		`[{"op":"add","path":"Foo","value":1}]`,
+		`[{"op":"frob","path":"/Foo"}]`,
+		`{"op":"remove","path":"/Foo"}`,
+	} {
+		if _, err := ApplyJsonPatch([]byte(doc), []byte(bad)); err == nil {
+			t.Errorf("expected error from bad patch %s", bad)
+		}
+	}
+}
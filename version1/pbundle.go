@@ -19,6 +19,7 @@ type PBundle interface {
 	ParentValue(interface{}) interface{}
 	SetParentValue(reflect.Type, interface{})
 	IntQueryParameter(string, int64) int64
+	IndexQuery() (*IndexQuery, error)
 }
 
 type simplePBundle struct {
@@ -28,6 +29,10 @@ type simplePBundle struct {
 	mgr    SessionManager
 	out    map[string]string
 	parent map[reflect.Type]interface{}
+	query  *IndexQuery
+	//reissued is true if UpdateSession changed the session id or the
+	//session manager renewed the session, so the cookie must be sent again
+	reissued bool
 }
 
 //ReturnHeaders gets all the header _keys_ that should be returned the client.
@@ -71,9 +76,17 @@ func (self *simplePBundle) Session() Session {
 }
 
 //UpdateSession associates a new data blob (i) with the currently in use session.
-//This will blow up if there is no associated SessionManager.
+//This will blow up if there is no associated SessionManager.  Some session
+//managers, such as CookieSessionManager, change the session id when the data
+//changes; in that case the new session replaces the current one and the
+//cookie is sent again with the response.
 func (self *simplePBundle) UpdateSession(i interface{}) (Session, error) {
-	return self.mgr.Update(self.s, i)
+	s, err := self.mgr.Update(self.s, i)
+	if err == nil && s != nil && self.s != nil && s.SessionId() != self.s.SessionId() {
+		self.s = s
+		self.reissued = true
+	}
+	return s, err
 }
 
 //DestroySession removes the session associated with this Pbundle from the
@@ -118,6 +131,21 @@ func (self *simplePBundle) IntQueryParameter(name string, def int64) int64 {
 	return i
 }
 
+//IndexQuery returns the paging, sorting, and filtering requested by the client
+//for a call to Index.  The value is computed once from the query parameters,
+//so changes made to it (such as setting Total) are seen by later callers.
+func (self *simplePBundle) IndexQuery() (*IndexQuery, error) {
+	if self.query != nil {
+		return self.query, nil
+	}
+	query, err := ParseIndexQuery(self.q)
+	if err != nil {
+		return nil, err
+	}
+	self.query = query
+	return query, nil
+}
+
 //NewSimplePBundle needs to hold a reference to the session manager as well
 //as the session because it must be able to update the information stored
 //about a particular sesison.
@@ -16,17 +16,25 @@ const (
 	AUTH_OP_LOGOUT        = "logout"
 	AUTH_OP_PWD_RESET     = "pwdreset"
 	AUTH_OP_PWD_RESET_REQ = "pwdresetreq"
+	AUTH_OP_TOTP          = "totp"
 )
 
 //PasswordAuthParameters is passed from client to server to request login, login
-//or to use (consume) a reset request.  XXX Ugh, this has to be manually copied
-//over to the client side library. XXX
+//or to use (consume) a reset request.  Code is the second factor for AUTH_OP_TOTP.
+//XXX Ugh, this has to be manually copied over to the client side library. XXX
 type PasswordAuthParameters struct {
 	Username         string
 	Password         string
 	ResetRequestUdid string
 	UserUdid         string
 	Op               string
+	Code             string
+}
+
+//PasswordAuthResult is sent to the client after a login.  If SecondFactorRequired
+//is true, the client has a partial session and must send an AUTH_OP_TOTP.
+type PasswordAuthResult struct {
+	SecondFactorRequired bool
 }
 
 //Valdating session manager is one that can also check the validity of a
@@ -35,7 +43,9 @@ type PasswordAuthParameters struct {
 //login attempt and use the error for something more serious, like the database
 //cannot be reached.  If the first returned value from ValidateCredentials is
 //not "" it should be a unique id, both of the first two returned values will be
-//sent to the (nested) session manager's Assign.
+//sent to the (nested) session manager's Assign.  GenerateResetRequest should
+//deliver a reset token to the user (see PasswordReset) and UseResetRequest
+//takes the user id, the token and the new password.
 type ValidatingSessionManager interface {
 	SessionManager
 	ValidateCredentials(username, password string) (string, interface{}, error)
@@ -46,10 +56,14 @@ type ValidatingSessionManager interface {
 
 //SimplePasswordHandler is a utility for handling login-logout and authentication
 //checks.  It expects to be given a SessionManager that it will work in combination
-//with.
+//with.  If Throttle is set, logins are refused when there have been too many
+//failures for the username or from the client's address.  If SecondFactor is
+//set, users who have enrolled must also give a TOTP code.
 type SimplePasswordHandler struct {
-	vsm ValidatingSessionManager
-	cm  CookieMapper
+	vsm          ValidatingSessionManager
+	cm           CookieMapper
+	Throttle     *LoginThrottle
+	SecondFactor *TOTPAuth
 }
 
 //
@@ -67,7 +81,8 @@ func NewSimplePasswordHandler(vsm ValidatingSessionManager, cm CookieMapper) *Si
 //
 // Check verifies that the username and password provided are the ones we expect
 // via a calle the ValidatingSessionManager. It returns nil,nil in the case of a
-// failed check on the password provided.
+// failed check on the password provided.  If the user has a second factor, the
+// session returned is a partial session.
 //
 func (self *SimplePasswordHandler) Check(username, pwd string) (Session, error) {
 	uniq, userData, err := self.vsm.ValidateCredentials(username, pwd)
@@ -77,6 +92,15 @@ func (self *SimplePasswordHandler) Check(username, pwd string) (Session, error)
 	if uniq == "" {
 		return nil, nil
 	}
+	if self.SecondFactor != nil {
+		enrolled, err := self.SecondFactor.Enrolled(uniq)
+		if err != nil {
+			return nil, err
+		}
+		if enrolled {
+			return self.SecondFactor.Begin(uniq, userData)
+		}
+	}
 	return self.vsm.Assign(uniq, userData, time.Time{})
 }
 
@@ -89,23 +113,27 @@ func (self *SimplePasswordHandler) MeHandler(w http.ResponseWriter, r *http.Requ
 
 	val, err := self.cm.Value(r)
 	if err != nil && err != NO_SUCH_COOKIE {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendProblem(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	if err != nil { //no cookie
-		http.Error(w, "no cookie", http.StatusUnauthorized)
+		sendProblem(w, "no cookie", http.StatusUnauthorized)
 		return
 	}
 	sr, err := self.vsm.Find(strings.TrimSpace(val))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendProblem(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	if sr == nil {
-		http.Error(w, "no session", http.StatusUnauthorized)
+		sendProblem(w, "no session", http.StatusUnauthorized)
 		return
 	}
 
+	if IsPartialSession(sr.Session) || (sr.Session == nil && isPendingUniqueId(sr.UniqueId)) {
+		WriteError(w, secondFactorRequired())
+		return
+	}
 	if sr.Session != nil {
 		if err := self.vsm.SendUserDetails(sr.Session.UserData(), w); err != nil {
 			log.Printf("failed to send user data: %v", err)
@@ -114,7 +142,7 @@ func (self *SimplePasswordHandler) MeHandler(w http.ResponseWriter, r *http.Requ
 	}
 	i, err := self.vsm.Generate(sr.UniqueId)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to recover session: %v", err), http.StatusInternalServerError)
+		sendProblem(w, fmt.Sprintf("unable to recover session: %v", err), http.StatusInternalServerError)
 		return
 	}
 	recovered, err := self.vsm.Assign(sr.UniqueId, i, time.Time{})
@@ -157,14 +185,13 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	//PW RESET REQ? (Can be done without being logged in)
 	//
 	if auth.Op == AUTH_OP_PWD_RESET_REQ {
-		resetUdid, err := self.vsm.GenerateResetRequest(auth.Username)
-		if err != nil {
+		//the token is a secret that only the user should see, so don't log it
+		if _, err := self.vsm.GenerateResetRequest(auth.Username); err != nil {
 			WriteError(w, err)
 			log.Printf("[AUTH] error returned from GenerateResetRequest %v", err)
 			return
 		}
-		log.Printf("[AUTH] generated password reset req for user %s: %s",
-			auth.UserUdid, resetUdid)
+		log.Printf("[AUTH] password reset requested for user %s", auth.Username)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("{}")) //need to prevent the client-side dying
 		return
@@ -174,8 +201,6 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	//PW RESET? (Can be done without being logged in)
 	//
 	if auth.Op == AUTH_OP_PWD_RESET {
-		//UseResetRequest(userId string, requestId string, newpwd string) (bool, error) {
-
 		ok, err := self.vsm.UseResetRequest(auth.UserUdid, auth.ResetRequestUdid, auth.Password)
 		if err != nil {
 			WriteError(w, err)
@@ -184,22 +209,30 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 		}
 		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
-			log.Printf("[AUTH] UseResetRequest refused to update password: %s", auth.ResetRequestUdid)
+			log.Printf("[AUTH] UseResetRequest refused to update password for user %s", auth.UserUdid)
 			return
 		}
-		log.Printf("[AUTH] reset password for user %s with token %s",
-			auth.UserUdid, auth.ResetRequestUdid)
+		log.Printf("[AUTH] reset password for user %s", auth.UserUdid)
+		self.unlock(auth.UserUdid)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("{}")) //need to prevent the client-side dying
 		return
 	}
 
+	//
+	//SECOND FACTOR? (Must have the partial session from the login)
+	//
+	if auth.Op == AUTH_OP_TOTP {
+		self.secondFactor(w, r, val, auth.Code)
+		return
+	}
+
 	//
 	//LOGOUT?
 	//
 	if auth.Op == AUTH_OP_LOGOUT {
 		if err == NO_SUCH_COOKIE {
-			http.Error(w, "not logged in", http.StatusBadRequest)
+			sendProblem(w, "not logged in", http.StatusBadRequest)
 		} else {
 			self.cm.RemoveCookie(w)
 			self.vsm.Destroy(val)
@@ -212,17 +245,125 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	//
 	// MUST BE LOGIN
 	//
+	ip := RemoteIP(r)
+	var attempt *LoginAttempt
+	if self.Throttle != nil {
+		var err error
+		if attempt, err = self.Throttle.Begin(auth.Username, ip); err != nil {
+			log.Printf("[AUTH] login refused for user %s from %s: %v", auth.Username, ip, err)
+			WriteThrottleError(w, err)
+			return
+		}
+	}
 	session, err := self.Check(auth.Username, auth.Password)
 	if err != nil {
+		//the attempt stays counted as a failure
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	if session == nil {
+		if attempt != nil {
+			if err := attempt.Failed(); err != nil {
+				log.Printf("[AUTH] unable to record failed login: %v", err)
+			}
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	if attempt != nil {
+		if err := attempt.Succeeded(); err != nil {
+			log.Printf("[AUTH] unable to clear failed logins: %v", err)
+		}
+	}
+	self.cm.AssociateCookie(w, session)
+	if IsPartialSession(session) {
+		log.Printf("[AUTH] user %s needs a second factor", auth.Username)
+		sendJson(w, &PasswordAuthResult{SecondFactorRequired: true})
+		return
+	}
 	log.Printf("[AUTH] user %s is authenticated", auth.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}")) //need to prevent the client-side dying
+}
+
+//secondFactor replaces the partial session with a full one if the code is right.
+//Wrong codes count as failed logins for the throttle.
+func (self *SimplePasswordHandler) secondFactor(w http.ResponseWriter, r *http.Request, sessionId string, code string) {
+	if self.SecondFactor == nil {
+		sendProblem(w, "second factor is not available", http.StatusNotImplemented)
+		return
+	}
+	var p *PartialAuth
+	var err error
+	if sessionId != "" {
+		p, err = self.SecondFactor.Pending(sessionId)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+	}
+	if p == nil {
+		sendProblem(w, "no login waiting for a second factor", http.StatusUnauthorized)
+		return
+	}
+	key, ip := MFA_PENDING_PREFIX+p.UniqueId, RemoteIP(r)
+	var attempt *LoginAttempt
+	if self.Throttle != nil {
+		if attempt, err = self.Throttle.Begin(key, ip); err != nil {
+			log.Printf("[AUTH] second factor refused for user %s from %s: %v", p.UniqueId, ip, err)
+			WriteThrottleError(w, err)
+			return
+		}
+	}
+	ok, err := self.SecondFactor.VerifyPending(sessionId, p, code)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if !ok {
+		if attempt != nil {
+			if err := attempt.Failed(); err != nil {
+				log.Printf("[AUTH] unable to record failed second factor: %v", err)
+			}
+		}
+		sendProblem(w, "wrong code", http.StatusUnauthorized)
+		return
+	}
+	if attempt != nil {
+		if err := attempt.Succeeded(); err != nil {
+			log.Printf("[AUTH] unable to clear failed second factors: %v", err)
+		}
+	}
+	session, err := self.SecondFactor.Complete(sessionId, p)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] user %s is authenticated with a second factor", p.UniqueId)
 	self.cm.AssociateCookie(w, session)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{}")) //need to prevent the client-side dying
 }
+
+//unlock removes the lockouts for the user whose password was reset: the ones
+//from wrong second factor codes, and the one from wrong passwords if the
+//session manager can say what their username is.
+func (self *SimplePasswordHandler) unlock(uniq string) {
+	if self.SecondFactor != nil {
+		self.SecondFactor.ResetAttempts(uniq)
+	}
+	if self.Throttle == nil {
+		return
+	}
+	err := self.Throttle.Unlock(MFA_PENDING_PREFIX + uniq)
+	if lookup, ok := self.vsm.(UsernameLookup); ok && err == nil {
+		var username string
+		username, err = lookup.LookupUsername(uniq)
+		if err == nil && username != "" {
+			err = self.Throttle.Unlock(username)
+		}
+	}
+	if err != nil {
+		log.Printf("[AUTH] unable to unlock user %s: %v", uniq, err)
+	}
+}
@@ -0,0 +1,367 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+//Seven5User is the table used by QbsValidatingSessionManager to store users.
+//Call CreateTable on the session manager (or use your own migrations) to create it.
+type Seven5User struct {
+	Id           int64
+	Username     string `qbs:"size:255,unique,notnull"`
+	PasswordHash string `qbs:"size:255,notnull"`
+	UserData     string
+}
+
+//QbsValidatingSessionManager is a ValidatingSessionManager that keeps users,
+//with hashes of their passwords, in the database of a QbsStore.  Sessions are
+//kept by a SimpleSessionManager that uses this object as its Generator, so a
+//session can be recreated from the database after a restart.  The unique id
+//of a session is the id of the user's row.
+//
+//When a user logs in and the hash of their password was made with other
+//parameters than the PasswordHasher would use now (such as a lower bcrypt cost,
+//or bcrypt rather than argon2id), the password is hashed again and stored.
+//User data is stored with the codec given at creation; SendUserDetails uses
+//Details if it is not nil, so the data sent to the client can differ from the
+//data stored.
+//
+//Password reset is available if Reset is set; the tokens are usually kept with
+//a QbsResetTokenStore in the same database.
+type QbsValidatingSessionManager struct {
+	SessionManager
+	store   *QbsStore
+	hasher  PasswordHasher
+	codec   UserDataCodec
+	dummy   string
+	Details UserDataCodec
+	Reset   *PasswordReset
+}
+
+//NewQbsValidatingSessionManager returns a session manager that checks passwords
+//against the users in the store.  If the codec is nil, a JsonUserDataCodec with
+//no example is used.  The keys for session ids are read from the environment,
+//as with NewSimpleSessionManager.
+func NewQbsValidatingSessionManager(store *QbsStore, hasher PasswordHasher, codec UserDataCodec) *QbsValidatingSessionManager {
+	if codec == nil {
+		codec = NewJsonUserDataCodec(nil)
+	}
+	//checked against when the user does not exist, so that a login for an
+	//unknown user takes as long as one for a known user
+	dummy, err := hasher.Hash("seven5 dummy password")
+	if err != nil {
+		log.Fatalf("unable to hash with password hasher: %v", err)
+	}
+	result := &QbsValidatingSessionManager{
+		store:  store,
+		hasher: hasher,
+		codec:  codec,
+		dummy:  dummy,
+	}
+	result.SessionManager = NewSimpleSessionManager(result)
+	return result
+}
+
+//CreateTable creates the table for users if it does not already exist.
+func (self *QbsValidatingSessionManager) CreateTable() error {
+	m, err := qbs.GetMigration()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.CreateTableIfNotExists(&Seven5User{})
+}
+
+//findUser returns the user with the username, or nil if there is none.
+func findUser(tx *qbs.Qbs, username string) (*Seven5User, error) {
+	row := &Seven5User{}
+	err := tx.WhereEqual("username", normalizeUsername(username)).Find(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+//CreateUser adds a user with the password and user data and returns the id of
+//the new user.
+func (self *QbsValidatingSessionManager) CreateUser(username string, password string, userData interface{}) (int64, error) {
+	hash, err := self.hasher.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+	encoded, err := self.codec.EncodeUserData(userData)
+	if err != nil {
+		return 0, err
+	}
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		existing, err := findUser(tx, username)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, HTTPError(http.StatusConflict, fmt.Sprintf("user %s already exists", username))
+		}
+		row := &Seven5User{
+			Username:     normalizeUsername(username),
+			PasswordHash: hash,
+			UserData:     encoded,
+		}
+		if _, err := tx.Save(row); err != nil {
+			return nil, err
+		}
+		return row.Id, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+//SetPassword changes the password of the user.
+func (self *QbsValidatingSessionManager) SetPassword(username string, password string) error {
+	hash, err := self.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return nil, self.storeHash(tx, username, hash)
+	})
+	return err
+}
+
+//LookupUsername returns the username of the user with the unique id, so
+//SimplePasswordHandler can unlock the account after a password reset.
+func (self *QbsValidatingSessionManager) LookupUsername(uniq string) (string, error) {
+	id, err := strconv.ParseInt(uniq, 10, 64)
+	if err != nil {
+		return "", nil
+	}
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row := &Seven5User{}
+		err := tx.WhereEqual("id", id).Find(row)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return row.Username, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.(string), nil
+}
+
+//storeHash updates the password hash of the user.
+func (self *QbsValidatingSessionManager) storeHash(tx *qbs.Qbs, username string, hash string) error {
+	r, err := tx.Exec("UPDATE seven5_user SET password_hash = ? WHERE username = ?", hash, normalizeUsername(username))
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return HTTPError(http.StatusNotFound, fmt.Sprintf("no such user %s", username))
+	}
+	return nil
+}
+
+//ValidateCredentials checks the password of the user and returns the unique id
+//and user data for the session, or "" if the username or password is wrong.
+func (self *QbsValidatingSessionManager) ValidateCredentials(username string, password string) (string, interface{}, error) {
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row, err := findUser(tx, username)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			CheckPassword(self.dummy, password)
+			return nil, nil
+		}
+		ok, err := CheckPassword(row.PasswordHash, password)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+		if self.hasher.NeedsRehash(row.PasswordHash) {
+			hash, err := self.hasher.Hash(password)
+			if err != nil {
+				return nil, err
+			}
+			if err := self.storeHash(tx, row.Username, hash); err != nil {
+				return nil, err
+			}
+		}
+		return row, nil
+	})
+	if err != nil || result == nil {
+		return "", nil, err
+	}
+	row := result.(*Seven5User)
+	ud, err := self.codec.DecodeUserData(row.UserData)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to decode user data for %s: %v", row.Username, err)
+	}
+	return strconv.FormatInt(row.Id, 10), ud, nil
+}
+
+//Generate reads the user data for the unique id (the id of the user's row)
+//from the database.  It returns nil if the user no longer exists.
+func (self *QbsValidatingSessionManager) Generate(uniq string) (interface{}, error) {
+	id, err := strconv.ParseInt(uniq, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row := &Seven5User{}
+		err := tx.WhereEqual("id", id).Find(row)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return row, err
+	})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return self.codec.DecodeUserData(result.(*Seven5User).UserData)
+}
+
+//SendUserDetails encodes the user data with the Details codec (or the codec
+//given at creation) and sends it to the client.
+func (self *QbsValidatingSessionManager) SendUserDetails(i interface{}, w http.ResponseWriter) error {
+	codec := self.Details
+	if codec == nil {
+		codec = self.codec
+	}
+	encoded, err := codec.EncodeUserData(i)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(encoded))
+	return err
+}
+
+//GenerateResetRequest issues a reset token for the user and mails it with
+//Reset.  If the user does not exist, nothing is sent and no error is returned,
+//so the client cannot find out which usernames exist.  The address is the
+//username unless the user data is a MailAddresser.
+func (self *QbsValidatingSessionManager) GenerateResetRequest(username string) (string, error) {
+	if self.Reset == nil {
+		return "", HTTPError(http.StatusNotImplemented, "password reset is not available")
+	}
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return findUser(tx, username)
+	})
+	if err != nil {
+		return "", err
+	}
+	row := result.(*Seven5User)
+	if row == nil {
+		return "", nil
+	}
+	address := row.Username
+	if ud, err := self.codec.DecodeUserData(row.UserData); err == nil {
+		if addr, ok := ud.(MailAddresser); ok && addr.MailAddress() != "" {
+			address = addr.MailAddress()
+		}
+	}
+	return self.Reset.Issue(strconv.FormatInt(row.Id, 10), row.Username, address)
+}
+
+//UseResetRequest changes the password of the user if the token is one that was
+//mailed to them, has not expired, and has not been used.
+func (self *QbsValidatingSessionManager) UseResetRequest(userId string, token string, newpwd string) (bool, error) {
+	if self.Reset == nil {
+		return false, HTTPError(http.StatusNotImplemented, "password reset is not available")
+	}
+	id, err := strconv.ParseInt(userId, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	ok, err := self.Reset.Consume(userId, token)
+	if err != nil || !ok {
+		return false, err
+	}
+	hash, err := self.hasher.Hash(newpwd)
+	if err != nil {
+		return false, err
+	}
+	_, err = self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return tx.Exec("UPDATE seven5_user SET password_hash = ? WHERE id = ?", hash, id)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//Seven5ResetToken is the table used by QbsResetTokenStore.
+type Seven5ResetToken struct {
+	Id        int64
+	UserId    string    `qbs:"size:64,index,notnull"`
+	TokenHash string    `qbs:"size:64,unique,notnull"`
+	Expires   time.Time `qbs:"notnull"`
+}
+
+//QbsResetTokenStore is a ResetTokenStore that keeps the hashes of reset tokens
+//in the database of a QbsStore.
+type QbsResetTokenStore struct {
+	store *QbsStore
+}
+
+//NewQbsResetTokenStore returns a store that uses the QbsStore's database.
+func NewQbsResetTokenStore(store *QbsStore) *QbsResetTokenStore {
+	return &QbsResetTokenStore{store: store}
+}
+
+//CreateTable creates the table for reset tokens if it does not already exist.
+func (self *QbsResetTokenStore) CreateTable() error {
+	m, err := qbs.GetMigration()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.CreateTableIfNotExists(&Seven5ResetToken{})
+}
+
+//SaveResetToken removes the user's other tokens, and any expired ones, before
+//saving the new one.
+func (self *QbsResetTokenStore) SaveResetToken(userId string, hash string, expires time.Time) error {
+	_, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		if _, err := tx.Exec("DELETE FROM seven5_reset_token WHERE user_id = ? OR expires < ?", userId, time.Now()); err != nil {
+			return nil, err
+		}
+		return tx.Save(&Seven5ResetToken{UserId: userId, TokenHash: hash, Expires: expires})
+	})
+	return err
+}
+
+//ConsumeResetToken deletes the token; it was valid if a row was deleted.
+func (self *QbsResetTokenStore) ConsumeResetToken(userId string, hash string) (bool, error) {
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		r, err := tx.Exec("DELETE FROM seven5_reset_token WHERE user_id = ? AND token_hash = ? AND expires > ?",
+			userId, hash, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		return n == 1, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
@@ -0,0 +1,90 @@
+package seven5
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coocood/qbs"
+)
+
+func TestQbsPasswordUsers(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("1", 32))
+	store := setupTestStore()
+	old := NewQbsValidatingSessionManager(store, &BcryptHasher{Cost: 4}, NewJsonUserDataCodec(&sessionUser{}))
+	if err := old.CreateTable(); err != nil {
+		t.Fatalf("unable to create user table: %v", err)
+	}
+	store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return tx.Exec("DELETE FROM seven5_user")
+	})
+	id, err := old.CreateUser("Fred@Example.com", "sekrit", &sessionUser{Email: "fred@example.com"})
+	if err != nil {
+		t.Fatalf("unable to create user: %v", err)
+	}
+	if _, err := old.CreateUser("fred@example.com", "other", nil); err == nil {
+		t.Errorf("expected error creating a duplicate user")
+	}
+
+	//parameters changed, password is rehashed on login
+	mgr := NewQbsValidatingSessionManager(store, &Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16},
+		NewJsonUserDataCodec(&sessionUser{}))
+	if uniq, _, err := mgr.ValidateCredentials("fred@example.com", "wrong"); uniq != "" || err != nil {
+		t.Errorf("wrong password accepted: %s %v", uniq, err)
+	}
+	if uniq, _, err := mgr.ValidateCredentials("nobody@example.com", "sekrit"); uniq != "" || err != nil {
+		t.Errorf("unknown user accepted: %s %v", uniq, err)
+	}
+	uniq, ud, err := mgr.ValidateCredentials("FRED@example.com", "sekrit")
+	if err != nil || uniq == "" || ud.(*sessionUser).Email != "fred@example.com" {
+		t.Fatalf("login failed: %s %v", uniq, err)
+	}
+	row, _ := store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return findUser(tx, "fred@example.com")
+	})
+	if !strings.HasPrefix(row.(*Seven5User).PasswordHash, "$argon2id$") || row.(*Seven5User).Id != id {
+		t.Errorf("password was not rehashed: %s", row.(*Seven5User).PasswordHash)
+	}
+
+	//sessions can be recreated from the database
+	recovered, err := mgr.Generate(uniq)
+	if err != nil || recovered.(*sessionUser).Email != "fred@example.com" {
+		t.Errorf("unable to generate user data: %v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := mgr.SendUserDetails(recovered, w); err != nil || !strings.Contains(w.Body.String(), "fred@example.com") {
+		t.Errorf("bad user details: %v %s", err, w.Body.String())
+	}
+
+	if err := mgr.SetPassword("fred@example.com", "changed"); err != nil {
+		t.Fatalf("unable to set password: %v", err)
+	}
+	if uniq, _, _ := mgr.ValidateCredentials("fred@example.com", "changed"); uniq == "" {
+		t.Errorf("new password refused")
+	}
+
+	//password reset through the mailed token
+	tokens := NewQbsResetTokenStore(store)
+	if err := tokens.CreateTable(); err != nil {
+		t.Fatalf("unable to create reset token table: %v", err)
+	}
+	mailer := NewWriterMailer(nil)
+	mgr.Reset = NewPasswordReset(tokens, mailer, "noreply@example.com", "https://example.com/reset")
+	if token, err := mgr.GenerateResetRequest("nobody@example.com"); token != "" || err != nil || len(mailer.Sent) != 0 {
+		t.Errorf("reset issued for unknown user: %v", err)
+	}
+	token, err := mgr.GenerateResetRequest("fred@example.com")
+	if err != nil || mailer.Last() == nil || mailer.Last().To[0] != "fred@example.com" {
+		t.Fatalf("reset not mailed: %v", err)
+	}
+	if ok, err := mgr.UseResetRequest(uniq, token, "reset"); !ok || err != nil {
+		t.Fatalf("reset refused: %v", err)
+	}
+	if ok, _ := mgr.UseResetRequest(uniq, token, "again"); ok {
+		t.Errorf("reset token used twice")
+	}
+	if uniq, _, _ := mgr.ValidateCredentials("fred@example.com", "reset"); uniq == "" {
+		t.Errorf("reset password refused")
+	}
+}
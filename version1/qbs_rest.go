@@ -1,6 +1,12 @@
 package seven5
 
 import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
 	"github.com/coocood/qbs"
 )
 
@@ -39,11 +45,48 @@ type QbsRestPutUdid interface {
 	PutQbs(string, interface{}, PBundle, *qbs.Qbs) (interface{}, error)
 }
 
+//QbsRestPatch is the QBS version RestPatch
+type QbsRestPatch interface {
+	PatchQbs(int64, interface{}, PBundle, *qbs.Qbs) (interface{}, error)
+}
+
+//QbsRestPatchUdid is the QBS version RestPatchUdid
+type QbsRestPatchUdid interface {
+	PatchQbs(string, interface{}, PBundle, *qbs.Qbs) (interface{}, error)
+}
+
 //QbsRestPost is the QBS version RestPost
 type QbsRestPost interface {
 	PostQbs(interface{}, PBundle, *qbs.Qbs) (interface{}, error)
 }
 
+//QbsQueryIndex is an optional interface for a QbsRestIndex.  If the index has
+//it, the wrapper calls QueryIndexQbs instead of IndexQbs, passing the client's
+//query (filters, sort, limit and offset) so that the implementation can
+//combine it with its own criteria (see QbsIndexQuery.FindAll).  Indexes without
+//it get the query only from the PBundle.
+type QbsQueryIndex interface {
+	QueryIndexQbs(query *QbsIndexQuery, pb PBundle, tx *qbs.Qbs) (interface{}, error)
+}
+
+//QbsIndexQuery is the client's IndexQuery, as given to a QbsQueryIndex.
+type QbsIndexQuery struct {
+	Query *IndexQuery
+}
+
+//QbsVersioned is an optional interface for QbsRestPut, QbsRestPatch and
+//QbsRestDelete implementations (and their UDID versions) whose table has an
+//integer version column.  The result is the name of the table, the name of
+//the key column, and the name of the version column.  When the wrapped
+//implementation meets this interface, the version is checked against the
+//If-Match header (see VersionETag) and incremented in the same transaction as
+//the write, so two clients cannot both update the same version of a row.  The
+//wire type's version field is set to the new version before the write, and
+//the wire type should implement ETagger with VersionETag.
+type QbsVersioned interface {
+	VersionColumn() (table string, key string, version string)
+}
+
 //QbsRestAll is the same as RestAll but with the additional qbs.Qbs parameter
 //on each method.
 type QbsRestAll interface {
@@ -85,10 +128,184 @@ type qbsWrappedUdid struct {
 	post  QbsRestPost
 }
 
+//qbsWrappedPatch adds the RestPatch method to a qbsWrapped.  It is a separate
+//type because the dispatcher decides if PATCH is supported by checking for
+//the RestPatch interface.
+type qbsWrappedPatch struct {
+	*qbsWrapped
+	patch QbsRestPatch
+}
+
+type qbsWrappedPatchUdid struct {
+	*qbsWrappedUdid
+	patch QbsRestPatchUdid
+}
+
+//qbsWrappedPatchTx adds the RestPatchTx method to a qbsWrappedPatch that can
+//find, so that PATCH reads and writes in one transaction.
+type qbsWrappedPatchTx struct {
+	*qbsWrappedPatch
+}
+
+type qbsWrappedPatchTxUdid struct {
+	*qbsWrappedPatchUdid
+}
+
 //
 // WRAPPED
 //
 
+//FindAll runs the client's query on the table of rows, which must be a pointer
+//to a slice of pointers to structs as for qbs.FindAll.  The client's filters
+//are combined with scope, which holds the implementation's own criteria such
+//as "only this user's rows", and is changed by this call; scope may be nil.
+//Filter and sort fields have already been checked against the wire type by
+//the dispatcher and are checked again here against the table's struct, since
+//only fields that are in both can be used.  If the total is wanted, it is the
+//count of the rows that match the combined criteria.
+func (self *QbsIndexQuery) FindAll(tx *qbs.Qbs, scope *qbs.Condition, rows interface{}) error {
+	table := reflect.TypeOf(rows)
+	for table.Kind() == reflect.Ptr || table.Kind() == reflect.Slice {
+		table = table.Elem()
+	}
+	if table.Kind() != reflect.Struct {
+		return fmt.Errorf("FindAll needs a pointer to a slice of structs, not %T", rows)
+	}
+	query := self.Query
+	cond := scope
+	for _, f := range query.Filters {
+		col, err := indexColumn(table, f.Field)
+		if err != nil {
+			return err
+		}
+		var expr string
+		if f.Op == "in" {
+			marks := strings.TrimSuffix(strings.Repeat("?,", len(f.Args)), ",")
+			expr = fmt.Sprintf("%s IN (%s)", col, marks)
+		} else {
+			expr = fmt.Sprintf("%s %s ?", col, f.Operator())
+		}
+		if cond == nil {
+			cond = qbs.NewCondition(expr, f.Args...)
+		} else {
+			cond = cond.And(expr, f.Args...)
+		}
+	}
+	order := []string{}
+	for _, s := range query.Sort {
+		col, err := indexColumn(table, s.Field)
+		if err != nil {
+			return err
+		}
+		order = append(order, col)
+	}
+	if query.Total < 0 {
+		if cond != nil {
+			tx.Condition(cond)
+		}
+		query.Total = tx.Count(reflect.New(table).Interface())
+	}
+	if cond != nil {
+		tx.Condition(cond)
+	}
+	for i, s := range query.Sort {
+		if s.Desc {
+			tx.OrderByDesc(order[i])
+		} else {
+			tx.OrderBy(order[i])
+		}
+	}
+	if query.Limit > 0 {
+		tx.Limit(query.Limit)
+	}
+	if query.Offset > 0 {
+		tx.Offset(query.Offset)
+	}
+	return tx.FindAll(rows)
+}
+
+//indexQbs calls the index, passing the client's query if it is a QbsQueryIndex.
+func indexQbs(index QbsRestIndex, pb PBundle, tx *qbs.Qbs) (interface{}, error) {
+	q, ok := index.(QbsQueryIndex)
+	if !ok || pb == nil {
+		return index.IndexQbs(pb, tx)
+	}
+	query, err := pb.IndexQuery()
+	if err != nil {
+		return nil, err
+	}
+	return q.QueryIndexQbs(&QbsIndexQuery{Query: query}, pb, tx)
+}
+
+//indexColumn returns the column for a field of the wire type, if the table's
+//struct has an exported field with the same name.  Otherwise the error has the
+//code http.StatusBadRequest.
+func indexColumn(table reflect.Type, field string) (string, error) {
+	if table.Kind() == reflect.Ptr {
+		table = table.Elem()
+	}
+	f, ok := table.FieldByName(field)
+	if !ok || f.PkgPath != "" {
+		return "", HTTPError(http.StatusBadRequest, fmt.Sprintf("cannot query by field %s", field))
+	}
+	return qbs.FieldNameToColumnName(f.Name), nil
+}
+
+//checkVersion bumps the version of the row with the given key, if impl meets
+//QbsVersioned.  If the client sent a version in If-Match and the row is no
+//longer at that version (or is gone), the error returned has the code
+//http.StatusPreconditionFailed.  Without If-Match, a missing row is left to
+//the resource, as it is for resources that are not versioned.
+//The new version is placed in the version field of value, if value is not nil.
+func checkVersion(tx *qbs.Qbs, pb PBundle, impl interface{}, key interface{}, value interface{}) error {
+	versioned, ok := impl.(QbsVersioned)
+	if !ok {
+		return nil
+	}
+	table, keyCol, verCol := versioned.VersionColumn()
+	var next int64
+	header, _ := pb.Header("If-Match")
+	if expected, ok := ParseVersionETag(header); ok {
+		result, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = %s + 1 WHERE %s = ? AND %s = ?",
+			table, verCol, verCol, keyCol, verCol), key, expected)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return HTTPError(http.StatusPreconditionFailed, "Precondition failed, the value has been changed")
+		}
+		next = expected + 1
+	} else {
+		var current int64
+		row := tx.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", verCol, table, keyCol), key)
+		if err := row.Scan(&current); err != nil {
+			if err == sql.ErrNoRows {
+				//nothing to bump, the resource decides what a missing row means
+				return nil
+			}
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, verCol, keyCol), current+1, key); err != nil {
+			return err
+		}
+		next = current + 1
+	}
+	if value != nil {
+		v := reflect.ValueOf(value)
+		if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+			f := v.Elem().FieldByName(qbs.ColumnNameToFieldName(verCol))
+			if f.IsValid() && f.CanSet() && f.Kind() >= reflect.Int && f.Kind() <= reflect.Int64 {
+				f.SetInt(next)
+			}
+		}
+	}
+	return nil
+}
+
 func (self *qbsWrapped) applyPolicy(pb PBundle, fn func(tx *qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
 	q, err := qbs.GetQbs()
 	if err != nil {
@@ -109,7 +326,7 @@ func (self *qbsWrapped) applyPolicy(pb PBundle, fn func(tx *qbs.Qbs) (interface{
 //Index meets the interface RestIndex but calls the wrapped QBSRestIndex
 func (self *qbsWrapped) Index(pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
-		return self.index.IndexQbs(pb, tx)
+		return indexQbs(self.index, pb, tx)
 	})
 }
 
@@ -123,6 +340,9 @@ func (self *qbsWrapped) Find(id int64, pb PBundle) (interface{}, error) {
 //Delete meets the interface RestDelete but calls the wrapped QBSRestDelete
 func (self *qbsWrapped) Delete(id int64, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		if err := checkVersion(tx, pb, self.del, id, nil); err != nil {
+			return nil, err
+		}
 		return self.del.DeleteQbs(id, pb, tx)
 	})
 }
@@ -130,6 +350,9 @@ func (self *qbsWrapped) Delete(id int64, pb PBundle) (interface{}, error) {
 //Put meets the interface RestPut but calls the wrapped QBSRestPut
 func (self *qbsWrapped) Put(id int64, value interface{}, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		if err := checkVersion(tx, pb, self.put, id, value); err != nil {
+			return nil, err
+		}
 		return self.put.PutQbs(id, value, pb, tx)
 	})
 }
@@ -178,6 +401,41 @@ func (self *qbsWrapped) Allow(id int64, method string, pb PBundle) bool {
 
 }
 
+//resultFilter returns the wrapped index's, or find's, ResultFilter.
+func (self *qbsWrapped) resultFilter() (ResultFilter, bool) {
+	return wrappedResultFilter(self.index, self.find)
+}
+
+//Patch meets the interface RestPatch but calls the wrapped QBSRestPatch
+func (self *qbsWrappedPatch) Patch(id int64, value interface{}, pb PBundle) (interface{}, error) {
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		if err := checkVersion(tx, pb, self.patch, id, value); err != nil {
+			return nil, err
+		}
+		return self.patch.PatchQbs(id, value, pb, tx)
+	})
+}
+
+//PatchTx meets the interface RestPatchTx.  The current value is found with the
+//wrapped QbsRestFind and the patched value is stored with the wrapped
+//QbsRestPatch in the same transaction.
+func (self *qbsWrappedPatchTx) PatchTx(id int64, apply PatchFunc, pb PBundle) (interface{}, error) {
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		current, err := self.find.FindQbs(id, pb, tx)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := apply(current)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkVersion(tx, pb, self.patch, id, patched); err != nil {
+			return nil, err
+		}
+		return self.patch.PatchQbs(id, patched, pb, tx)
+	})
+}
+
 //
 // WRAPPED UDID
 //
@@ -201,7 +459,7 @@ func (self *qbsWrappedUdid) applyPolicy(pb PBundle, fn func(*qbs.Qbs) (interface
 //Index meets the interface RestIndex but calls the wrapped QBSRestIndex
 func (self *qbsWrappedUdid) Index(pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
-		return self.index.IndexQbs(pb, tx)
+		return indexQbs(self.index, pb, tx)
 	})
 }
 
@@ -215,6 +473,9 @@ func (self *qbsWrappedUdid) Find(id string, pb PBundle) (interface{}, error) {
 //DeleteUdid meets the interface RestDeleteUdid but calls the wrapped QBSRestDeleteUdid
 func (self *qbsWrappedUdid) Delete(id string, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		if err := checkVersion(tx, pb, self.del, id, nil); err != nil {
+			return nil, err
+		}
 		return self.del.DeleteQbs(id, pb, tx)
 	})
 }
@@ -229,6 +490,9 @@ func (self *qbsWrappedUdid) Post(value interface{}, pb PBundle) (interface{}, er
 //PutUdid meets the interface RestPutUdid but calls the wrapped QBSRestPutUdid
 func (self *qbsWrappedUdid) Put(id string, value interface{}, pb PBundle) (interface{}, error) {
 	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		if err := checkVersion(tx, pb, self.put, id, value); err != nil {
+			return nil, err
+		}
 		return self.put.PutQbs(id, value, pb, tx)
 	})
 }
@@ -270,18 +534,74 @@ func (self *qbsWrappedUdid) Allow(udid string, method string, pb PBundle) bool {
 
 }
 
+//PatchUdid meets the interface RestPatchUdid but calls the wrapped QBSRestPatchUdid
+func (self *qbsWrappedPatchUdid) Patch(id string, value interface{}, pb PBundle) (interface{}, error) {
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		if err := checkVersion(tx, pb, self.patch, id, value); err != nil {
+			return nil, err
+		}
+		return self.patch.PatchQbs(id, value, pb, tx)
+	})
+}
+
+//PatchTx meets the interface RestPatchTxUdid, see qbsWrappedPatchTx.
+func (self *qbsWrappedPatchTxUdid) PatchTx(id string, apply PatchFunc, pb PBundle) (interface{}, error) {
+	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+		current, err := self.find.FindQbs(id, pb, tx)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := apply(current)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkVersion(tx, pb, self.patch, id, patched); err != nil {
+			return nil, err
+		}
+		return self.patch.PatchQbs(id, patched, pb, tx)
+	})
+}
+
+//resultFilter returns the wrapped index's, or find's, ResultFilter.
+func (self *qbsWrappedUdid) resultFilter() (ResultFilter, bool) {
+	return wrappedResultFilter(self.index, self.find)
+}
+
+//wrappedResultFilter returns the first of the wrapped values that is a
+//ResultFilter.
+func wrappedResultFilter(wrapped ...interface{}) (ResultFilter, bool) {
+	for _, w := range wrapped {
+		if filter, ok := w.(ResultFilter); ok {
+			return filter, true
+		}
+	}
+	return nil, false
+}
+
 //
 // WRAPPING FUNCITONS
 //
 
-//Given a QbsRestAll return a RestAll
+//Given a QbsRestAll return a RestAll.  If the QbsRestAll also implements
+//QbsRestPatch, the result implements RestPatch and RestPatchTx, so PATCH
+//finds and stores the value in one transaction.
 func QbsWrapAll(a QbsRestAll, s *QbsStore) RestAll {
-	return &qbsWrapped{store: s, index: a, find: a, del: a, put: a, post: a}
+	w := &qbsWrapped{store: s, index: a, find: a, del: a, put: a, post: a}
+	if patcher, ok := a.(QbsRestPatch); ok {
+		return &qbsWrappedPatchTx{&qbsWrappedPatch{qbsWrapped: w, patch: patcher}}
+	}
+	return w
 }
 
-//Given a QbsRestAllUdid return a RestAllUdid
+//Given a QbsRestAllUdid return a RestAllUdid.  If the QbsRestAllUdid also
+//implements QbsRestPatchUdid, the result implements RestPatchUdid and
+//RestPatchTxUdid.
 func QbsWrapAllUdid(a QbsRestAllUdid, s *QbsStore) RestAllUdid {
-	return &qbsWrappedUdid{store: s, index: a, find: a, del: a, put: a, post: a}
+	w := &qbsWrappedUdid{store: s, index: a, find: a, del: a, put: a, post: a}
+	if patcher, ok := a.(QbsRestPatchUdid); ok {
+		return &qbsWrappedPatchTxUdid{&qbsWrappedPatchUdid{qbsWrappedUdid: w, patch: patcher}}
+	}
+	return w
 }
 
 //Given a QBSRestIndex return a RestIndex
@@ -319,6 +639,37 @@ func QbsWrapPutUdid(puter QbsRestPutUdid, s *QbsStore) RestPutUdid {
 	return &qbsWrappedUdid{put: puter, store: s}
 }
 
+//Given a QbsRestPatch return a RestPatch.  Since the dispatcher discovers
+//PATCH support on the put implementation, the result also meets RestPut
+//if the patcher is also a QbsRestPut (or see SetPatch).  If the patcher is
+//also a QbsRestFind, the result meets RestPatchTx.
+func QbsWrapPatch(patcher QbsRestPatch, s *QbsStore) RestPatch {
+	w := &qbsWrapped{store: s}
+	if puter, ok := patcher.(QbsRestPut); ok {
+		w.put = puter
+	}
+	result := &qbsWrappedPatch{qbsWrapped: w, patch: patcher}
+	if finder, ok := patcher.(QbsRestFind); ok {
+		w.find = finder
+		return &qbsWrappedPatchTx{result}
+	}
+	return result
+}
+
+//Given a QbsRestPatchUdid return a RestPatchUdid. See QbsWrapPatch.
+func QbsWrapPatchUdid(patcher QbsRestPatchUdid, s *QbsStore) RestPatchUdid {
+	w := &qbsWrappedUdid{store: s}
+	if puter, ok := patcher.(QbsRestPutUdid); ok {
+		w.put = puter
+	}
+	result := &qbsWrappedPatchUdid{qbsWrappedUdid: w, patch: patcher}
+	if finder, ok := patcher.(QbsRestFindUdid); ok {
+		w.find = finder
+		return &qbsWrappedPatchTxUdid{result}
+	}
+	return result
+}
+
 //Given a QbsRestPost return a RestPost
 func QbsWrapPost(poster QbsRestPost, s *QbsStore) RestPost {
 	return &qbsWrapped{post: poster, store: s}
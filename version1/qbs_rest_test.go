@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
 	"testing"
 
 	"github.com/coocood/qbs"
@@ -327,3 +328,14 @@ func checkResponse(T *testing.T, err error, resp *http.Response) {
 		T.Fatalf("failed on %s with status %d", "GET", resp.StatusCode)
 	}
 }
+
+func TestIndexColumn(t *testing.T) {
+	if _, err := indexColumn(reflect.TypeOf(&House{}), "Address"); err != nil {
+		t.Errorf("expected field of table to be found: %v", err)
+	}
+	//only in the wire type
+	_, err := indexColumn(reflect.TypeOf(&House{}), "ZipCode")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for field not in table, got %v", err)
+	}
+}
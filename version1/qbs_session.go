@@ -0,0 +1,293 @@
+package seven5
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+//Seven5Session is the table used by QbsSessionManager to store sessions.  Call
+//CreateTable on the session manager (or use your own migrations) to create it.
+//Destroyed sessions are kept, with Destroyed set, until they expire so that
+//they are not recreated from their session id.
+type Seven5Session struct {
+	Id         int64
+	SessionId  string `qbs:"size:255,unique,notnull"`
+	UniqueInfo string `qbs:"size:255,notnull,index"`
+	UserData   string
+	Expires    int64 `qbs:"index"`
+	Destroyed  bool
+}
+
+//UserDataCodec converts the user data of a session to and from the text that
+//is stored in the database by QbsSessionManager.
+type UserDataCodec interface {
+	EncodeUserData(ud interface{}) (string, error)
+	DecodeUserData(s string) (interface{}, error)
+}
+
+//JsonUserDataCodec is a UserDataCodec that stores user data as json.  User
+//data is decoded into a new instance of the type of the example provided at
+//creation time.
+type JsonUserDataCodec struct {
+	typ reflect.Type
+}
+
+//NewJsonUserDataCodec returns a codec that decodes user data into the same type
+//as the example, which should be a pointer to a struct.  If the example is nil,
+//user data is decoded into the generic form, such as map[string]interface{}.
+func NewJsonUserDataCodec(example interface{}) *JsonUserDataCodec {
+	if example == nil {
+		return &JsonUserDataCodec{}
+	}
+	return &JsonUserDataCodec{typ: reflect.TypeOf(example)}
+}
+
+//EncodeUserData encodes the user data as json.
+func (self *JsonUserDataCodec) EncodeUserData(ud interface{}) (string, error) {
+	buff, err := json.Marshal(ud)
+	if err != nil {
+		return "", err
+	}
+	return string(buff), nil
+}
+
+//DecodeUserData decodes json into a new instance of the example's type.
+func (self *JsonUserDataCodec) DecodeUserData(s string) (interface{}, error) {
+	if self.typ == nil {
+		var result interface{}
+		err := json.Unmarshal([]byte(s), &result)
+		return result, err
+	}
+	if self.typ.Kind() != reflect.Ptr {
+		ptr := reflect.New(self.typ)
+		err := json.Unmarshal([]byte(s), ptr.Interface())
+		return ptr.Elem().Interface(), err
+	}
+	ptr := reflect.New(self.typ.Elem())
+	err := json.Unmarshal([]byte(s), ptr.Interface())
+	return ptr.Interface(), err
+}
+
+//QbsSessionManager is an implementation of SessionManager that keeps sessions
+//in a database through a QbsStore, so sessions survive restarts and can be
+//shared between multiple server processes (such as Heroku dynos).  Session ids
+//are encrypted with the server's session keys in exactly the same way as the
+//SimpleSessionManager, so the two can be switched without logging anyone out.
+//If a session id can be decrypted but is not in the database, Find returns the
+//unique id so that the session can be recreated with Generate and Assign.
+//Expired sessions are removed from the database every DEFAULT_REAP_INTERVAL.
+type QbsSessionManager struct {
+	store     *QbsStore
+	generator Generator
+	codec     UserDataCodec
+	ring      *Keyring
+}
+
+//NewQbsSessionManager returns a session manager that keeps its sessions in
+//the database of the store.  The keys for the session ids are read from the
+//environment (see EnvKeySource), as with NewSimpleSessionManager.
+//The codec is used to store user data in the database and if it is nil,
+//a JsonUserDataCodec with no example is used.
+func NewQbsSessionManager(store *QbsStore, g Generator, codec UserDataCodec) *QbsSessionManager {
+	return NewQbsKeyringSessionManager(store, g, codec, serverKeyring())
+}
+
+//NewQbsKeyringSessionManager is the same as NewQbsSessionManager but the keys
+//for session ids are taken from the keyring provided.
+func NewQbsKeyringSessionManager(store *QbsStore, g Generator, codec UserDataCodec, ring *Keyring) *QbsSessionManager {
+	if ring == nil || ring.Primary() == "" {
+		panic("session manager needs a keyring with at least one key")
+	}
+	if codec == nil {
+		codec = NewJsonUserDataCodec(nil)
+	}
+	result := &QbsSessionManager{
+		store:     store,
+		generator: g,
+		codec:     codec,
+		ring:      ring,
+	}
+	go result.reap(DEFAULT_REAP_INTERVAL)
+	return result
+}
+
+//reap periodically removes expired sessions, including destroyed ones, from
+//the database.
+func (self *QbsSessionManager) reap(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := self.Reap(); err != nil {
+			log.Printf("[SESSION] unable to remove expired sessions: %v", err)
+		}
+	}
+}
+
+//Reap removes the sessions that have expired from the database.  This is
+//done periodically by the session manager but can also be called directly.
+func (self *QbsSessionManager) Reap() error {
+	_, err := self.transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return tx.Exec("DELETE FROM seven5_session WHERE expires < ?", time.Now().Unix())
+	})
+	return err
+}
+
+//CreateTable creates the table for sessions if it does not already exist.
+func (self *QbsSessionManager) CreateTable() error {
+	m, err := qbs.GetMigration()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.CreateTableIfNotExists(&Seven5Session{})
+}
+
+//transaction runs fn inside a transaction that is handled by the store's policy.
+func (self *QbsSessionManager) transaction(fn func(tx *qbs.Qbs) (interface{}, error)) (interface{}, error) {
+	return self.store.Transaction(fn)
+}
+
+//Assign creates a new session for the uniqueInfo and stores it in the database.
+//The semantics are the same as SimpleSessionManager.Assign.
+func (self *QbsSessionManager) Assign(uniqueInfo string, userData interface{}, expires time.Time) (Session, error) {
+	if expires.IsZero() {
+		expires = time.Now().Add(24 * time.Hour)
+	}
+	encoded, err := self.codec.EncodeUserData(storedUserData(userData))
+	if err != nil {
+		return nil, err
+	}
+	sid := self.ring.encrypt(uniqueInfo, expires)
+	_, err = self.transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row := &Seven5Session{
+			SessionId:  sid,
+			UniqueInfo: uniqueInfo,
+			UserData:   encoded,
+			Expires:    expires.Unix(),
+		}
+		_, err := tx.Save(row)
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewSimpleSession(userData, sid), nil
+}
+
+//findRow returns the row for the session id, or nil if there is none.
+func (self *QbsSessionManager) findRow(id string) (*Seven5Session, error) {
+	result, err := self.transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row := &Seven5Session{}
+		err := tx.WhereEqual("session_id", id).Find(row)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return row, err
+	})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return result.(*Seven5Session), nil
+}
+
+//Find looks up the session in the database.  If it is not there, but the
+//session id can be decrypted and has not expired, the unique id is returned so
+//the caller can recreate the session.  Destroyed sessions and legacy session
+//ids (see Keyring.AcceptLegacyUntil) are never recreated.
+func (self *QbsSessionManager) Find(id string) (*SessionReturn, error) {
+	if id == "" {
+		log.Printf("[SESSION] likely programming error, called find with id=\"\"")
+		return nil, nil
+	}
+	info, ok := self.ring.open(id)
+	if !ok {
+		//expired or forged, the reaper removes any row
+		return nil, nil
+	}
+	row, err := self.findRow(id)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		if info.legacy {
+			return nil, nil
+		}
+		return &SessionReturn{UniqueId: info.uniq}, nil
+	}
+	if row.Destroyed || row.Expires < time.Now().Unix() {
+		return nil, nil
+	}
+	ud, err := self.codec.DecodeUserData(row.UserData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode user data for session: %v", err)
+	}
+	return &SessionReturn{Session: NewSimpleSession(restoredUserData(row.UniqueInfo, ud), row.SessionId)}, nil
+}
+
+//Destroy marks the session as destroyed, so that Find does not return it or
+//its unique id again.  The row is removed when the session expires.
+func (self *QbsSessionManager) Destroy(id string) error {
+	info, ok := self.ring.open(id)
+	if !ok {
+		return nil
+	}
+	_, err := self.transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		r, err := tx.Exec("UPDATE seven5_session SET destroyed = ?, user_data = '' WHERE session_id = ?", true, id)
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil || n > 0 || info.legacy {
+			return nil, err
+		}
+		//not stored here, perhaps it was created by another kind of session
+		//manager, but it could still be recreated from the id
+		return tx.Save(&Seven5Session{
+			SessionId:  id,
+			UniqueInfo: info.uniq,
+			Expires:    info.expires.Unix(),
+			Destroyed:  true,
+		})
+	})
+	return err
+}
+
+//Update replaces the user data of the session in the database.  It returns nil
+//if the session no longer exists.
+func (self *QbsSessionManager) Update(session Session, i interface{}) (Session, error) {
+	encoded, err := self.codec.EncodeUserData(storedUserData(i))
+	if err != nil {
+		return nil, err
+	}
+	result, err := self.transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		r, err := tx.Exec("UPDATE seven5_session SET user_data = ? WHERE session_id = ? AND NOT destroyed",
+			encoded, session.SessionId())
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.RowsAffected()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		return NewSimpleSession(i, session.SessionId()), nil
+	})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return result.(Session), nil
+}
+
+//Generate returns nil,nil if no Generator was provided at the time of this
+//object's creation. If a Generator was provided it is invoked to create
+//the user data for this session.
+func (self *QbsSessionManager) Generate(uniq string) (interface{}, error) {
+	if self.generator == nil {
+		return nil, nil
+	}
+	return self.generator.Generate(uniq)
+}
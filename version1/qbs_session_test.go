@@ -0,0 +1,107 @@
+package seven5
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coocood/qbs"
+	_ "github.com/lib/pq"
+)
+
+type sessionUser struct {
+	Email string
+	Admin bool
+}
+
+type userGen struct {
+}
+
+func (self *userGen) Generate(uniqueId string) (interface{}, error) {
+	return &sessionUser{Email: uniqueId}, nil
+}
+
+func TestQbsSessionManager(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("1", 32))
+	store := setupTestStore()
+	mgr := NewQbsSessionManager(store, &userGen{}, NewJsonUserDataCodec(&sessionUser{}))
+	if err := mgr.CreateTable(); err != nil {
+		t.Fatalf("unable to create session table: %v", err)
+	}
+
+	sr, err := mgr.Find("bogus")
+	if err != nil {
+		t.Fatalf("failed to find: %v", err)
+	}
+	if sr != nil {
+		t.Errorf("unexpected find of 'bogus'")
+	}
+
+	s, err := mgr.Assign("fred@example.com", &sessionUser{Email: "fred@example.com", Admin: true}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to assign: %v", err)
+	}
+
+	//a second manager is like a second server process
+	other := NewQbsSessionManager(store, &userGen{}, NewJsonUserDataCodec(&sessionUser{}))
+	sr, err = other.Find(s.SessionId())
+	if err != nil || sr == nil || sr.Session == nil {
+		t.Fatalf("failed to find session from another manager: %v, %+v", err, sr)
+	}
+	if u := sr.Session.UserData().(*sessionUser); u.Email != "fred@example.com" || !u.Admin {
+		t.Errorf("wrong user data from database: %+v", u)
+	}
+
+	updated, err := other.Update(sr.Session, &sessionUser{Email: "fred@example.com"})
+	if err != nil || updated == nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	sr, _ = mgr.Find(s.SessionId())
+	if sr == nil || sr.Session == nil || sr.Session.UserData().(*sessionUser).Admin {
+		t.Errorf("update did not reach the database")
+	}
+
+	//destroyed sessions are not recreated, by any process
+	if err := mgr.Destroy(s.SessionId()); err != nil {
+		t.Fatalf("failed to destroy: %v", err)
+	}
+	sr, err = other.Find(s.SessionId())
+	if err != nil || sr != nil {
+		t.Fatalf("expected nothing after destroy, got %+v (%v)", sr, err)
+	}
+
+	//ids that are good but not in the database can be regenerated
+	sid := mgr.ring.encrypt("wilma@example.com", time.Now().Add(time.Hour))
+	sr, err = mgr.Find(sid)
+	if err != nil || sr == nil || sr.Session != nil || sr.UniqueId != "wilma@example.com" {
+		t.Fatalf("expected to recover unique id, got %+v (%v)", sr, err)
+	}
+	if err := mgr.Destroy(sid); err != nil {
+		t.Fatalf("failed to destroy: %v", err)
+	}
+	if sr, err = mgr.Find(sid); err != nil || sr != nil {
+		t.Fatalf("expected nothing after destroy of unstored id, got %+v (%v)", sr, err)
+	}
+
+	//expired sessions are not found at all
+	s, err = mgr.Assign("barney@example.com", nil, time.Now().Add(-1*time.Hour))
+	if err != nil {
+		t.Fatalf("failed to assign: %v", err)
+	}
+	sr, err = mgr.Find(s.SessionId())
+	if err != nil || sr != nil {
+		t.Errorf("expected expired session to be ignored, got %+v (%v)", sr, err)
+	}
+	if err := mgr.Reap(); err != nil {
+		t.Fatalf("failed to reap: %v", err)
+	}
+	var count int64
+	store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		count = tx.WhereEqual("session_id", s.SessionId()).Count(&Seven5Session{})
+		return nil, nil
+	})
+	if count != 0 {
+		t.Errorf("expected expired session to be reaped")
+	}
+}
@@ -28,6 +28,25 @@ func NewQbsStoreFromDSN(dsn *qbs.DataSourceName) *QbsStore {
 	return result
 }
 
+//Transaction runs fn inside a transaction that is handled by the store's
+//policy, the same way as resources wrapped with QbsWrapAll.
+func (self *QbsStore) Transaction(fn func(tx *qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
+	q, err := qbs.GetQbs()
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	tx := self.Policy.StartTransaction(q)
+	defer func() {
+		if x := recover(); x != nil {
+			result_obj, result_error = self.Policy.HandlePanic(tx, x)
+		}
+	}()
+	value, err := fn(tx)
+	return self.Policy.HandleResult(tx, value, err)
+}
+
 //ParamsToDSN allows you to create a DSN directly from some values. This
 //is useful for testing.  If driver or user is "", the default driver and
 //user are used.
@@ -0,0 +1,132 @@
+package seven5
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+//Seven5LoginFailure is the table of failed logins used by QbsThrottleStore.
+type Seven5LoginFailure struct {
+	Id          int64
+	ThrottleKey string    `qbs:"size:255,index,notnull"`
+	At          time.Time `qbs:"notnull"`
+}
+
+//Seven5Lockout is the table of locked accounts used by QbsThrottleStore.
+type Seven5Lockout struct {
+	Id          int64
+	ThrottleKey string `qbs:"size:255,unique,notnull"`
+}
+
+//QbsThrottleStore is a ThrottleStore that keeps failed logins in the database
+//of a QbsStore, so they are shared by all the server processes.
+type QbsThrottleStore struct {
+	store *QbsStore
+}
+
+//NewQbsThrottleStore returns a store that uses the QbsStore's database.
+func NewQbsThrottleStore(store *QbsStore) *QbsThrottleStore {
+	return &QbsThrottleStore{store: store}
+}
+
+//CreateTables creates the tables for failures and lockouts if they do not
+//already exist.
+func (self *QbsThrottleStore) CreateTables() error {
+	m, err := qbs.GetMigration()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.CreateTableIfNotExists(&Seven5LoginFailure{}); err != nil {
+		return err
+	}
+	return m.CreateTableIfNotExists(&Seven5Lockout{})
+}
+
+//AddFailure also removes the failures for every key before since.
+func (self *QbsThrottleStore) AddFailure(key string, at time.Time, since time.Time) (int64, error) {
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		if _, err := tx.Exec("DELETE FROM seven5_login_failure WHERE at <= ?", since); err != nil {
+			return nil, err
+		}
+		row := &Seven5LoginFailure{ThrottleKey: key, At: at}
+		if _, err := tx.Save(row); err != nil {
+			return nil, err
+		}
+		return row.Id, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+func (self *QbsThrottleStore) Failures(key string, since time.Time, before int64) (int, time.Time, error) {
+	var rows []*Seven5LoginFailure
+	_, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		condition := qbs.NewEqualCondition("throttle_key", key).And("at > ?", since)
+		if before != 0 {
+			condition = condition.And("id < ?", before)
+		}
+		return nil, tx.Condition(condition).FindAll(&rows)
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var last time.Time
+	for _, row := range rows {
+		if row.At.After(last) {
+			last = row.At
+		}
+	}
+	return len(rows), last, nil
+}
+
+func (self *QbsThrottleStore) RemoveFailure(key string, id int64) error {
+	_, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return tx.Exec("DELETE FROM seven5_login_failure WHERE throttle_key = ? AND id = ?", key, id)
+	})
+	return err
+}
+
+func (self *QbsThrottleStore) Clear(key string) error {
+	_, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		return tx.Exec("DELETE FROM seven5_login_failure WHERE throttle_key = ?", key)
+	})
+	return err
+}
+
+func (self *QbsThrottleStore) SetLocked(key string, locked bool) error {
+	_, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		if !locked {
+			return tx.Exec("DELETE FROM seven5_lockout WHERE throttle_key = ?", key)
+		}
+		row := &Seven5Lockout{}
+		err := tx.WhereEqual("throttle_key", key).Find(row)
+		if err == nil {
+			return nil, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		return tx.Save(&Seven5Lockout{ThrottleKey: key})
+	})
+	return err
+}
+
+func (self *QbsThrottleStore) Locked(key string) (bool, error) {
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row := &Seven5Lockout{}
+		err := tx.WhereEqual("throttle_key", key).Find(row)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
@@ -0,0 +1,83 @@
+package seven5
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strings"
+
+	"github.com/coocood/qbs"
+)
+
+//Seven5SecondFactor is the table used by QbsSecondFactorStore.
+type Seven5SecondFactor struct {
+	Id            int64
+	UniqueId      string `qbs:"size:255,unique,notnull"`
+	Secret        string `qbs:"size:64,notnull"`
+	Confirmed     bool
+	LastStep      int64
+	RecoveryCodes string
+}
+
+//QbsSecondFactorStore is a SecondFactorStore that keeps the TOTP secrets and
+//recovery codes of users in the database of a QbsStore.
+type QbsSecondFactorStore struct {
+	store *QbsStore
+}
+
+//NewQbsSecondFactorStore returns a store that uses the QbsStore's database.
+func NewQbsSecondFactorStore(store *QbsStore) *QbsSecondFactorStore {
+	return &QbsSecondFactorStore{store: store}
+}
+
+//CreateTable creates the table for second factors if it does not already exist.
+func (self *QbsSecondFactorStore) CreateTable() error {
+	m, err := qbs.GetMigration()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	return m.CreateTableIfNotExists(&Seven5SecondFactor{})
+}
+
+func (self *QbsSecondFactorStore) LoadSecondFactor(uniq string) (*SecondFactorState, error) {
+	result, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		row := &Seven5SecondFactor{}
+		err := tx.WhereEqual("unique_id", uniq).Find(row)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return row, err
+	})
+	if err != nil || result == nil {
+		return nil, err
+	}
+	row := result.(*Seven5SecondFactor)
+	secret, err := base64.StdEncoding.DecodeString(row.Secret)
+	if err != nil {
+		return nil, err
+	}
+	state := &SecondFactorState{Secret: secret, Confirmed: row.Confirmed, LastStep: row.LastStep}
+	if row.RecoveryCodes != "" {
+		state.RecoveryCodes = strings.Split(row.RecoveryCodes, ",")
+	}
+	return state, nil
+}
+
+func (self *QbsSecondFactorStore) SaveSecondFactor(uniq string, state *SecondFactorState) error {
+	_, err := self.store.Transaction(func(tx *qbs.Qbs) (interface{}, error) {
+		if _, err := tx.Exec("DELETE FROM seven5_second_factor WHERE unique_id = ?", uniq); err != nil {
+			return nil, err
+		}
+		if state == nil {
+			return nil, nil
+		}
+		return tx.Save(&Seven5SecondFactor{
+			UniqueId:      uniq,
+			Secret:        base64.StdEncoding.EncodeToString(state.Secret),
+			Confirmed:     state.Confirmed,
+			LastStep:      state.LastStep,
+			RecoveryCodes: strings.Join(state.RecoveryCodes, ","),
+		})
+	})
+	return err
+}
@@ -11,6 +11,8 @@ import (
 	"unicode"
 )
 
+//MAX_FORM_SIZE is the default limit on the size of a request body; it can
+//be changed for a particular resource with SetBodyLimit.
 const MAX_FORM_SIZE = 16 * 1024
 
 //NewRawDispatcher is the lower-level interface to creating a RawDispatcher.  Applications only
@@ -51,13 +53,19 @@ func NewRestNode() *RestNode {
 
 //RawDispatcher is the "parent" type of dispatchers that understand REST.   This class
 //is actually broken into pieces so that parts of its implementation may be changed
-//by applications.
+//by applications.  If CORS is not nil, it is the policy used for cross-origin
+//requests on any resource that does not have its own (see SetCORSPolicy).
+//If CSRF is not nil, requests that have a session and change something must
+//pass the check of the policy (see CSRFPolicy).  NewRawDispatcher leaves it nil
+//and NewBaseDispatcher sets it to a DoubleSubmitCSRF.
 type RawDispatcher struct {
 	Root       *RestNode
 	IO         IOHook
 	SessionMgr SessionManager
 	Auth       Authorizer
 	Prefix     string
+	CORS       CORSPolicy
+	CSRF       CSRFPolicy
 }
 
 func (self *RawDispatcher) validateType(example interface{}) reflect.Type {
@@ -69,26 +77,37 @@ func (self *RawDispatcher) validateType(example interface{}) reflect.Type {
 	if under.Kind() != reflect.Struct {
 		panic("wire example is not a pointer to a struct (but is a pointer)")
 	}
+	if err := CompileValidation(t); err != nil {
+		panic(err.Error())
+	}
 	return t
 }
 
 //AddResourceSeparate adds a resource to a given rest node, in a way parallel
-//to ResourceSeparate.
+//to ResourceSeparate.  If the put implementation also implements RestPatch, the
+//resource will accept PATCH requests; otherwise, a patch implementation can
+//be given with SetPatch.
 func (self *RawDispatcher) AddResourceSeparate(node *RestNode, name string, wireExample interface{}, index RestIndex,
 	find RestFind, post RestPost, put RestPut, del RestDelete) {
 
 	t := self.validateType(wireExample)
 	obj := &restObj{
 		restShared: restShared{
-			typ:   t,
-			name:  name,
-			index: index,
-			post:  post,
+			typ:          t,
+			name:         name,
+			path:         strings.ToLower(name),
+			index:        index,
+			post:         post,
+			defaultLimit: DEFAULT_INDEX_LIMIT,
+			maxLimit:     MAX_INDEX_LIMIT,
 		},
 		find: find,
 		del:  del,
 		put:  put,
 	}
+	if patch, ok := put.(RestPatch); ok {
+		obj.patch = patch
+	}
 	node.Res[strings.ToLower(name)] = obj
 }
 
@@ -112,24 +131,70 @@ func (self *RawDispatcher) ResourceSeparateUdid(name string, wireExample interfa
 }
 
 //AddResourceSeparateUdid adds a resource to a given rest node, in a way parallel
-//to ResourceSeparateUdid.
+//to ResourceSeparateUdid.  If the put implementation also implements RestPatchUdid, the
+//resource will accept PATCH requests.
 func (self *RawDispatcher) AddResourceSeparateUdid(node *RestNode, name string, wireExample interface{}, index RestIndex,
 	find RestFindUdid, post RestPost, put RestPutUdid, del RestDeleteUdid) {
 	t := self.validateType(wireExample)
 	obj := &restObjUdid{
 		restShared: restShared{
-			typ:   t,
-			name:  name,
-			index: index,
-			post:  post,
+			typ:          t,
+			name:         name,
+			path:         strings.ToLower(name),
+			index:        index,
+			post:         post,
+			defaultLimit: DEFAULT_INDEX_LIMIT,
+			maxLimit:     MAX_INDEX_LIMIT,
 		},
 		find: find,
 		del:  del,
 		put:  put,
 	}
+	if patch, ok := put.(RestPatchUdid); ok {
+		obj.patch = patch
+	}
 	node.ResUdid[strings.ToLower(name)] = obj
 }
 
+//SetPatch sets the implementation of PATCH for the resource with the given
+//name (see SetCORSPolicy for the names of subresources), for when it is not
+//the put implementation.  The patch must be a RestPatch for resources with
+//int64 ids and a RestPatchUdid for resources with UDIDs.  This call panics if
+//the resource cannot be found or the patch is the wrong kind, because this
+//indicates that the program is misconfigured.
+func (self *RawDispatcher) SetPatch(name string, patch interface{}) {
+	rez, rezUdid := self.findRest(name)
+	switch {
+	case rez != nil:
+		p, ok := patch.(RestPatch)
+		if !ok {
+			panic(fmt.Sprintf("patch for %s is not a RestPatch (%T)", name, patch))
+		}
+		rez.patch = p
+	case rezUdid != nil:
+		p, ok := patch.(RestPatchUdid)
+		if !ok {
+			panic(fmt.Sprintf("patch for %s is not a RestPatchUdid (%T)", name, patch))
+		}
+		rezUdid.patch = p
+	default:
+		panic(fmt.Sprintf("unable to find resource %s", name))
+	}
+}
+
+//SetBodyLimit changes the largest request body, in bytes, that will be accepted
+//by the resource with the given name (see SetCORSPolicy for the names of
+//subresources).  Larger bodies are refused with a 413 (Request Entity Too Large).
+//This call panics if the resource cannot be found, because this indicates that
+//the program is misconfigured.
+func (self *RawDispatcher) SetBodyLimit(name string, limit int64) {
+	shared := self.findRestShared(name)
+	if shared == nil {
+		panic(fmt.Sprintf("unable to find resource %s", name))
+	}
+	shared.maxBody = limit
+}
+
 //Resource is the shorter form of ResourceSeparate that allows you to pass a single resource
 //in so long as it meets the interface RestAll.  Resource name must be singular and camel case and will be
 //converted to all lowercase for use as a url.  The example wire type's fields must be public.
@@ -190,6 +255,8 @@ func (self *RawDispatcher) SubResource(parentWire interface{},
 	parent.Children[subresourcename] = child
 	self.AddResourceSeparate(child, subresourcename, wireExample,
 		index, find, post, put, del)
+	rez := child.Res[strings.ToLower(subresourcename)]
+	rez.path = wirePath(parent, reflect.TypeOf(parentWire)) + "/" + rez.path
 }
 
 //SubResourceSeparate is for adding a subresource, analagous to ResourceSeparate.
@@ -218,6 +285,8 @@ func (self *RawDispatcher) SubResourceUdid(parentWire interface{}, subresourcena
 	parent.ChildrenUdid[strings.ToLower(exampleTypeToName(wireExample))] = child
 	self.AddResourceSeparateUdid(child, subresourcename, wireExample, index,
 		find, post, put, del)
+	rez := child.ResUdid[strings.ToLower(subresourcename)]
+	rez.path = wirePath(parent, reflect.TypeOf(parentWire)) + "/" + rez.path
 }
 
 //SubResourceSeparateUdid is for adding a subresource udid, analagous to ResourceSeparateUdid.
@@ -230,6 +299,22 @@ func (self *RawDispatcher) SubResourceSeparateUdid(parentWire interface{}, wireE
 		wireExample, index, find, post, put, del)
 }
 
+//wirePath returns the path of the resource in the node that has the given type
+//as a target.
+func wirePath(node *RestNode, target reflect.Type) string {
+	for _, v := range node.Res {
+		if v.typ == target {
+			return v.path
+		}
+	}
+	for _, v := range node.ResUdid {
+		if v.typ == target {
+			return v.path
+		}
+	}
+	return ""
+}
+
 //FindWireType searches the tree of rest resources trying to find one that has the
 //given type as a target. This is only of interest to dispatch implementors.
 func (self *RawDispatcher) FindWireType(target reflect.Type, curr *RestNode) *RestNode {
@@ -276,9 +361,16 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 		path = path[len(pre):]
 	}
 	parts := strings.Split(path, "/")
+	if self.handleCORS(w, r, parts) {
+		return nil
+	}
 	bundle, err := self.IO.BundleHook(w, r, self.SessionMgr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create parameter bundle:%s", err), http.StatusInternalServerError)
+		sendProblem(w, fmt.Sprintf("failed to create parameter bundle:%s", err), http.StatusInternalServerError)
+		return nil
+	}
+	if IsPartialSession(bundle.Session()) {
+		WriteError(w, secondFactorRequired())
 		return nil
 	}
 	self.DispatchSegment(mux, w, r, parts, self.Root, bundle)
@@ -298,7 +390,7 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 	matched, id, rez, rezUdid := self.resolve(parts, current)
 	if matched == "" {
 		//typically trips the error dispatcher
-		http.NotFound(w, r)
+		sendProblem(w, fmt.Sprintf("No such resource: %s", r.URL.Path), http.StatusNotFound)
 		return
 	}
 	method := strings.ToUpper(r.Method)
@@ -316,7 +408,7 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			num = n
 			if errMessage != "" {
 				//typically trips the error dispatcher
-				http.Error(w, fmt.Sprintf("Bad request (id): %s", errMessage), http.StatusBadRequest)
+				sendProblem(w, fmt.Sprintf("Bad request (id): %s", errMessage), http.StatusBadRequest)
 				return
 			}
 		}
@@ -333,19 +425,22 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 		//we need to shear off the front parts and process the id
 		if rezUdid == nil {
 			if num <= 0 {
-				http.Error(w, fmt.Sprintf("Bad request id"), http.StatusBadRequest)
+				sendProblem(w, fmt.Sprintf("Bad request id"), http.StatusBadRequest)
 				return
 			}
 			if rez.find == nil {
-				http.Error(w, "Not implemented (FIND)", http.StatusNotImplemented)
+				sendProblem(w, "Not implemented (FIND)", http.StatusNotImplemented)
 				return
 			}
 			if self.Auth != nil && !self.Auth.Find(rez, num, bundle) {
 				//typically trips the error dispatcher
-				http.Error(w, "Not authorized (FIND)", http.StatusUnauthorized)
+				sendProblem(w, "Not authorized (FIND)", http.StatusUnauthorized)
 				return
 			}
 			result, err := rez.find.Find(num, bundle)
+			if err == nil {
+				result, err = filterFindResult(&rez.restShared, rez.find, result, bundle)
+			}
 			if err != nil {
 				self.SendError(err, w, "Internal error on Find")
 				return
@@ -355,7 +450,7 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 				if !ok {
 					node, ok = current.ChildrenUdid[parts[2]]
 					if !ok {
-						http.Error(w, fmt.Sprintf("No such subresource:%s", parts[2]),
+						sendProblem(w, fmt.Sprintf("No such subresource:%s", parts[2]),
 							http.StatusNotFound)
 					}
 				}
@@ -368,15 +463,18 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 		//it's a UDID
 		if rezUdid.find == nil {
 			//typically trips the error dispatcher
-			http.Error(w, "Not implemented (FIND,UDID)", http.StatusNotImplemented)
+			sendProblem(w, "Not implemented (FIND,UDID)", http.StatusNotImplemented)
 			return
 		}
 		if self.Auth != nil && !self.Auth.FindUdid(rezUdid, id, bundle) {
 			//typically trips the error dispatcher
-			http.Error(w, "Not authorized (FIND, UDID)", http.StatusUnauthorized)
+			sendProblem(w, "Not authorized (FIND, UDID)", http.StatusUnauthorized)
 			return
 		}
 		result, err := rezUdid.find.Find(id, bundle)
+		if err == nil {
+			result, err = filterFindResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+		}
 		if err != nil {
 			self.SendError(err, w, "Internal error on Find (UDID")
 			return
@@ -386,7 +484,7 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 		if !ok {
 			node, ok = current.ChildrenUdid[parts[2]]
 			if !ok {
-				http.Error(w, fmt.Sprintf("No such subresource:%s", parts[2]),
+				sendProblem(w, fmt.Sprintf("No such subresource:%s", parts[2]),
 					http.StatusNotFound)
 			}
 		}
@@ -397,19 +495,47 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 	}
 
 	//
-	//pull anything from the body that's there, we might need it
+	// OPTIONS AND HEAD ARE COMPUTED FROM THE REGISTERED INTERFACES
 	//
-	if rezUdid == nil {
-		body, err = self.IO.BodyHook(r, &rez.restShared)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
+	allow := allowedMethods(rez, rezUdid, id != "")
+	switch method {
+	case "OPTIONS":
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	case "HEAD":
+		method = "GET"
+		w = &headResponseWriter{w}
+	}
+	//check this first so we don't run the method when we can't send the result
+	if checker, ok := self.IO.(AcceptChecker); ok {
+		if _, err := checker.CheckAccept(r); err != nil {
+			self.SendError(err, w, "Unable to check Accept")
 			return
 		}
-	} else {
-		body, err = self.IO.BodyHook(r, &rezUdid.restShared)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
-			return
+	}
+	if self.handleCSRF(w, r, bundle) {
+		return
+	}
+
+	//
+	//pull anything from the body that's there, we might need it... PATCH
+	//bodies are not wire types so they are handled separately
+	//
+	if method != "PATCH" {
+		if rezUdid == nil {
+			body, err = self.IO.BodyHook(r, &rez.restShared)
+			if err != nil {
+				self.sendBodyError(err, w)
+				return
+			}
+		} else {
+			body, err = self.IO.BodyHook(r, &rezUdid.restShared)
+			if err != nil {
+				self.sendBodyError(err, w)
+				return
+			}
 		}
 	}
 
@@ -420,38 +546,56 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			if rez != nil {
 				if rez.index == nil {
 					//typically trips the error dispatcher
-					http.Error(w, "Not implemented (INDEX)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (INDEX)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.Index(&rez.restShared, bundle) {
 					//typically trips the error dispatcher
-					http.Error(w, "Not authorized (INDEX)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (INDEX)", http.StatusUnauthorized)
+					return
+				}
+				query, err := self.indexQuery(bundle, &rez.restShared)
+				if err != nil {
+					self.SendError(err, w, "Bad index query")
 					return
 				}
 				result, err := rez.index.Index(bundle)
+				if err == nil {
+					result, err = filterIndexResult(&rez.restShared, rez.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Index")
 				} else {
 					//go through encoding
+					self.paginationHeaders(r, query, bundle)
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
 			} else {
 				//UDID INDER
 				if rezUdid.index == nil {
 					//typically trips the error dispatcher
-					http.Error(w, "Not implemented (INDEX, UDID)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (INDEX, UDID)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.Index(&rezUdid.restShared, bundle) {
 					//typically trips the error dispatcher
-					http.Error(w, "Not authorized (INDEX, UDID)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (INDEX, UDID)", http.StatusUnauthorized)
+					return
+				}
+				query, err := self.indexQuery(bundle, &rezUdid.restShared)
+				if err != nil {
+					self.SendError(err, w, "Bad index query")
 					return
 				}
 				result, err := rezUdid.index.Index(bundle)
+				if err == nil {
+					result, err = filterIndexResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Index (UDID)")
 				} else {
 					//go through encoding
+					self.paginationHeaders(r, query, bundle)
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
 			}
@@ -460,18 +604,21 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			if rez != nil {
 				if rez.find == nil {
 					//typically trips the error dispatcher
-					http.Error(w, "Not implemented (FIND)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (FIND)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.Find(rez, num, bundle) {
 					//typically trips the error dispatcher
-					http.Error(w, "Not authorized (FIND)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (FIND)", http.StatusUnauthorized)
 					return
 				}
 				result, err := rez.find.Find(num, bundle)
+				if err == nil {
+					result, err = filterFindResult(&rez.restShared, rez.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Find")
-				} else {
+				} else if !self.notModified(w, r, bundle, result) {
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
 				return
@@ -479,18 +626,21 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 				//UDID RESOURCE
 				if rezUdid.find == nil {
 					//typically trips the error dispatcher
-					http.Error(w, "Not implemented (FIND,UDID)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (FIND,UDID)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.FindUdid(rezUdid, id, bundle) {
 					//typically trips the error dispatcher
-					http.Error(w, "Not authorized (FIND, UDID)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (FIND, UDID)", http.StatusUnauthorized)
 					return
 				}
 				result, err := rezUdid.find.Find(id, bundle)
+				if err == nil {
+					result, err = filterFindResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Find (UDID")
-				} else {
+				} else if !self.notModified(w, r, bundle, result) {
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
 				return
@@ -499,96 +649,142 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 	case "POST":
 		if rez != nil {
 			if id != "" {
-				http.Error(w, "can't POST to a particular resource, did you mean PUT?", http.StatusBadRequest)
+				sendProblem(w, "can't POST to a particular resource, did you mean PUT?", http.StatusBadRequest)
 				return
 			}
 			if rez.post == nil {
-				http.Error(w, "Not implemented (POST)", http.StatusNotImplemented)
+				self.MethodNotAllowed(w, allow, "Method not allowed (POST)")
 				return
 			}
 			if self.Auth != nil && !self.Auth.Post(&rez.restShared, bundle) {
-				http.Error(w, "Not authorized (POST)", http.StatusUnauthorized)
+				sendProblem(w, "Not authorized (POST)", http.StatusUnauthorized)
+				return
+			}
+			if err := ValidateWire(body); err != nil {
+				self.sendValidationError(err, w)
 				return
 			}
 			result, err := rez.post.Post(body, bundle)
+			var location string
+			if err == nil {
+				location = self.location(rez.name, false, result)
+				result, err = filterFindResult(&rez.restShared, rez.find, result, bundle)
+			}
 			if err != nil {
 				self.SendError(err, w, "Internal error on Post")
 			} else {
-				self.IO.SendHook(&rez.restShared, w, bundle, result, self.location(rez.name, false, result))
+				self.IO.SendHook(&rez.restShared, w, bundle, result, location)
 			}
 			return
 		} else {
 			//UDID POST
 			if id != "" {
-				http.Error(w, "can't (UDID) POST to a particular resource, did you mean PUT?", http.StatusBadRequest)
+				sendProblem(w, "can't (UDID) POST to a particular resource, did you mean PUT?", http.StatusBadRequest)
 				return
 			}
 			if rezUdid.post == nil {
-				http.Error(w, "Not implemented (POST, UDID)", http.StatusNotImplemented)
+				self.MethodNotAllowed(w, allow, "Method not allowed (POST, UDID)")
 				return
 			}
 			if self.Auth != nil && !self.Auth.Post(&rezUdid.restShared, bundle) {
-				http.Error(w, "Not authorized (POST)", http.StatusUnauthorized)
+				sendProblem(w, "Not authorized (POST)", http.StatusUnauthorized)
+				return
+			}
+			if err := ValidateWire(body); err != nil {
+				self.sendValidationError(err, w)
 				return
 			}
 			result, err := rezUdid.post.Post(body, bundle)
+			var location string
+			if err == nil {
+				location = self.location(rezUdid.name, true, result)
+				result, err = filterFindResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+			}
 			if err != nil {
 				self.SendError(err, w, "Internal error on Post")
 			} else {
-				self.IO.SendHook(&rezUdid.restShared, w, bundle, result, self.location(rezUdid.name, true, result))
+				self.IO.SendHook(&rezUdid.restShared, w, bundle, result, location)
 			}
 			return
 
 		}
 	case "PUT", "DELETE":
 		if id == "" {
-			http.Error(w, fmt.Sprintf("%s requires a resource id or UDID", method), http.StatusBadRequest)
+			sendProblem(w, fmt.Sprintf("%s requires a resource id or UDID", method), http.StatusBadRequest)
 			return
 		}
 		if method == "PUT" {
 			if rez != nil {
 				if rez.put == nil {
-					http.Error(w, "Not implemented (PUT)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (PUT)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.Put(rez, num, bundle) {
-					http.Error(w, "Not authorized (PUT)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (PUT)", http.StatusUnauthorized)
+					return
+				}
+				if !self.ifMatch(w, r, finder(rez, num, bundle), hasResultFilter(&rez.restShared, rez.find)) {
+					return
+				}
+				if err := ValidateWire(body); err != nil {
+					self.sendValidationError(err, w)
 					return
 				}
 				result, err := rez.put.Put(num, body, bundle)
+				if err == nil {
+					result, err = filterFindResult(&rez.restShared, rez.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Put")
 				} else {
+					self.setETag(r, bundle, result)
 					self.IO.SendHook(&rez.restShared, w, bundle, result, "")
 				}
 			} else {
 				//PUT ON UDID
 				if rezUdid.put == nil {
-					http.Error(w, "Not implemented (PUT, UDID)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (PUT, UDID)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.PutUdid(rezUdid, id, bundle) {
-					http.Error(w, "Not authorized (PUT, UDID)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (PUT, UDID)", http.StatusUnauthorized)
+					return
+				}
+				if !self.ifMatch(w, r, finderUdid(rezUdid, id, bundle), hasResultFilter(&rezUdid.restShared, rezUdid.find)) {
+					return
+				}
+				if err := ValidateWire(body); err != nil {
+					self.sendValidationError(err, w)
 					return
 				}
 				result, err := rezUdid.put.Put(id, body, bundle)
+				if err == nil {
+					result, err = filterFindResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Put (UDID)")
 				} else {
+					self.setETag(r, bundle, result)
 					self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
 				}
 			}
 		} else {
 			if rez != nil {
 				if rez.del == nil {
-					http.Error(w, "Not implemented (DELETE)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (DELETE)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.Delete(rez, num, bundle) {
-					http.Error(w, "Not authorized (DELETE)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (DELETE)", http.StatusUnauthorized)
+					return
+				}
+				if !self.ifMatch(w, r, finder(rez, num, bundle), hasResultFilter(&rez.restShared, rez.find)) {
 					return
 				}
 				result, err := rez.del.Delete(num, bundle)
+				if err == nil {
+					result, err = filterFindResult(&rez.restShared, rez.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Delete")
 				} else {
@@ -597,14 +793,20 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			} else {
 				//UDID DELETE
 				if rezUdid.del == nil {
-					http.Error(w, "Not implemented (DELETE, UDID)", http.StatusNotImplemented)
+					self.MethodNotAllowed(w, allow, "Method not allowed (DELETE, UDID)")
 					return
 				}
 				if self.Auth != nil && !self.Auth.DeleteUdid(rezUdid, id, bundle) {
-					http.Error(w, "Not authorized (DELETE, UDID)", http.StatusUnauthorized)
+					sendProblem(w, "Not authorized (DELETE, UDID)", http.StatusUnauthorized)
+					return
+				}
+				if !self.ifMatch(w, r, finderUdid(rezUdid, id, bundle), hasResultFilter(&rezUdid.restShared, rezUdid.find)) {
 					return
 				}
 				result, err := rezUdid.del.Delete(id, bundle)
+				if err == nil {
+					result, err = filterFindResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+				}
 				if err != nil {
 					self.SendError(err, w, "Internal error on Delete")
 				} else {
@@ -613,17 +815,157 @@ func (self *RawDispatcher) DispatchSegment(mux *ServeMux, w http.ResponseWriter,
 			}
 		}
 		return
+	case "PATCH":
+		if id == "" {
+			sendProblem(w, "PATCH requires a resource id or UDID", http.StatusBadRequest)
+			return
+		}
+		if rez != nil {
+			if !rez.canPatch() {
+				self.MethodNotAllowed(w, allow, "Method not allowed (PATCH)")
+				return
+			}
+			//PATCH is a write to an existing resource, so it is authorized as a PUT
+			if self.Auth != nil && !self.Auth.Put(rez, num, bundle) {
+				sendProblem(w, "Not authorized (PATCH)", http.StatusUnauthorized)
+				return
+			}
+			apply := self.patcher(r, &rez.restShared, rez.find, bundle)
+			var result interface{}
+			if tx, ok := rez.patch.(RestPatchTx); ok {
+				result, err = tx.PatchTx(num, apply, bundle)
+			} else {
+				result, err = rez.find.Find(num, bundle)
+				if err == nil {
+					result, err = apply(result)
+				}
+				if err == nil {
+					result, err = rez.patch.Patch(num, result, bundle)
+				}
+			}
+			if err == nil {
+				result, err = filterFindResult(&rez.restShared, rez.find, result, bundle)
+			}
+			if err != nil {
+				self.SendError(err, w, "Internal error on Patch")
+			} else {
+				self.setETag(r, bundle, result)
+				self.IO.SendHook(&rez.restShared, w, bundle, result, "")
+			}
+		} else {
+			//PATCH ON UDID
+			if !rezUdid.canPatch() {
+				self.MethodNotAllowed(w, allow, "Method not allowed (PATCH, UDID)")
+				return
+			}
+			if self.Auth != nil && !self.Auth.PutUdid(rezUdid, id, bundle) {
+				sendProblem(w, "Not authorized (PATCH, UDID)", http.StatusUnauthorized)
+				return
+			}
+			apply := self.patcher(r, &rezUdid.restShared, rezUdid.find, bundle)
+			var result interface{}
+			if tx, ok := rezUdid.patch.(RestPatchTxUdid); ok {
+				result, err = tx.PatchTx(id, apply, bundle)
+			} else {
+				result, err = rezUdid.find.Find(id, bundle)
+				if err == nil {
+					result, err = apply(result)
+				}
+				if err == nil {
+					result, err = rezUdid.patch.Patch(id, result, bundle)
+				}
+			}
+			if err == nil {
+				result, err = filterFindResult(&rezUdid.restShared, rezUdid.find, result, bundle)
+			}
+			if err != nil {
+				self.SendError(err, w, "Internal error on Patch (UDID)")
+			} else {
+				self.setETag(r, bundle, result)
+				self.IO.SendHook(&rezUdid.restShared, w, bundle, result, "")
+			}
+		}
+		return
 	}
-	log.Printf("should not be able to reach here, probably bad method? from bad client?")
-	http.Error(w, "bad client behavior", http.StatusBadRequest)
+	self.MethodNotAllowed(w, allow, fmt.Sprintf("Method not allowed (%s)", method))
 }
 
+//MethodNotAllowed sends the 405 response to the client with the Allow header
+//set to the methods that the resource does support.
+func (self *RawDispatcher) MethodNotAllowed(w http.ResponseWriter, allow []string, msg string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	sendProblem(w, msg, http.StatusMethodNotAllowed)
+}
+
+//allowedMethods computes the HTTP methods that a resource supports based on the
+//interfaces provided when it was registered. If isItem is true, the methods
+//returned are those for a particular instance (url with an id) otherwise
+//they are the methods for the collection.  Exactly one of rez or rezUdid
+//should be non-nil.
+func allowedMethods(rez *restObj, rezUdid *restObjUdid, isItem bool) []string {
+	var get, post, put, patch, del bool
+	if rez != nil {
+		get = (isItem && rez.find != nil) || (!isItem && rez.index != nil)
+		post = !isItem && rez.post != nil
+		put = isItem && rez.put != nil
+		patch = isItem && rez.canPatch()
+		del = isItem && rez.del != nil
+	} else {
+		get = (isItem && rezUdid.find != nil) || (!isItem && rezUdid.index != nil)
+		post = !isItem && rezUdid.post != nil
+		put = isItem && rezUdid.put != nil
+		patch = isItem && rezUdid.canPatch()
+		del = isItem && rezUdid.del != nil
+	}
+	result := []string{}
+	if get {
+		result = append(result, "GET", "HEAD")
+	}
+	if post {
+		result = append(result, "POST")
+	}
+	if put {
+		result = append(result, "PUT")
+	}
+	if patch {
+		result = append(result, "PATCH")
+	}
+	if del {
+		result = append(result, "DELETE")
+	}
+	return append(result, "OPTIONS")
+}
+
+//headResponseWriter is used to run HEAD requests through the GET machinery.  It
+//passes along headers and status codes but discards the body.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (self *headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+//sendBodyError reports a failure from the BodyHook.  Errors that carry their
+//own status code (such as 415 for a content type we can't decode) are sent
+//as is, anything else is the client's fault.
+func (self *RawDispatcher) sendBodyError(err error, w http.ResponseWriter) {
+	if ours, ok := err.(*Error); ok {
+		WriteError(w, ours)
+		return
+	}
+	sendProblem(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
+}
+
+//SendError sends an error returned by a resource to the client as a problem details
+//object.  Errors of type *Error are sent as is, anything else is an internal error
+//and msg is used to describe what the dispatcher was doing.
 func (self *RawDispatcher) SendError(err error, w http.ResponseWriter, msg string) {
 	ours, ok := err.(*Error)
 	if !ok {
-		http.Error(w, fmt.Sprintf("%s: %s", msg, err), http.StatusInternalServerError)
+		sendProblem(w, fmt.Sprintf("%s: %s", msg, err), http.StatusInternalServerError)
 	} else {
-		http.Error(w, ours.Msg, ours.StatusCode)
+		WriteError(w, ours)
 	}
 }
 
@@ -665,6 +1007,9 @@ func (self *RawDispatcher) resolve(parts []string, node *RestNode) (string, stri
 	if okUdid && len(parts) == 1 {
 		return parts[0], "", nil, rezUdid
 	}
+	if len(parts) == 1 {
+		return "", "", nil, nil
+	}
 	id := parts[1]
 	uriPathParent := parts[0]
 
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -42,6 +43,10 @@ func (self *someResource) Put(id int64, i interface{}, p PBundle) (interface{},
 	s := i.(*someWire)
 	return &someWire{id, s.Foo + "?"}, nil
 }
+func (self *someResource) Patch(id int64, i interface{}, p PBundle) (interface{}, error) {
+	s := i.(*someWire)
+	return &someWire{id, s.Foo + "!"}, nil
+}
 
 func (self *someSubResource) Put(id int64, i interface{}, p PBundle) (interface{}, error) {
 	panic("NYI")
@@ -201,6 +206,145 @@ func (self *badlyWrittenResource) Find(id int64, p PBundle) (interface{}, error)
 	return &s, nil
 }
 
+func TestPatch(t *testing.T) {
+	resource := &someResource{}
+	mux := setupMux(resource, nil)
+	go func() {
+		http.ListenAndServe(":8193", mux)
+	}()
+	client := new(http.Client)
+
+	body := "{\"Foo\":\"merged\"}"
+	w := makeRequestAndCheckStatus(t, client, "PATCH", "http://localhost:8193/rest/somewire/41", body,
+		http.StatusOK, false)
+	checkBody(t, w, 41, "merged!")
+
+	req := makeReq(t, "PATCH", "http://localhost:8193/rest/somewire/42",
+		"[{\"op\":\"test\",\"path\":\"/Foo\",\"value\":\"find\"},{\"op\":\"replace\",\"path\":\"/Foo\",\"value\":\"json\"}]")
+	req.Header.Set("Content-Type", JSON_PATCH_CONTENT_TYPE)
+	resp, err := client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	checkBody(t, readBody(t, resp.Body, false), 42, "json!")
+
+	req = makeReq(t, "PATCH", "http://localhost:8193/rest/somewire/43",
+		"[{\"op\":\"test\",\"path\":\"/Foo\",\"value\":\"nope\"}]")
+	req.Header.Set("Content-Type", JSON_PATCH_CONTENT_TYPE)
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusConflict)
+
+	req = makeReq(t, "PATCH", "http://localhost:8193/rest/somewire/44", "<Foo/>")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusUnsupportedMediaType)
+}
+
+//txPatcher finds and stores its value in PatchTx.
+type txPatcher struct {
+	stored *someWire
+}
+
+func (self *txPatcher) Patch(id int64, i interface{}, p PBundle) (interface{}, error) {
+	panic("Patch should not be called when there is PatchTx")
+}
+
+func (self *txPatcher) PatchTx(id int64, apply PatchFunc, p PBundle) (interface{}, error) {
+	patched, err := apply(&someWire{id, "tx"})
+	if err != nil {
+		return nil, err
+	}
+	self.stored = patched.(*someWire)
+	return self.stored, nil
+}
+
+func TestSeparatePatch(t *testing.T) {
+	_, _, raw := setupTestDispatcher("patchtest")
+	tx := &txPatcher{}
+	raw.ResourceSeparate("somewire", &someWire{}, nil, nil, nil, nil, nil)
+	raw.SetPatch("SomeWire", tx)
+	raw.ResourceSeparate("other", &someWire{}, nil, &someResource{}, nil, nil, nil)
+	raw.SetPatch("other", &someResource{})
+	send := func(url string, body string, ifMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PATCH", url, strings.NewReader(body))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		raw.Dispatch(nil, w, r)
+		return w
+	}
+
+	//the current value comes from PatchTx, no Find is needed
+	if w := send("/rest/somewire/3", `{"Foo":"patched"}`, ""); w.Code != http.StatusOK || tx.stored == nil || tx.stored.Foo != "patched" {
+		t.Errorf("patch not applied by PatchTx: %d %s", w.Code, w.Body.String())
+	}
+	etag, _ := ComputeETag(&someWire{3, "tx"}, "")
+	if w := send("/rest/somewire/3", `{"Foo":"again"}`, etag); w.Code != http.StatusOK {
+		t.Errorf("expected If-Match to be checked against the value in PatchTx: %d", w.Code)
+	}
+	if w := send("/rest/somewire/3", `{"Foo":"again"}`, `"nope"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for the wrong etag, got %d", w.Code)
+	}
+
+	//a patch implementation that is not the put implementation
+	w := send("/rest/other/4", `{"Foo":"merged"}`, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "merged!") {
+		t.Errorf("separate patch not used: %d %s", w.Code, w.Body.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic for a patch of the wrong kind")
+		}
+	}()
+	raw.SetPatch("other", &someWire{})
+}
+
+func TestOptionsAndHead(t *testing.T) {
+	resource := &someResource{}
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.Rez(&someWire{}, resource)
+	raw.ResourceSeparate("ReadOnly", &someWire{}, resource, resource, nil, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8194", mux)
+	}()
+	client := new(http.Client)
+
+	for url, expected := range map[string]string{
+		"http://localhost:8194/rest/somewire":     "GET, HEAD, POST, OPTIONS",
+		"http://localhost:8194/rest/somewire/12":  "GET, HEAD, PUT, PATCH, DELETE, OPTIONS",
+		"http://localhost:8194/rest/readonly":     "GET, HEAD, OPTIONS",
+		"http://localhost:8194/rest/readonly/12/": "GET, HEAD, OPTIONS",
+	} {
+		req := makeReq(t, "OPTIONS", url, "")
+		resp, err := client.Do(req)
+		checkHttpStatus(t, resp, err, http.StatusOK)
+		if allow := resp.Header.Get("Allow"); allow != expected {
+			t.Errorf("wrong Allow header for %s, expected '%s' but got '%s'", url, expected, allow)
+		}
+	}
+
+	req := makeReq(t, "HEAD", "http://localhost:8194/rest/somewire/12", "")
+	resp, err := client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusOK)
+	all, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body: %s", err)
+	}
+	if len(all) != 0 {
+		t.Errorf("expected no body from HEAD but got '%s'", string(all))
+	}
+
+	req = makeReq(t, "DELETE", "http://localhost:8194/rest/readonly/12", "")
+	resp, err = client.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
+	if allow := resp.Header.Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Errorf("wrong Allow header on 405, got '%s'", allow)
+	}
+}
+
 func TestBadResource(t *testing.T) {
 
 	bad := &badlyWrittenResource{}
@@ -233,11 +377,17 @@ func TestBadJson(t *testing.T) {
 	resp, err := http.Post("http://localhost:8187/rest/somewire", "text/json", strings.NewReader(body))
 	checkHttpStatus(t, resp, err, http.StatusBadRequest)
 
+	//anything after the value is refused, as json.Unmarshal does
+	for _, body := range []string{`{"Id":1,"Foo":"a"}garbage`, `{"Id":1,"Foo":"a"}{"Foo":"b"}`} {
+		resp, err = http.Post("http://localhost:8187/rest/somewire", "text/json", strings.NewReader(body))
+		checkHttpStatus(t, resp, err, http.StatusBadRequest)
+	}
+
 	//if you try to send a really big bundle, the go level code disconnects you, so we send a bunch bunch
 	//of nothing to see what happens
 	x := make([]byte, 100000)
 	resp, err = http.Post("http://localhost:8187/rest/somewire", "text/json", strings.NewReader(string(x)))
-	checkHttpStatus(t, resp, err, http.StatusBadRequest)
+	checkHttpStatus(t, resp, err, http.StatusRequestEntityTooLarge)
 
 	all, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -249,6 +399,28 @@ func TestBadJson(t *testing.T) {
 	}
 }
 
+func TestBodyLimit(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	raw.Rez(&someWire{}, &someResource{})
+	raw.SetBodyLimit("SomeWire", 64)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8198", mux)
+	}()
+
+	body := "{ \"Id\":-1, \"Foo\":\"short\"}\n"
+	resp, err := http.Post("http://localhost:8198/rest/somewire", "text/json", strings.NewReader(body))
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+
+	//no content length, so this has to be caught while decoding
+	body = "{ \"Id\":-1, \"Foo\":\"" + strings.Repeat("x", 100) + "\"}"
+	chunked := ioutil.NopCloser(strings.NewReader(body))
+	resp, err = http.Post("http://localhost:8198/rest/somewire", "text/json", chunked)
+	checkHttpStatus(t, resp, err, http.StatusRequestEntityTooLarge)
+}
+
 func TestResourceNotImplementedMethods(t *testing.T) {
 
 	mux := setupMux(nil, nil)
@@ -257,31 +429,34 @@ func TestResourceNotImplementedMethods(t *testing.T) {
 	}()
 
 	resp, err := http.Get("http://localhost:8188/rest/somewire")
-	checkHttpStatus(t, resp, err, http.StatusNotImplemented)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
+	if allow := resp.Header.Get("Allow"); allow != "OPTIONS" {
+		t.Errorf("expected only OPTIONS to be allowed but got '%s'", allow)
+	}
 
 	body := "{}"
 	resp, err = http.Post("http://localhost:8188/rest/somewire", "text/json", strings.NewReader(body))
-	checkHttpStatus(t, resp, err, http.StatusNotImplemented)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
 
 	data := url.Values(map[string][]string{"nothing": []string{"bogus"}})
 	resp, err = http.PostForm("http://localhost:8188/rest/somewire", data)
-	checkHttpStatus(t, resp, err, http.StatusNotImplemented)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
 
 	resp, err = http.Post("http://localhost:8188/rest/somewire/2", "text/json", strings.NewReader(body))
 	checkHttpStatus(t, resp, err, http.StatusBadRequest)
 
 	resp, err = http.Get("http://localhost:8188/rest/somewire/3")
-	checkHttpStatus(t, resp, err, http.StatusNotImplemented)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
 
 	client := new(http.Client)
 
 	req := makeReq(t, "PUT", "http://localhost:8188/rest/somewire/4", "{}")
 	resp, err = client.Do(req)
-	checkHttpStatus(t, resp, err, http.StatusNotImplemented)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
 
 	req = makeReq(t, "DELETE", "http://localhost:8188/rest/somewire/5", "")
 	resp, err = client.Do(req)
-	checkHttpStatus(t, resp, err, http.StatusNotImplemented)
+	checkHttpStatus(t, resp, err, http.StatusMethodNotAllowed)
 
 }
 
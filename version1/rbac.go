@@ -0,0 +1,273 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	//ANONYMOUS_ROLE is the role of requests without a session.
+	ANONYMOUS_ROLE = "anonymous"
+	//AUTHENTICATED_ROLE is a role of every request with a session, in addition
+	//to the roles from the user data.
+	AUTHENTICATED_ROLE = "authenticated"
+	//PERMISSION_ANY is used in a Permission to mean any resource or any method.
+	PERMISSION_ANY = "*"
+)
+
+//RoleHolder should be implemented by the user data of sessions to give the
+//roles of the user to a RolePolicy.
+type RoleHolder interface {
+	Roles() []string
+}
+
+//OwnerPredicate returns true if the user of the bundle owns the object of the
+//resource with the id (for resources with int64 ids) or udid (for resources
+//with UDIDs).  The resource is named as in Permission, in lower case.
+type OwnerPredicate func(resource string, id int64, udid string, bundle PBundle) bool
+
+//Permission allows a role to use some methods of a resource.  Resource is the
+//name given when the resource was added to the dispatcher (case does not
+//matter) or PERMISSION_ANY.  Methods are GET, POST, PUT, and DELETE, or
+//PERMISSION_ANY; GET covers both Index and Find, PATCH is allowed by PUT, and
+//HEAD by GET.  Sub-resources are named by their path, like "parent/child"
+//(see SetCORSPolicy), so each parent has its own permissions.  If Owner is
+//not "", it is the name of an OwnerPredicate and the permission only applies
+//to requests with an id for which the predicate returns true, so it never
+//allows Index or POST.
+type Permission struct {
+	Resource string   `json:"resource"`
+	Methods  []string `json:"methods"`
+	Owner    string   `json:"owner,omitempty"`
+}
+
+//RolePolicy is an Authorizer that is configured with data rather than code.
+//Each role has a list of permissions, and a request is allowed if any role of
+//the user has a permission for it; everything else is refused.  The roles of
+//a request with a session are AUTHENTICATED_ROLE and, if the user data is a
+//RoleHolder, its roles.  Requests without a session have ANONYMOUS_ROLE.
+//
+//Policies are usually read from a json file with LoadRolePolicy:
+//
+//	{"roles": {
+//		"admin": [{"resource": "*", "methods": ["*"]}],
+//		"authenticated": [
+//			{"resource": "article", "methods": ["GET", "POST"]},
+//			{"resource": "article", "methods": ["PUT", "DELETE"], "owner": "author"}
+//		],
+//		"anonymous": [{"resource": "article", "methods": ["GET"]}]
+//	}}
+//
+//The OwnerPredicates named in the policy are added with Owner.  If Next is not
+//nil, requests the policy allows must also be allowed by Next; Install sets it
+//to the dispatcher's previous Authorizer, so the Allow* interfaces of the
+//resources are still used with a BaseDispatcher.
+type RolePolicy struct {
+	Roles  map[string][]*Permission `json:"roles"`
+	Next   Authorizer               `json:"-"`
+	owners map[string]OwnerPredicate
+}
+
+//NewRolePolicy returns a policy with no roles, which allows nothing.
+func NewRolePolicy() *RolePolicy {
+	return &RolePolicy{Roles: make(map[string][]*Permission)}
+}
+
+//ParseRolePolicy reads a policy from json.
+func ParseRolePolicy(data []byte) (*RolePolicy, error) {
+	result := NewRolePolicy()
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//LoadRolePolicy reads a policy from a json file.
+func LoadRolePolicy(path string) (*RolePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ParseRolePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read role policy from %s: %v", path, err)
+	}
+	return result, nil
+}
+
+//Allow adds a permission to the role.
+func (self *RolePolicy) Allow(role string, resource string, owner string, methods ...string) {
+	self.Roles[role] = append(self.Roles[role], &Permission{Resource: resource, Methods: methods, Owner: owner})
+}
+
+//Owner adds the predicate with the name used by permissions.
+func (self *RolePolicy) Owner(name string, pred OwnerPredicate) {
+	if self.owners == nil {
+		self.owners = make(map[string]OwnerPredicate)
+	}
+	self.owners[name] = pred
+}
+
+//supportedMethods returns the methods that the resources implement, by path,
+//in all the nodes of the tree.
+func supportedMethods(node *RestNode, result map[string]map[string]bool) {
+	add := func(shared *restShared, find bool, put bool, del bool) {
+		if result[shared.path] == nil {
+			result[shared.path] = make(map[string]bool)
+		}
+		m := result[shared.path]
+		m["GET"] = m["GET"] || shared.index != nil || find
+		m["POST"] = m["POST"] || shared.post != nil
+		m["PUT"] = m["PUT"] || put
+		m["DELETE"] = m["DELETE"] || del
+	}
+	for _, r := range node.Res {
+		add(&r.restShared, r.find != nil, r.put != nil || r.patch != nil, r.del != nil)
+	}
+	for _, r := range node.ResUdid {
+		add(&r.restShared, r.find != nil, r.put != nil || r.patch != nil, r.del != nil)
+	}
+	for _, child := range node.Children {
+		supportedMethods(child, result)
+	}
+	for _, child := range node.ChildrenUdid {
+		supportedMethods(child, result)
+	}
+}
+
+//Check compares the policy to the resources of the tree and returns a
+//*ValidationError with every problem: resources that are not in the tree,
+//methods the resources do not implement, and owner predicates that have not
+//been added.  Call this at startup, after all the resources have been added.
+func (self *RolePolicy) Check(root *RestNode) error {
+	supported := make(map[string]map[string]bool)
+	supportedMethods(root, supported)
+	result := &ValidationError{}
+	roles := make([]string, 0, len(self.Roles))
+	for role := range self.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		for i, p := range self.Roles[role] {
+			field := fmt.Sprintf("%s[%d]", role, i)
+			resource := strings.ToLower(p.Resource)
+			methods, known := supported[resource]
+			if resource != PERMISSION_ANY && !known {
+				result.Add(field, fmt.Sprintf("no such resource %s", p.Resource))
+			}
+			if len(p.Methods) == 0 {
+				result.Add(field, "no methods")
+			}
+			for _, m := range p.Methods {
+				m = strings.ToUpper(m)
+				switch {
+				case m == "PATCH":
+					result.Add(field, "PATCH is allowed by PUT")
+				case m != PERMISSION_ANY && m != "GET" && m != "POST" && m != "PUT" && m != "DELETE":
+					result.Add(field, fmt.Sprintf("unknown method %s", m))
+				case m == "POST" && p.Owner != "":
+					result.Add(field, "POST has no id for the owner to check")
+				case known && m != PERMISSION_ANY && !methods[m]:
+					result.Add(field, fmt.Sprintf("%s does not implement %s", p.Resource, m))
+				}
+			}
+			if _, ok := self.owners[p.Owner]; p.Owner != "" && !ok {
+				result.Add(field, fmt.Sprintf("no owner predicate %s", p.Owner))
+			}
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+	return nil
+}
+
+//Install checks the policy against the dispatcher's resources and, if there
+//are no problems, makes it the dispatcher's Authorizer.
+func (self *RolePolicy) Install(raw *RawDispatcher) error {
+	if err := self.Check(raw.Root); err != nil {
+		return err
+	}
+	if raw.Auth != self {
+		self.Next = raw.Auth
+	}
+	raw.Auth = self
+	return nil
+}
+
+//roles returns the roles of the request.
+func (self *RolePolicy) roles(bundle PBundle) []string {
+	if bundle == nil || bundle.Session() == nil {
+		return []string{ANONYMOUS_ROLE}
+	}
+	result := []string{AUTHENTICATED_ROLE}
+	if holder, ok := bundle.Session().UserData().(RoleHolder); ok {
+		result = append(result, holder.Roles()...)
+	}
+	return result
+}
+
+//allowed returns true if a role of the request has a permission for the method
+//on the resource with the path.  hasId is false for Index and Post.
+func (self *RolePolicy) allowed(name string, method string, hasId bool, id int64, udid string, bundle PBundle) bool {
+	for _, role := range self.roles(bundle) {
+		for _, p := range self.Roles[role] {
+			if p.Resource != PERMISSION_ANY && strings.ToLower(p.Resource) != name {
+				continue
+			}
+			matched := false
+			for _, m := range p.Methods {
+				if m == PERMISSION_ANY || strings.ToUpper(m) == method {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			if p.Owner == "" {
+				return true
+			}
+			if pred, ok := self.owners[p.Owner]; ok && hasId && pred(name, id, udid, bundle) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (self *RolePolicy) Index(d *restShared, bundle PBundle) bool {
+	return self.allowed(d.path, "GET", false, 0, "", bundle) && (self.Next == nil || self.Next.Index(d, bundle))
+}
+
+func (self *RolePolicy) Post(d *restShared, bundle PBundle) bool {
+	return self.allowed(d.path, "POST", false, 0, "", bundle) && (self.Next == nil || self.Next.Post(d, bundle))
+}
+
+func (self *RolePolicy) Find(d *restObj, num int64, bundle PBundle) bool {
+	return self.allowed(d.path, "GET", true, num, "", bundle) && (self.Next == nil || self.Next.Find(d, num, bundle))
+}
+
+func (self *RolePolicy) FindUdid(d *restObjUdid, id string, bundle PBundle) bool {
+	return self.allowed(d.path, "GET", true, 0, id, bundle) && (self.Next == nil || self.Next.FindUdid(d, id, bundle))
+}
+
+func (self *RolePolicy) Put(d *restObj, num int64, bundle PBundle) bool {
+	return self.allowed(d.path, "PUT", true, num, "", bundle) && (self.Next == nil || self.Next.Put(d, num, bundle))
+}
+
+func (self *RolePolicy) PutUdid(d *restObjUdid, id string, bundle PBundle) bool {
+	return self.allowed(d.path, "PUT", true, 0, id, bundle) && (self.Next == nil || self.Next.PutUdid(d, id, bundle))
+}
+
+func (self *RolePolicy) Delete(d *restObj, num int64, bundle PBundle) bool {
+	return self.allowed(d.path, "DELETE", true, num, "", bundle) && (self.Next == nil || self.Next.Delete(d, num, bundle))
+}
+
+func (self *RolePolicy) DeleteUdid(d *restObjUdid, id string, bundle PBundle) bool {
+	return self.allowed(d.path, "DELETE", true, 0, id, bundle) && (self.Next == nil || self.Next.DeleteUdid(d, id, bundle))
+}
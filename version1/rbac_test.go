@@ -0,0 +1,130 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rbacUser struct {
+	name  string
+	roles []string
+}
+
+func (self *rbacUser) Roles() []string {
+	return self.roles
+}
+
+const testRolePolicy = `{"roles": {
+	"admin": [{"resource": "*", "methods": ["*"]}],
+	"authenticated": [
+		{"resource": "SomeWire", "methods": ["GET", "POST"]},
+		{"resource": "somewire", "methods": ["PUT", "DELETE"], "owner": "mine"}
+	],
+	"anonymous": [{"resource": "readonly", "methods": ["GET"]}]
+}}`
+
+func TestRolePolicy(t *testing.T) {
+	cm, sm, raw := setupTestDispatcher("rbactest")
+	raw.Rez(&someWire{}, &someResource{})
+	raw.ResourceSeparate("readonly", &someWire{}, nil, &someResource{}, nil, nil, nil)
+
+	policy, err := ParseRolePolicy([]byte(testRolePolicy))
+	if err != nil {
+		t.Fatalf("unable to parse policy: %v", err)
+	}
+	if err := policy.Install(raw); err == nil || !strings.Contains(err.Error(), "no owner predicate mine") {
+		t.Fatalf("expected missing owner predicate, got %v", err)
+	}
+	//users own the objects with even ids
+	policy.Owner("mine", func(resource string, id int64, udid string, pb PBundle) bool {
+		return resource == "somewire" && id%2 == 0
+	})
+	if err := policy.Install(raw); err != nil {
+		t.Fatalf("unable to install policy: %v", err)
+	}
+
+	fred, _ := sm.Assign("fred", &rbacUser{name: "fred"}, time.Time{})
+	admin, _ := sm.Assign("admin", &rbacUser{name: "admin", roles: []string{"admin"}}, time.Time{})
+	check := func(session Session, method string, url string, expected int) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(`{"Id":0,"Foo":"bar"}`))
+		if session != nil {
+			r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: session.SessionId()})
+		}
+		raw.Dispatch(nil, w, r)
+		if w.Code != expected {
+			t.Errorf("%s %s: expected %d, got %d", method, url, expected, w.Code)
+		}
+	}
+	check(nil, "GET", "/rest/readonly/1", http.StatusOK)
+	check(nil, "GET", "/rest/somewire/1", http.StatusUnauthorized)
+	check(fred, "GET", "/rest/somewire/1", http.StatusOK)
+	check(fred, "GET", "/rest/readonly/1", http.StatusUnauthorized)
+	check(fred, "POST", "/rest/somewire", http.StatusCreated)
+	check(fred, "PUT", "/rest/somewire/2", http.StatusOK)
+	check(fred, "PUT", "/rest/somewire/3", http.StatusUnauthorized)
+	check(fred, "PATCH", "/rest/somewire/3", http.StatusUnauthorized)
+	check(fred, "DELETE", "/rest/somewire/4", http.StatusOK)
+	check(admin, "DELETE", "/rest/somewire/3", http.StatusOK)
+	check(admin, "GET", "/rest/readonly/1", http.StatusOK)
+}
+
+func TestRolePolicyCheck(t *testing.T) {
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, "/rest")
+	raw.ResourceSeparate("readonly", &someWire{}, nil, &someResource{}, nil, nil, nil)
+	policy := NewRolePolicy()
+	policy.Allow("user", "readonly", "", "GET", "PUT")
+	policy.Allow("user", "missing", "", "GET")
+	policy.Allow("user", "readonly", "", "PATCH", "FETCH")
+	policy.Allow("user", "*", "owns", "POST")
+	err := policy.Check(raw.Root)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 6 {
+		t.Fatalf("expected six problems, got %v", err)
+	}
+	for _, msg := range []string{"readonly does not implement PUT", "no such resource missing", "PATCH is allowed by PUT",
+		"unknown method FETCH", "POST has no id", "no owner predicate owns"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("expected %q in %v", msg, err)
+		}
+	}
+}
+
+func TestRolePolicySubResources(t *testing.T) {
+	cm, sm, raw := setupTestDispatcher("rbacsubtest")
+	notes := &noteResource{}
+	raw.Rez(&someWire{}, &someResource{})
+	raw.SubResource(&someWire{}, "child", &someSubWire{}, nil, &someResource{}, nil, nil, nil)
+	raw.SubResource(&someWire{}, "note", &noteWire{}, notes, notes, nil, nil, nil)
+	raw.SubResource(&someSubWire{}, "note", &noteWire{}, notes, notes, nil, nil, nil)
+
+	//the same name under two parents is two resources
+	policy := NewRolePolicy()
+	policy.Allow(AUTHENTICATED_ROLE, "somewire", "", "GET")
+	policy.Allow(AUTHENTICATED_ROLE, "somewire/child", "", "GET")
+	policy.Allow(AUTHENTICATED_ROLE, "SomeWire/Child/Note", "", "GET")
+	policy.Allow(AUTHENTICATED_ROLE, "note", "", "GET")
+	if err := policy.Check(raw.Root); err == nil || !strings.Contains(err.Error(), "no such resource note") {
+		t.Fatalf("expected sub-resources to be named by their path, got %v", err)
+	}
+	policy.Roles[AUTHENTICATED_ROLE] = policy.Roles[AUTHENTICATED_ROLE][:3]
+	if err := policy.Install(raw); err != nil {
+		t.Fatalf("unable to install policy: %v", err)
+	}
+
+	admin, _ := sm.Assign("admin", "admin", time.Time{})
+	check := func(url string, expected int) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: admin.SessionId()})
+		raw.Dispatch(nil, w, r)
+		if w.Code != expected {
+			t.Errorf("%s: expected %d, got %d", url, expected, w.Code)
+		}
+	}
+	check("/rest/somewire/1/child/2/note", http.StatusOK)
+	check("/rest/somewire/1/note", http.StatusUnauthorized)
+}
@@ -0,0 +1,208 @@
+package seven5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	//DEFAULT_RESET_LIFETIME is how long a password reset token can be used.
+	DEFAULT_RESET_LIFETIME = time.Hour
+	//DEFAULT_RESET_SUBJECT is the template for the subject of reset emails.
+	DEFAULT_RESET_SUBJECT = "Reset your password"
+	//DEFAULT_RESET_BODY is the template for the body of reset emails.  The
+	//fields are those of ResetMailData.
+	DEFAULT_RESET_BODY = `Hello {{.Username}},
+
+Someone asked to reset the password for your account.  If that was you,
+follow this link to choose a new password:
+
+{{.Link}}
+
+The link can be used once and expires at {{.Expires.Format "15:04 MST on Jan 2, 2006"}}.
+If you did not ask to reset your password, you can ignore this message.
+`
+)
+
+//ResetTokenStore keeps the hashes of password reset tokens.  Save replaces any
+//tokens the user already has.  Consume returns true if the hash is a token of
+//the user that has not expired, and removes it so it cannot be used again; this
+//must be atomic.
+type ResetTokenStore interface {
+	SaveResetToken(userId string, hash string, expires time.Time) error
+	ConsumeResetToken(userId string, hash string) (bool, error)
+}
+
+type memoryResetToken struct {
+	userId  string
+	expires time.Time
+}
+
+//MemoryResetTokenStore keeps reset tokens in memory, so they are lost when the
+//server restarts.  It is useful for tests and servers with one process.
+type MemoryResetTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]*memoryResetToken
+}
+
+//NewMemoryResetTokenStore returns an empty store.
+func NewMemoryResetTokenStore() *MemoryResetTokenStore {
+	return &MemoryResetTokenStore{tokens: make(map[string]*memoryResetToken)}
+}
+
+func (self *MemoryResetTokenStore) SaveResetToken(userId string, hash string, expires time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	for h, t := range self.tokens {
+		if t.userId == userId || now.After(t.expires) {
+			delete(self.tokens, h)
+		}
+	}
+	self.tokens[hash] = &memoryResetToken{userId: userId, expires: expires}
+	return nil
+}
+
+func (self *MemoryResetTokenStore) ConsumeResetToken(userId string, hash string) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	t, ok := self.tokens[hash]
+	if !ok || t.userId != userId {
+		return false, nil
+	}
+	delete(self.tokens, hash)
+	return time.Now().Before(t.expires), nil
+}
+
+//ResetMailData is given to the templates of reset emails.
+type ResetMailData struct {
+	Username string
+	UserId   string
+	Token    string
+	Link     string
+	Expires  time.Time
+}
+
+//PasswordReset issues and consumes password reset tokens.  A token is random
+//and is only given to the user, by email; the store only has its hash, so
+//reading the store does not allow passwords to be reset.  Tokens can be used
+//once and expire after Lifetime.  Issuing a new token for a user makes the
+//previous ones useless.
+//
+//The email has a link to LinkURL with the query parameters "user" and "token"
+//added.  The page there should send them back, with the new password, as the
+//UserUdid and ResetRequestUdid of an AUTH_OP_PWD_RESET.  Subject and Body are
+//templates that are given a ResetMailData.
+type PasswordReset struct {
+	Store    ResetTokenStore
+	Mailer   Mailer
+	From     string
+	LinkURL  string
+	Lifetime time.Duration
+	Subject  *template.Template
+	Body     *template.Template
+}
+
+//NewPasswordReset returns a PasswordReset with the default lifetime and templates.
+func NewPasswordReset(store ResetTokenStore, mailer Mailer, from string, linkURL string) *PasswordReset {
+	return &PasswordReset{
+		Store:    store,
+		Mailer:   mailer,
+		From:     from,
+		LinkURL:  linkURL,
+		Lifetime: DEFAULT_RESET_LIFETIME,
+		Subject:  template.Must(template.New("subject").Parse(DEFAULT_RESET_SUBJECT)),
+		Body:     template.Must(template.New("body").Parse(DEFAULT_RESET_BODY)),
+	}
+}
+
+//hashResetToken is what the store keeps instead of the token.
+func hashResetToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+//Issue creates a token for the user and mails a link with it to the address.
+//The token is returned for applications that deliver it some other way; it
+//should not be logged.
+func (self *PasswordReset) Issue(userId string, username string, address string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	expires := time.Now().Add(self.Lifetime)
+	if err := self.Store.SaveResetToken(userId, hashResetToken(token), expires); err != nil {
+		return "", err
+	}
+	if self.Mailer == nil {
+		return token, nil
+	}
+	msg, err := self.Message(&ResetMailData{
+		Username: username,
+		UserId:   userId,
+		Token:    token,
+		Link:     self.link(userId, token),
+		Expires:  expires,
+	}, address)
+	if err != nil {
+		return "", err
+	}
+	if err := self.Mailer.Send(msg); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//link returns LinkURL with the user id and token added.
+func (self *PasswordReset) link(userId string, token string) string {
+	u, err := url.Parse(self.LinkURL)
+	if err != nil {
+		return self.LinkURL
+	}
+	q := u.Query()
+	q.Set("user", userId)
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+//Message fills in the templates to make the email sent to the address.
+func (self *PasswordReset) Message(data *ResetMailData, address string) (*MailMessage, error) {
+	var subject, body bytes.Buffer
+	if err := self.Subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := self.Body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return &MailMessage{
+		From:    self.From,
+		To:      []string{address},
+		Subject: subject.String(),
+		Body:    body.String(),
+	}, nil
+}
+
+//Consume returns true if the token is valid for the user.  The token cannot be
+//used again, even if the caller fails to change the password.
+func (self *PasswordReset) Consume(userId string, token string) (bool, error) {
+	if userId == "" || token == "" {
+		return false, nil
+	}
+	return self.Store.ConsumeResetToken(userId, hashResetToken(token))
+}
+
+//MailAddresser can be implemented by user data to give the address to which
+//reset emails are sent, when the username is not an email address.
+type MailAddresser interface {
+	MailAddress() string
+}
@@ -0,0 +1,71 @@
+package seven5
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	var out bytes.Buffer
+	mailer := NewWriterMailer(&out)
+	reset := NewPasswordReset(NewMemoryResetTokenStore(), mailer, "noreply@example.com", "https://example.com/reset?lang=en")
+
+	token, err := reset.Issue("17", "fred", "fred@example.com")
+	if err != nil {
+		t.Fatalf("unable to issue token: %v", err)
+	}
+	msg := mailer.Last()
+	if msg == nil || msg.To[0] != "fred@example.com" || msg.Subject != DEFAULT_RESET_SUBJECT {
+		t.Fatalf("bad reset message: %+v", msg)
+	}
+	if !strings.Contains(msg.Body, "Hello fred") || !strings.Contains(out.String(), "From: noreply@example.com") {
+		t.Errorf("bad reset email: %s", out.String())
+	}
+	var link string
+	for _, line := range strings.Split(msg.Body, "\n") {
+		if strings.HasPrefix(line, "https://") {
+			link = line
+		}
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Query().Get("token") != token || u.Query().Get("user") != "17" || u.Query().Get("lang") != "en" {
+		t.Fatalf("bad link in reset email: %s", link)
+	}
+
+	//tokens are for one user, and used once
+	if ok, _ := reset.Consume("18", token); ok {
+		t.Errorf("token accepted for another user")
+	}
+	if ok, _ := reset.Consume("17", token+"x"); ok {
+		t.Errorf("wrong token accepted")
+	}
+	if ok, err := reset.Consume("17", token); !ok || err != nil {
+		t.Errorf("token refused: %v", err)
+	}
+	if ok, _ := reset.Consume("17", token); ok {
+		t.Errorf("token accepted twice")
+	}
+
+	//a new token replaces the old one
+	first, _ := reset.Issue("17", "fred", "fred@example.com")
+	second, _ := reset.Issue("17", "fred", "fred@example.com")
+	if ok, _ := reset.Consume("17", first); ok {
+		t.Errorf("replaced token accepted")
+	}
+	if ok, _ := reset.Consume("17", second); !ok {
+		t.Errorf("new token refused")
+	}
+
+	//expired tokens are refused
+	reset.Lifetime = -time.Second
+	expired, _ := reset.Issue("17", "fred", "fred@example.com")
+	if ok, _ := reset.Consume("17", expired); ok {
+		t.Errorf("expired token accepted")
+	}
+	if len(mailer.Sent) != 4 {
+		t.Errorf("expected 4 emails, got %d", len(mailer.Sent))
+	}
+}
@@ -29,6 +29,41 @@ type RestPutUdid interface {
 	Put(string, interface{}, PBundle) (interface{}, error)
 }
 
+//RestPatch is an optional interface for resources that accept partial updates.
+//The dispatcher applies the patch document sent by the client (either a JSON
+//merge patch or a JSON Patch) to the result of Find on the same id, and the
+//value passed in here is the resulting, fully-formed wire object.  The put
+//implementation is used for PATCH if it has this interface; a separate one can
+//be given with SetPatch.
+type RestPatch interface {
+	Patch(int64, interface{}, PBundle) (interface{}, error)
+}
+
+//RestPatchUdid is the UDID version of RestPatch.
+type RestPatchUdid interface {
+	Patch(string, interface{}, PBundle) (interface{}, error)
+}
+
+//PatchFunc turns the current value of a resource, as Find would return it,
+//into the patched value that should be stored.  It reads the body of the
+//request, so it can only be called once.
+type PatchFunc func(current interface{}) (interface{}, error)
+
+//RestPatchTx is an optional interface for a RestPatch that can read the current
+//value and store the patched one without another write coming between them.
+//If the patch implementation has it, the dispatcher calls PatchTx instead of
+//Find and Patch; PatchTx must call apply with the current value and store
+//the value apply returns.  The resources wrapped for qbs that can Find have
+//it, and do both in one transaction.
+type RestPatchTx interface {
+	PatchTx(int64, PatchFunc, PBundle) (interface{}, error)
+}
+
+//RestPatchTxUdid is the UDID version of RestPatchTx.
+type RestPatchTxUdid interface {
+	PatchTx(string, PatchFunc, PBundle) (interface{}, error)
+}
+
 type RestPost interface {
 	Post(interface{}, PBundle) (interface{}, error)
 }
@@ -50,24 +85,54 @@ type RestAllUdid interface {
 }
 
 type restShared struct {
-	typ   reflect.Type
-	name  string
-	index RestIndex
-	post  RestPost
+	typ  reflect.Type
+	name string
+	//the name in lower case after those of the parents, like "parent/child"
+	path    string
+	index   RestIndex
+	post    RestPost
+	cors    CORSPolicy
+	maxBody int64
+	//limits on the number of elements an Index returns, see SetIndexLimits
+	defaultLimit int
+	maxLimit     int
+}
+
+//bodyLimit returns the largest body that can be sent to this resource.
+func (self *restShared) bodyLimit() int64 {
+	if self.maxBody > 0 {
+		return self.maxBody
+	}
+	return MAX_FORM_SIZE
 }
 
 type restObj struct {
 	restShared
-	find RestFind
-	del  RestDelete
-	put  RestPut
+	find  RestFind
+	del   RestDelete
+	put   RestPut
+	patch RestPatch
 }
 
 type restObjUdid struct {
 	restShared
-	find RestFindUdid
-	del  RestDeleteUdid
-	put  RestPutUdid
+	find  RestFindUdid
+	del   RestDeleteUdid
+	put   RestPutUdid
+	patch RestPatchUdid
+}
+
+//canPatch returns true if there is a patch implementation and the current
+//value can be found, by Find or by the patch implementation itself.
+func (self *restObj) canPatch() bool {
+	_, isTx := self.patch.(RestPatchTx)
+	return self.patch != nil && (self.find != nil || isTx)
+}
+
+//canPatch is the UDID version of restObj.canPatch.
+func (self *restObjUdid) canPatch() bool {
+	_, isTx := self.patch.(RestPatchTxUdid)
+	return self.patch != nil && (self.find != nil || isTx)
 }
 
 //
@@ -4,11 +4,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -53,10 +53,19 @@ type Session interface {
 	UserData() interface{}
 }
 
+//ExpiringSession is an optional interface for sessions that know when they
+//expire.  When sliding expiration is in use, this time moves forward each
+//time the session is found.
+type ExpiringSession interface {
+	Session
+	Expires() time.Time
+}
+
 //SimpleSession is a default implementation of Session suitable for most applications.
 type SimpleSession struct {
-	id string
-	ud interface{}
+	id      string
+	ud      interface{}
+	expires time.Time
 }
 
 //SessionId returns the sessionId. To make sessions stable across runs, the
@@ -82,7 +91,86 @@ func NewSimpleSession(userData interface{}, sid string) *SimpleSession {
 	if sid == "" {
 		s = UDID()
 	}
-	return &SimpleSession{s, userData}
+	return &SimpleSession{id: s, ud: userData}
+}
+
+//Expires returns the time at which the session expires, or the zero time if
+//that is not known.
+func (self *SimpleSession) Expires() time.Time {
+	return self.expires
+}
+
+//EvictionReason explains why a session was removed by a SimpleSessionManager.
+type EvictionReason int
+
+const (
+	EVICT_DESTROYED    EvictionReason = iota //Destroy was called, usually a logout
+	EVICT_EXPIRED                            //the expiration time of the session passed
+	EVICT_IDLE                               //the session was not used for longer than the IdleTimeout
+	EVICT_MAX_LIFETIME                       //the session has existed for longer than the MaxLifetime
+)
+
+func (self EvictionReason) String() string {
+	switch self {
+	case EVICT_DESTROYED:
+		return "destroyed"
+	case EVICT_EXPIRED:
+		return "expired"
+	case EVICT_IDLE:
+		return "idle"
+	case EVICT_MAX_LIFETIME:
+		return "max lifetime"
+	}
+	return fmt.Sprintf("EvictionReason(%d)", int(self))
+}
+
+//DEFAULT_REAP_INTERVAL is how often the SimpleSessionManager looks for expired
+//sessions if the SessionPolicy does not say.
+const DEFAULT_REAP_INTERVAL = 5 * time.Minute
+
+//SessionPolicy controls the expiration of sessions held by a SimpleSessionManager.
+//The zero value of each field means that limit is not used.
+//
+//With Sliding set, each time a session is found its expiration time is moved
+//forward to the current time plus the length of time it was originally given by
+//Assign.  MaxLifetime is an absolute limit on the age of a session, no matter
+//how active it is; it also limits the expiration time passed to Assign.
+//IdleTimeout expires sessions that have not been found in that length of time.
+//Expired sessions are removed every ReapInterval, or DEFAULT_REAP_INTERVAL if
+//that is zero.  OnEvict, if not nil, is called each time a session is removed,
+//including by Destroy, which lets applications audit logouts.  OnEvict is
+//called from the goroutine that manages sessions, so it must not call the
+//session manager.
+type SessionPolicy struct {
+	Sliding      bool
+	MaxLifetime  time.Duration
+	IdleTimeout  time.Duration
+	ReapInterval time.Duration
+	OnEvict      func(s Session, reason EvictionReason)
+}
+
+//sessionEntry is the information the session goroutine keeps about each session.
+type sessionEntry struct {
+	session  *SimpleSession
+	window   time.Duration //the original lifetime, for sliding renewal
+	absolute time.Time     //cannot be renewed past this, zero for no limit
+	maxed    bool          //absolute was set by the MaxLifetime
+	lastUsed time.Time
+	baked    time.Time //the expiration time sealed into the id
+}
+
+//expired returns the reason the entry should be evicted, if it should be.
+func (self *sessionEntry) expired(now time.Time, policy *SessionPolicy) (EvictionReason, bool) {
+	if now.After(self.session.expires) {
+		if self.maxed && !self.session.expires.Before(self.absolute) {
+			return EVICT_MAX_LIFETIME, true
+		}
+		return EVICT_EXPIRED, true
+	}
+	if policy.IdleTimeout > 0 && now.Sub(self.lastUsed) > policy.IdleTimeout {
+		return EVICT_IDLE, true
+	}
+	return 0, false
 }
 
 //SimpleSessionManager is an implementation of the SessionManager that knows about the semantics
@@ -90,6 +178,7 @@ func NewSimpleSession(userData interface{}, sid string) *SimpleSession {
 type SimpleSessionManager struct {
 	generator Generator
 	out       chan *sessionPacket
+	policy    *SessionPolicy
 }
 
 //NewSimpleSessionManager returns an instance of seven5.SessionManager.
@@ -97,35 +186,48 @@ type SimpleSessionManager struct {
 //insure that sessions are stable across runs by encrypting the session ids
 //with a key only the session manager knows. The key must be supplied in
 //the environment variable SERVER_SESSION_KEY or this function panics. That
-//key should be a 32 character hex string (see key2hex).  If you pass nil
+//key should be a 32 character hex string (see key2hex).  To rotate keys, use
+//SERVER_SESSION_KEYS instead (see EnvKeySource).  If you pass nil
 //as your generator, we are assuming that you will explicitly connect each
 //user session via a call to Assign.
 func NewSimpleSessionManager(g Generator) *SimpleSessionManager {
-	if os.Getenv("SERVER_SESSION_KEY") == "" {
-		log.Fatalf("unable to find environment variable SERVER_SESSION_KEY")
-	}
-	keyRaw := strings.TrimSpace(os.Getenv("SERVER_SESSION_KEY"))
-	if len(keyRaw) != aes.BlockSize*2 {
-		log.Fatalf("expected SERVER_SESSION_KEY length to be %d, but was %d", aes.BlockSize*2, len(keyRaw))
-	}
-	buf := make([]byte, aes.BlockSize)
-	l, err := hex.Decode(buf, []byte(keyRaw))
-	if err != nil {
-		log.Fatalf("Unable to decode SERVER_SESSION_KEY, maybe it's not in hex? %v", err)
-	}
-	if l != aes.BlockSize {
-		log.Fatalf("expected SERVER_SESSION_KEY decoded length to be %d, but was %d", aes.BlockSize, l)
-	}
-	key := buf[0:l]
+	return NewExpiringSessionManager(g, &SessionPolicy{})
+}
+
+//NewExpiringSessionManager is the same as NewSimpleSessionManager but allows
+//control over the expiration of sessions (see SessionPolicy).
+func NewExpiringSessionManager(g Generator, policy *SessionPolicy) *SimpleSessionManager {
+	return NewKeyringSessionManager(g, policy, serverKeyring())
+}
 
+//NewKeyringSessionManager is the same as NewExpiringSessionManager but the keys
+//for session ids are taken from the keyring provided rather than the environment.
+//Use this with a FileKeySource or your own KeySource to rotate keys without
+//logging everyone out.
+func NewKeyringSessionManager(g Generator, policy *SessionPolicy, ring *Keyring) *SimpleSessionManager {
+	if ring == nil || ring.Primary() == "" {
+		panic("session manager needs a keyring with at least one key")
+	}
 	result := &SimpleSessionManager{
 		out:       make(chan *sessionPacket),
 		generator: g,
+		policy:    policy,
 	}
-	go handleSessionChecks(result.out, key)
+	go handleSessionChecks(result.out, ring, policy)
+	go reapSessions(result.out, policy)
 	return result
 }
 
+//serverKeyring reads the keys for encrypting session ids from the environment
+//(see EnvKeySource). The process exits if the keys are missing or malformed.
+func serverKeyring() *Keyring {
+	ring, err := (&EnvKeySource{}).Keyring()
+	if err != nil {
+		log.Fatalf("unable to load session keys: %v", err)
+	}
+	return ring
+}
+
 //NewDumbSessionManager returns a session manager that makes no attempt
 //to conceal the client session id from the client, so this is probably only
 //useful for tests.
@@ -133,8 +235,10 @@ func NewDumbSessionManager() *SimpleSessionManager {
 	result := &SimpleSessionManager{
 		out:       make(chan *sessionPacket),
 		generator: nil,
+		policy:    &SessionPolicy{},
 	}
-	go handleSessionChecks(result.out, []byte{})
+	go handleSessionChecks(result.out, nil, result.policy)
+	go reapSessions(result.out, result.policy)
 	return result
 }
 
@@ -148,6 +252,7 @@ const (
 	_SESSION_OP_CREATE
 	_SESSION_OP_FIND
 	_SESSION_OP_UPDATE
+	_SESSION_OP_REAP
 )
 
 //sessionPacket is the type exchanged over the channel from the session manager to the go routine
@@ -166,88 +271,157 @@ type sessionPacket struct {
 //cookie that was originally passed to Assign(), although perhaps not on this run
 //of the program.  When Find() returns nil, then there was either no session data
 //to recover or the session expired, keys changed or some other event that means
-//you better re-check the user.
+//you better re-check the user.  Renewed is true if Find moved the expiration
+//time of the session forward, so the cookie must be sent again.
 type SessionReturn struct {
 	Session  Session
 	UniqueId string
+	Renewed  bool
 }
 
 //handleSessionChecks is the goroutine that reads session manager requests and responds based on its
 //map.  Each operation has a sessionPacket and that has on op to tell us how to
 //process each one.
-func handleSessionChecks(ch chan *sessionPacket, key []byte) {
-	hash := make(map[string]Session)
-
-	var err error
-	var block cipher.Block
-
-	if len(key) != 0 {
-		block, err = aes.NewCipher(key)
-		if err != nil {
-			log.Fatalf("unable to get AES cipher: %v", err)
+func handleSessionChecks(ch chan *sessionPacket, ring *Keyring, policy *SessionPolicy) {
+	hash := make(map[string]*sessionEntry)
+	var now time.Time
+	//ids of evicted sessions are kept until the expiration in the id, so
+	//they cannot be recreated from their unique id by a Generator
+	tombstones := make(map[string]time.Time)
+
+	evict := func(sid string, e *sessionEntry, reason EvictionReason) {
+		delete(hash, sid)
+		if e.baked.After(now) {
+			tombstones[sid] = e.baked
+		}
+		if policy.OnEvict != nil {
+			policy.OnEvict(e.session, reason)
 		}
 	}
 
 	var result *SessionReturn
 	for {
 		pkt := <-ch
-		packetsProcessed++
+		now = time.Now()
+		if pkt.op != _SESSION_OP_REAP {
+			packetsProcessed++
+		}
 
 		result = nil //safety
 		switch pkt.op {
 
 		case _SESSION_OP_DEL:
-			_, ok := hash[pkt.sessionId]
+			e, ok := hash[pkt.sessionId]
 			if ok {
-				delete(hash, pkt.sessionId)
+				evict(pkt.sessionId, e, EVICT_DESTROYED)
+			} else if ring != nil {
+				//from a previous run, but it must not be recreated either
+				if info, ok := ring.open(pkt.sessionId); ok && !info.legacy {
+					tombstones[pkt.sessionId] = info.expires
+				}
 			}
 			result = nil
+		case _SESSION_OP_REAP:
+			for sid, e := range hash {
+				if reason, expired := e.expired(now, policy); expired {
+					evict(sid, e, reason)
+				}
+			}
+			for sid, until := range tombstones {
+				if !until.After(now) {
+					delete(tombstones, sid)
+				}
+			}
 		case _SESSION_OP_CREATE:
+			e := &sessionEntry{
+				window:   pkt.expires.Sub(now),
+				absolute: pkt.expires,
+				lastUsed: now,
+			}
+			if policy.Sliding {
+				e.absolute = time.Time{} //no limit on renewals
+			}
+			if policy.MaxLifetime > 0 {
+				limit := now.Add(policy.MaxLifetime)
+				if e.absolute.IsZero() || limit.Before(e.absolute) {
+					e.absolute = limit
+					e.maxed = true
+				}
+			}
+			e.session = &SimpleSession{ud: pkt.userData, expires: pkt.expires}
+			if !e.absolute.IsZero() && e.absolute.Before(e.session.expires) {
+				e.session.expires = e.absolute
+			}
+			//the id is good until the absolute limit, if there is one, so a
+			//session can be recovered after a restart for as long as it
+			//could have been renewed
+			e.baked = e.session.expires
+			if !e.absolute.IsZero() {
+				e.baked = e.absolute
+			}
 			var sid string
-			if block == nil {
+			if ring == nil {
 				sid = pkt.uniqueInfo
+				//the same id can be assigned again
+				delete(tombstones, sid)
 			} else {
-				sessionId := computeRawSessionId(pkt.uniqueInfo, pkt.expires)
-				sid = encryptSessionId(sessionId, block)
+				sid = ring.encrypt(pkt.uniqueInfo, e.baked)
 			}
-			s := NewSimpleSession(pkt.userData, sid)
-			hash[sid] = s
-			result = &SessionReturn{Session: s}
+			e.session.id = sid
+			hash[sid] = e
+			result = &SessionReturn{Session: e.session}
 		case _SESSION_OP_UPDATE:
-			_, ok := hash[pkt.sessionId]
+			e, ok := hash[pkt.sessionId]
 			if !ok {
 				result = nil
 			} else {
 				s := NewSimpleSession(pkt.userData, pkt.sessionId)
+				s.expires = e.session.expires
+				e.session = s
 				result = &SessionReturn{Session: s}
 			}
 		case _SESSION_OP_FIND:
-			s, ok := hash[pkt.sessionId]
+			e, ok := hash[pkt.sessionId]
+			if _, dead := tombstones[pkt.sessionId]; !ok && dead {
+				//evicted on this run, so the user must log in again
+				result = nil
+				break
+			}
 			if !ok {
-				if block == nil {
+				if ring == nil {
 					//this is the dodgy bit
 					result = &SessionReturn{UniqueId: pkt.sessionId}
 					break
 				}
-				uniq, ok := decryptSessionId(pkt.sessionId, block)
+				uniq, ok := ring.decrypt(pkt.sessionId)
 				if !ok {
 					result = nil
 					break
 				}
 				result = &SessionReturn{UniqueId: uniq}
 			} else {
-				if block == nil {
-					result = &SessionReturn{Session: s}
+				//expired? our own records are authoritative, since sliding
+				//renewal can move the expiration past the one in the id
+				if reason, expired := e.expired(now, policy); expired {
+					evict(pkt.sessionId, e, reason)
+					result = nil
 					break
 				}
-				//expired?
-				_, ok := decryptSessionId(pkt.sessionId, block)
-				if !ok {
-					delete(hash, pkt.sessionId)
-					result = nil
-				} else {
-					result = &SessionReturn{Session: s}
+				e.lastUsed = now
+				result = &SessionReturn{}
+				if policy.Sliding {
+					renewed := now.Add(e.window)
+					if !e.absolute.IsZero() && renewed.After(e.absolute) {
+						renewed = e.absolute
+					}
+					if renewed.After(e.session.expires) {
+						s := NewSimpleSession(e.session.ud, e.session.id)
+						s.expires = renewed
+						e.session = s
+						result.Renewed = true
+					}
 				}
+				result.Session = e.session
 			}
 		}
 		pkt.ret <- result
@@ -255,6 +429,20 @@ func handleSessionChecks(ch chan *sessionPacket, key []byte) {
 	}
 }
 
+//reapSessions periodically asks the session goroutine to remove expired sessions.
+func reapSessions(ch chan *sessionPacket, policy *SessionPolicy) {
+	interval := policy.ReapInterval
+	if interval <= 0 {
+		interval = DEFAULT_REAP_INTERVAL
+	}
+	ret := make(chan *SessionReturn)
+	for {
+		time.Sleep(interval)
+		ch <- &sessionPacket{op: _SESSION_OP_REAP, ret: ret}
+		<-ret
+	}
+}
+
 //Assign is responsible for connecting the unique key for the user to a session.
 //The unique key should not contain colon or comma, email address or primary key from
 //the database are good choices. The userData will be initially assigned to the
@@ -331,6 +519,9 @@ func (self *SimpleSessionManager) Destroy(id string) error {
 //sessionid (created on a previous run).  If a uniqueId is returned, not
 //a session, it would be wise to create a session immediately since we have
 //confirmed that at some point in the past that sesison existed for this user.
+//Ids of sessions that were destroyed or evicted by the SessionPolicy on this
+//run are remembered until the expiration time in the id, and Find returns nil
+//for them, so a Generator cannot bring back a session that was logged out.
 func (self *SimpleSessionManager) Find(id string) (*SessionReturn, error) {
 
 	if id == "" {
@@ -357,8 +548,68 @@ func computeRawSessionId(uniqueId string, t time.Time) string {
 	return fmt.Sprintf("%s:%s,%d", s5CookiePrefix, uniqueId, t.Unix())
 }
 
+//sealSessionId returns a hex-encoded session id that is sealed with the
+//AEAD provided.  The ciphertext holds the expiration time and the unique id and
+//is preceded by a random nonce.  The additional data binds the id to the key
+//id, so that an id cannot be moved to another key or be changed without
+//detection.
+func sealSessionId(uniqueId string, expires time.Time, keyId string, aead cipher.AEAD) string {
+	return hex.EncodeToString(sealExpiring([]byte(uniqueId), expires, sessionIdData(keyId), aead))
+}
+
+//openSessionId checks and decrypts a session id created by sealSessionId.  It
+//returns the unique id, the expiration time and true, or false if the session
+//id has been tampered with, was sealed with another key, or has expired.  The
+//check of the authentication tag is done in constant time by the AEAD.
+func openSessionId(encryptedHex string, keyId string, aead cipher.AEAD) (string, time.Time, bool) {
+	sealed, err := hex.DecodeString(encryptedHex)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	uniq, expires, ok := openExpiring(sealed, sessionIdData(keyId), aead)
+	return string(uniq), expires, ok
+}
+
+//sealExpiring encrypts and authenticates the payload and expiration time with
+//the AEAD, using a random nonce that is placed at the front of the result.
+func sealExpiring(payload []byte, expires time.Time, data []byte, aead cipher.AEAD) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Panicf("failed to read the random stream: %v", err)
+	}
+	plaintext := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint64(plaintext, uint64(expires.Unix()))
+	copy(plaintext[8:], payload)
+	return aead.Seal(nonce, nonce, plaintext, data)
+}
+
+//openExpiring reverses sealExpiring and returns the payload and expiration
+//time.  It returns false if the sealed bytes fail authentication or have expired.
+func openExpiring(sealed []byte, data []byte, aead cipher.AEAD) ([]byte, time.Time, bool) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, time.Time{}, false
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], data)
+	if err != nil || len(plaintext) < 8 {
+		return nil, time.Time{}, false
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if expires.Before(time.Now()) {
+		return nil, time.Time{}, false
+	}
+	return plaintext[8:], expires, true
+}
+
+//sessionIdData is the additional data that is authenticated with a session id.
+func sessionIdData(keyId string) []byte {
+	return []byte(s5CookiePrefix + ":" + keyId)
+}
+
 //given a blob of text to encode, returns a hex-encoded string with
-//the provided block cipher's ouptut.  note that a random initialization
+//the provided block cipher's ouptut.  this is the original, unauthenticated
+//format of session ids; only ids in this format from before sealSessionId
+//are still accepted (see Keyring.AcceptLegacyUntil).  note that a random initialization
 //vector is used and placed at the front of the cleartext.  this iv
 //does not need to be secure, but does need to be random.
 func encryptSessionId(cleartext string, block cipher.Block) string {
@@ -383,6 +634,9 @@ func decryptSessionId(encryptedHex string, block cipher.Block) (string, bool) {
 		log.Printf("unable to decode the hex bytes of session id (%s,%d): %v", encryptedHex, len(encryptedHex), err)
 		return "", false
 	}
+	if l < aes.BlockSize {
+		return "", false
+	}
 	iv := ciphertext[:aes.BlockSize]
 	stream := cipher.NewCTR(block, iv)
 
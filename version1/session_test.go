@@ -1,6 +1,8 @@
 package seven5
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -52,6 +54,17 @@ func TestSessionBasic(t *testing.T) {
 		t.Errorf("Unexpected session returned (expected %s but got %s)", s.SessionId(), f.Session.SessionId())
 	}
 
+	//a session id can be recovered by a manager with the same key, as
+	//after a restart
+	other := NewSimpleSessionManager(&testGen{})
+	f, err = other.Find(s.SessionId())
+	if err != nil {
+		t.Fatalf("Failed to communicate to the session manager: %s", err)
+	}
+	if f == nil || f.UniqueId != "blah" {
+		t.Errorf("did not recover unique id %s, got %+v", "blah", f)
+	}
+
 	err = mgr.Destroy("bogus")
 	if err != nil {
 		t.Fatalf("Failed to communicate to the session manager: %s", err)
@@ -67,12 +80,9 @@ func TestSessionBasic(t *testing.T) {
 		t.Fatalf("Failed to communicate to the session manager: %s", err)
 	}
 
-	if f != nil && f.Session != nil {
-		t.Errorf("Unexpected find of '%s'", s.SessionId())
-	}
-
-	if f.UniqueId != "blah" {
-		t.Errorf("did not recover unique id %s, got '%s'", "blah", f.UniqueId)
+	//destroyed sessions are not recovered from their unique id
+	if f != nil {
+		t.Errorf("Unexpected find of '%s': %+v", s.SessionId(), f)
 	}
 
 	f, err = mgr.Find("garbagex")
@@ -108,8 +118,146 @@ func TestSessionBasic(t *testing.T) {
 	// channel
 	//
 
-	if packetsProcessed != 10 {
-		t.Errorf("Expected to have processed %d packets, but found %d\n", 6, packetsProcessed)
+	if packetsProcessed != 11 {
+		t.Errorf("Expected to have processed %d packets, but found %d\n", 11, packetsProcessed)
+	}
+
+}
+
+type eviction struct {
+	id     string
+	reason EvictionReason
+}
+
+func expectEviction(t *testing.T, ch chan eviction, id string, reason EvictionReason) {
+	select {
+	case ev := <-ch:
+		if ev.id != id || ev.reason != reason {
+			t.Errorf("expected eviction of %s (%v) but got %s (%v)", id, reason, ev.id, ev.reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for eviction of %s (%v)", id, reason)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	evicted := make(chan eviction, 10)
+	policy := &SessionPolicy{
+		Sliding:      true,
+		MaxLifetime:  1200 * time.Millisecond,
+		IdleTimeout:  400 * time.Millisecond,
+		ReapInterval: 50 * time.Millisecond,
+		OnEvict: func(s Session, reason EvictionReason) {
+			evicted <- eviction{s.SessionId(), reason}
+		},
+	}
+	mgr := NewExpiringSessionManager(&testGen{}, policy)
+
+	//idle sessions are reaped, and not recreated by the generator
+	idle, _ := mgr.Assign("idle", "idle", time.Now().Add(time.Hour))
+	expectEviction(t, evicted, idle.SessionId(), EVICT_IDLE)
+	if sr, _ := mgr.Find(idle.SessionId()); sr != nil {
+		t.Errorf("expected idle session to stay evicted: %+v", sr)
+	}
+
+	//active sessions slide forward, but not past the max lifetime
+	s, _ := mgr.Assign("active", "active", time.Now().Add(300*time.Millisecond))
+	first := s.(ExpiringSession).Expires()
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		sr, _ := mgr.Find(s.SessionId())
+		if sr == nil || sr.Session == nil {
+			t.Fatalf("lost active session after %d finds", i)
+		}
+		if i == 3 && !sr.Session.(ExpiringSession).Expires().After(first) {
+			t.Errorf("session expiration did not slide forward")
+		}
+	}
+	//stop using it and wait for the max lifetime
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		mgr.Find(s.SessionId())
+	}
+	expectEviction(t, evicted, s.SessionId(), EVICT_MAX_LIFETIME)
+	if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+		t.Errorf("expected nothing to be recoverable after max lifetime: %+v", sr)
+	}
+
+	//logouts are reported too
+	s, _ = mgr.Assign("logout", "logout", time.Time{})
+	mgr.Destroy(s.SessionId())
+	expectEviction(t, evicted, s.SessionId(), EVICT_DESTROYED)
+	if sr, _ := mgr.Find(s.SessionId()); sr != nil {
+		t.Errorf("expected destroyed session to stay gone: %+v", sr)
 	}
+}
 
+func TestSessionRegenerate(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	before := NewSimpleSessionManager(&testGen{})
+	s, _ := before.Assign("wilma", "wilma", time.Time{})
+
+	//after a restart, the session is recreated and the client gets its id
+	mgr := NewSimpleSessionManager(&testGen{})
+	cm := NewSimpleCookieMapper("regen")
+	hook := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	r, _ := http.NewRequest("GET", "http://localhost/rest/foo", nil)
+	r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+	w := httptest.NewRecorder()
+	pb, err := hook.BundleHook(w, r, mgr)
+	if err != nil || pb.Session() == nil || pb.Session().UserData() != "wilma" {
+		t.Fatalf("session was not regenerated: %v", err)
+	}
+	regenerated := pb.Session().SessionId()
+	if !strings.Contains(w.Header().Get("Set-Cookie"), regenerated) {
+		t.Errorf("regenerated session id not sent to the client: %s", w.Header().Get("Set-Cookie"))
+	}
+
+	//after logout, neither id brings the session back
+	for _, id := range []string{regenerated, s.SessionId()} {
+		mgr.Destroy(id)
+		r, _ = http.NewRequest("GET", "http://localhost/rest/foo", nil)
+		r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: id})
+		pb, err = hook.BundleHook(httptest.NewRecorder(), r, mgr)
+		if err != nil || pb.Session() != nil {
+			t.Errorf("session came back after logout: %v %+v", err, pb.Session())
+		}
+	}
+}
+
+func TestSlidingCookie(t *testing.T) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	cm := NewPolicyCookieMapper("sliding", &CookiePolicy{})
+	get := func(mgr SessionManager, s Session) *http.Cookie {
+		raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm), mgr, nil, "/rest")
+		raw.Rez(&someWire{}, &someResource{})
+		r, _ := http.NewRequest("GET", "http://localhost/rest/somewire/1", nil)
+		r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+		w := httptest.NewRecorder()
+		raw.Dispatch(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			return c
+		}
+		return nil
+	}
+
+	//the cookie follows the session's expiration as it slides forward
+	mgr := NewExpiringSessionManager(nil, &SessionPolicy{Sliding: true})
+	s, _ := mgr.Assign("slider", "slider", time.Now().Add(time.Minute))
+	time.Sleep(1100 * time.Millisecond)
+	c := get(mgr, s)
+	if c == nil || c.Value != s.SessionId() || !c.Expires.After(s.(ExpiringSession).Expires()) {
+		t.Errorf("expected the cookie to be sent with the new expiration: %+v", c)
+	}
+
+	//without sliding, the cookie does not change
+	mgr = NewExpiringSessionManager(nil, &SessionPolicy{})
+	s, _ = mgr.Assign("fixed", "fixed", time.Now().Add(time.Minute))
+	if c := get(mgr, s); c != nil {
+		t.Errorf("expected no cookie when the expiration did not move: %+v", c)
+	}
 }
@@ -0,0 +1,21 @@
+package seven5
+
+import (
+	"os"
+	"strings"
+)
+
+//setupTestSession sets the key for session ids and returns a session manager
+//and a cookie mapper for the app name.
+func setupTestSession(appName string) (CookieMapper, *SimpleSessionManager) {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	return NewSimpleCookieMapper(appName), NewSimpleSessionManager(nil)
+}
+
+//setupTestDispatcher returns a json dispatcher mounted at /rest that uses
+//the session manager and cookie mapper from setupTestSession.
+func setupTestDispatcher(appName string) (CookieMapper, *SimpleSessionManager, *RawDispatcher) {
+	cm, sm := setupTestSession(appName)
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm), sm, nil, "/rest")
+	return cm, sm, raw
+}
@@ -0,0 +1,368 @@
+package seven5
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//THROTTLE_PROBLEM_TYPE is the type of the problem sent when a login is
+	//refused because there have been too many failures recently.
+	THROTTLE_PROBLEM_TYPE = "urn:seven5:throttled"
+	//LOCKOUT_PROBLEM_TYPE is the type of the problem sent when a login is
+	//refused because the account is locked.
+	LOCKOUT_PROBLEM_TYPE = "urn:seven5:locked"
+
+	THROTTLE_USER_PREFIX = "user:"
+	THROTTLE_IP_PREFIX   = "ip:"
+)
+
+//ThrottleStore keeps the failed logins for LoginThrottle.  Keys are a username
+//or IP address with a prefix.  AddFailure records a failure and returns an id
+//for it; ids increase in the order failures are added.  Failures before since
+//are no longer needed, for any key, and may be removed.  Failures returns the
+//number of failures for the key since the time given, counting only those with
+//an id less than before (or all of them if before is 0), and the time of the
+//most recent one.  RemoveFailure removes one failure and Clear removes all the
+//failures for the key.
+type ThrottleStore interface {
+	AddFailure(key string, at time.Time, since time.Time) (int64, error)
+	Failures(key string, since time.Time, before int64) (int, time.Time, error)
+	RemoveFailure(key string, id int64) error
+	Clear(key string) error
+	SetLocked(key string, locked bool) error
+	Locked(key string) (bool, error)
+}
+
+//THROTTLE_SWEEP_INTERVAL is how often MemoryThrottleStore removes the failures
+//that are no longer needed for every key.
+const THROTTLE_SWEEP_INTERVAL = time.Minute
+
+//failure is a failed login kept by MemoryThrottleStore.
+type failure struct {
+	id int64
+	at time.Time
+}
+
+//MemoryThrottleStore keeps failures in memory, so they are per process and
+//are lost when the server restarts.  Old failures are swept away every
+//THROTTLE_SWEEP_INTERVAL, so trying many usernames does not use up memory.
+type MemoryThrottleStore struct {
+	lock      sync.Mutex
+	failures  map[string][]failure
+	locked    map[string]bool
+	nextId    int64
+	lastSweep time.Time
+}
+
+//NewMemoryThrottleStore returns an empty store.
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{
+		failures: make(map[string][]failure),
+		locked:   make(map[string]bool),
+	}
+}
+
+func (self *MemoryThrottleStore) AddFailure(key string, at time.Time, since time.Time) (int64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if at.Sub(self.lastSweep) > THROTTLE_SWEEP_INTERVAL {
+		for k := range self.failures {
+			self.prune(k, since)
+		}
+		self.lastSweep = at
+	}
+	self.nextId++
+	self.failures[key] = append(self.failures[key], failure{self.nextId, at})
+	return self.nextId, nil
+}
+
+//prune removes the failures for the key before since.  The caller must hold
+//the lock.
+func (self *MemoryThrottleStore) prune(key string, since time.Time) {
+	var recent []failure
+	for _, f := range self.failures[key] {
+		if f.at.After(since) {
+			recent = append(recent, f)
+		}
+	}
+	if len(recent) == 0 {
+		delete(self.failures, key)
+	} else {
+		self.failures[key] = recent
+	}
+}
+
+func (self *MemoryThrottleStore) Failures(key string, since time.Time, before int64) (int, time.Time, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.prune(key, since)
+	n := 0
+	var last time.Time
+	for _, f := range self.failures[key] {
+		if before != 0 && f.id >= before {
+			continue
+		}
+		n++
+		if f.at.After(last) {
+			last = f.at
+		}
+	}
+	return n, last, nil
+}
+
+func (self *MemoryThrottleStore) RemoveFailure(key string, id int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	list := self.failures[key]
+	for i, f := range list {
+		if f.id == id {
+			self.failures[key] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(self.failures[key]) == 0 {
+		delete(self.failures, key)
+	}
+	return nil
+}
+
+func (self *MemoryThrottleStore) Clear(key string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.failures, key)
+	return nil
+}
+
+func (self *MemoryThrottleStore) SetLocked(key string, locked bool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if locked {
+		self.locked[key] = true
+	} else {
+		delete(self.locked, key)
+	}
+	return nil
+}
+
+func (self *MemoryThrottleStore) Locked(key string) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.locked[key], nil
+}
+
+//LoginThrottle slows down password guessing.  Failed logins are counted, per
+//username and per IP address, over a sliding Window.  After UserFree failures
+//for a username (or IPFree for an address) each further attempt must wait
+//BaseDelay, doubling with each failure up to MaxDelay, after the most recent
+//failure.  If LockoutAfter is not zero, a username with that many failures in
+//the Window is locked until Unlock is called, which SimplePasswordHandler does
+//when the user resets their password.  Addresses are never locked.
+type LoginThrottle struct {
+	Store        ThrottleStore
+	Window       time.Duration
+	UserFree     int
+	IPFree       int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+}
+
+//NewLoginThrottle returns a throttle that allows 3 failures per username and
+//20 per address in 15 minutes before delays start at one second.  There is no
+//lockout.
+func NewLoginThrottle(store ThrottleStore) *LoginThrottle {
+	return &LoginThrottle{
+		Store:     store,
+		Window:    15 * time.Minute,
+		UserFree:  3,
+		IPFree:    20,
+		BaseDelay: time.Second,
+		MaxDelay:  15 * time.Minute,
+	}
+}
+
+//throttleKeys returns the keys for the username and ip, skipping empty ones.
+func throttleKeys(username string, ip string) []string {
+	var result []string
+	if username != "" {
+		result = append(result, THROTTLE_USER_PREFIX+normalizeUsername(username))
+	}
+	if ip != "" {
+		result = append(result, THROTTLE_IP_PREFIX+ip)
+	}
+	return result
+}
+
+//delay returns how long to wait after the last failure when there have been
+//n failures and free of them are allowed without waiting.
+func (self *LoginThrottle) delay(n int, free int) time.Duration {
+	if n < free {
+		return 0
+	}
+	d := float64(self.BaseDelay) * math.Pow(2, float64(n-free))
+	if d > float64(self.MaxDelay) {
+		return self.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+//LoginAttempt is a login that LoginThrottle.Begin has allowed.  It is counted
+//as a failure from the start, so that logins made at the same time cannot all
+//get past the throttle while the password is checked; Succeeded takes it back.
+type LoginAttempt struct {
+	throttle *LoginThrottle
+	keys     []string
+	ids      []int64
+}
+
+//Begin returns an attempt if a login for the username from the ip may be
+//made now.  Otherwise it returns a problem with status 429, with a
+//"retryAfter" extension in seconds, or 423 if the account is locked.  The
+//attempt is recorded before the failures are counted, so of several attempts
+//made at the same time only those that would be allowed one after the other
+//are allowed.  One of Failed or Succeeded must be called with the result.
+func (self *LoginThrottle) Begin(username string, ip string) (*LoginAttempt, error) {
+	now := time.Now()
+	since := now.Add(-self.Window)
+	keys := throttleKeys(username, ip)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, THROTTLE_USER_PREFIX) {
+			continue
+		}
+		locked, err := self.Store.Locked(key)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, Problem(http.StatusLocked, LOCKOUT_PROBLEM_TYPE, "Account locked",
+				"this account is locked, reset the password to unlock it")
+		}
+	}
+	attempt := &LoginAttempt{throttle: self, keys: keys}
+	for _, key := range keys {
+		id, err := self.Store.AddFailure(key, now, since)
+		if err != nil {
+			attempt.release()
+			return nil, err
+		}
+		attempt.ids = append(attempt.ids, id)
+	}
+	var wait time.Duration
+	for i, key := range keys {
+		free := self.IPFree
+		if strings.HasPrefix(key, THROTTLE_USER_PREFIX) {
+			free = self.UserFree
+		}
+		n, last, err := self.Store.Failures(key, since, attempt.ids[i])
+		if err != nil {
+			attempt.release()
+			return nil, err
+		}
+		if w := last.Add(self.delay(n, free)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return attempt, nil
+	}
+	//refused attempts are not failures
+	if err := attempt.release(); err != nil {
+		return nil, err
+	}
+	secs := int64(math.Ceil(wait.Seconds()))
+	return nil, Problem(http.StatusTooManyRequests, THROTTLE_PROBLEM_TYPE, "Too many attempts",
+		fmt.Sprintf("too many failed logins, try again in %d seconds", secs)).With("retryAfter", secs)
+}
+
+//release removes the failures recorded for the attempt.
+func (self *LoginAttempt) release() error {
+	for i, id := range self.ids {
+		if err := self.throttle.Store.RemoveFailure(self.keys[i], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Failed leaves the attempt counted as a failure, and locks the username if
+//there have been too many failures.
+func (self *LoginAttempt) Failed() error {
+	t := self.throttle
+	if t.LockoutAfter == 0 {
+		return nil
+	}
+	for _, key := range self.keys {
+		if !strings.HasPrefix(key, THROTTLE_USER_PREFIX) {
+			continue
+		}
+		n, _, err := t.Store.Failures(key, time.Now().Add(-t.Window), 0)
+		if err != nil {
+			return err
+		}
+		if n >= t.LockoutAfter {
+			if err := t.Store.SetLocked(key, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Succeeded forgets the failures for the username.  Failures from the address
+//are kept, since they may be for other usernames, but this attempt is removed.
+func (self *LoginAttempt) Succeeded() error {
+	for i, key := range self.keys {
+		var err error
+		if strings.HasPrefix(key, THROTTLE_USER_PREFIX) {
+			err = self.throttle.Store.Clear(key)
+		} else {
+			err = self.throttle.Store.RemoveFailure(key, self.ids[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Unlock removes the lock on the username and forgets its failures.
+func (self *LoginThrottle) Unlock(username string) error {
+	key := THROTTLE_USER_PREFIX + normalizeUsername(username)
+	if err := self.Store.SetLocked(key, false); err != nil {
+		return err
+	}
+	return self.Store.Clear(key)
+}
+
+//WriteThrottleError sends the error from Begin to the client, with a
+//Retry-After header if the login may be tried later.
+func WriteThrottleError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*Error); ok {
+		if secs, ok := e.Extensions["retryAfter"].(int64); ok {
+			w.Header().Set("Retry-After", fmt.Sprint(secs))
+		}
+	}
+	WriteError(w, err)
+}
+
+//RemoteIP returns the address of the client without the port.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//UsernameLookup can be implemented by a ValidatingSessionManager to find the
+//username for the unique id of a user.  SimplePasswordHandler uses it to unlock
+//an account when the user's password is reset.
+type UsernameLookup interface {
+	LookupUsername(uniq string) (string, error)
+}
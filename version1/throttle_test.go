@@ -0,0 +1,190 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testValidator accepts the password "sekrit" for any user.
+type testValidator struct {
+	SessionManager
+	resets int
+}
+
+func (self *testValidator) ValidateCredentials(username, password string) (string, interface{}, error) {
+	if password != "sekrit" {
+		return "", nil, nil
+	}
+	return username, username, nil
+}
+
+func (self *testValidator) SendUserDetails(i interface{}, w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (self *testValidator) GenerateResetRequest(username string) (string, error) {
+	return "token", nil
+}
+
+func (self *testValidator) UseResetRequest(userId string, token string, newpwd string) (bool, error) {
+	self.resets++
+	return token == "token", nil
+}
+
+func (self *testValidator) LookupUsername(uniq string) (string, error) {
+	return uniq, nil
+}
+
+//fail makes a login attempt that fails.
+func fail(throttle *LoginThrottle, username string, ip string) {
+	if attempt, err := throttle.Begin(username, ip); err == nil {
+		attempt.Failed()
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	throttle := NewLoginThrottle(NewMemoryThrottleStore())
+	throttle.UserFree = 2
+	throttle.IPFree = 4
+	throttle.BaseDelay = time.Hour
+	throttle.MaxDelay = 2 * time.Hour
+
+	for i := 0; i < 2; i++ {
+		attempt, err := throttle.Begin("fred", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("login refused after %d failures: %v", i, err)
+		}
+		attempt.Failed()
+	}
+	_, err := throttle.Begin("FRED", "10.0.0.2")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusTooManyRequests || e.Extensions["retryAfter"].(int64) != 3600 {
+		t.Fatalf("expected throttled login, got %v", err)
+	}
+	attempt, err := throttle.Begin("barney", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("other user throttled: %v", err)
+	}
+	//a success does not count against the address
+	attempt.Succeeded()
+
+	//address limit covers all usernames
+	fail(throttle, "barney", "10.0.0.1")
+	fail(throttle, "wilma", "10.0.0.1")
+	if _, err := throttle.Begin("betty", "10.0.0.1"); err == nil {
+		t.Errorf("expected address to be throttled")
+	}
+	//refused attempts are not failures, so the delay has not grown
+	fail(throttle, "fred", "10.0.0.3")
+	_, err = throttle.Begin("fred", "10.0.0.3")
+	if e, ok := err.(*Error); !ok || e.Extensions["retryAfter"].(int64) != 3600 {
+		t.Errorf("expected the same backoff, got %v", err)
+	}
+	throttle.Store.AddFailure(THROTTLE_USER_PREFIX+"fred", time.Now(), time.Now().Add(-throttle.Window))
+	_, err = throttle.Begin("fred", "10.0.0.3")
+	if e, ok := err.(*Error); !ok || e.Extensions["retryAfter"].(int64) != 7200 {
+		t.Errorf("expected backoff to double, got %v", err)
+	}
+	throttle.Unlock("fred")
+	if _, err := throttle.Begin("fred", "10.0.0.3"); err != nil {
+		t.Errorf("unlock did not clear failures: %v", err)
+	}
+
+	//failures outside the window are forgotten
+	throttle.Window = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := throttle.Begin("betty", "10.0.0.1"); err != nil {
+		t.Errorf("old failures not forgotten: %v", err)
+	}
+}
+
+func TestLoginThrottleConcurrent(t *testing.T) {
+	throttle := NewLoginThrottle(NewMemoryThrottleStore())
+	throttle.UserFree = 3
+	throttle.BaseDelay = time.Hour
+
+	//all the attempts start before any finishes, as with a slow password hash
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var allowed []*LoginAttempt
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if attempt, err := throttle.Begin("fred", ""); err == nil {
+				lock.Lock()
+				allowed = append(allowed, attempt)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(allowed) != 3 {
+		t.Errorf("expected 3 attempts to get past the throttle, got %d", len(allowed))
+	}
+}
+
+func TestMemoryThrottleSweep(t *testing.T) {
+	store := NewMemoryThrottleStore()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		store.AddFailure(fmt.Sprintf("user:random%d", i), now, now.Add(-time.Minute))
+	}
+	later := now.Add(2 * THROTTLE_SWEEP_INTERVAL)
+	store.AddFailure("user:fred", later, later.Add(-time.Minute))
+	if len(store.failures) != 1 {
+		t.Errorf("expected old failures to be swept, %d keys left", len(store.failures))
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	cm, sm := setupTestSession("throttletest")
+	vsm := &testValidator{SessionManager: sm}
+	handler := NewSimplePasswordHandler(vsm, cm)
+	handler.Throttle = NewLoginThrottle(NewMemoryThrottleStore())
+	handler.Throttle.UserFree = 1
+	handler.Throttle.BaseDelay = time.Millisecond
+	handler.Throttle.MaxDelay = time.Millisecond
+	handler.Throttle.LockoutAfter = 3
+
+	login := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://localhost/auth", strings.NewReader(body))
+		r.RemoteAddr = "10.0.0.1:1234"
+		handler.AuthHandler(w, r)
+		time.Sleep(2 * time.Millisecond)
+		return w
+	}
+	if w := login(`{"Username":"fred","Password":"sekrit","Op":"login"}`); w.Code != http.StatusOK {
+		t.Fatalf("login failed: %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := login(`{"Username":"fred","Password":"wrong","Op":"login"}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected failure %d, got %d", i, w.Code)
+		}
+	}
+	if w := login(`{"Username":"fred","Password":"sekrit","Op":"login"}`); w.Code != http.StatusLocked {
+		t.Fatalf("expected locked account, got %d", w.Code)
+	}
+
+	//throttled logins get Retry-After
+	handler.Throttle.BaseDelay, handler.Throttle.MaxDelay = time.Minute, time.Minute
+	login(`{"Username":"barney","Password":"wrong","Op":"login"}`)
+	w := login(`{"Username":"barney","Password":"sekrit","Op":"login"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	//reset unlocks
+	if w := login(`{"UserUdid":"fred","ResetRequestUdid":"token","Password":"new","Op":"pwdreset"}`); w.Code != http.StatusOK {
+		t.Fatalf("reset failed: %d", w.Code)
+	}
+	if w := login(`{"Username":"fred","Password":"sekrit","Op":"login"}`); w.Code != http.StatusOK {
+		t.Errorf("reset did not unlock account: %d", w.Code)
+	}
+}
@@ -0,0 +1,583 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//MFA_PENDING_PREFIX is put in front of the unique id of a session that is
+	//waiting for the second factor, so that it cannot be recreated as a full
+	//session after a restart.
+	MFA_PENDING_PREFIX = "mfa:"
+	//SECOND_FACTOR_PROBLEM_TYPE is the type of the problem sent when a request
+	//is made with a session that is waiting for the second factor.
+	SECOND_FACTOR_PROBLEM_TYPE = "urn:seven5:second-factor"
+
+	TOTP_DIGITS         = 6
+	TOTP_PERIOD         = 30
+	TOTP_SECRET_SIZE    = 20
+	RECOVERY_CODE_COUNT = 10
+	TOTP_MAX_ATTEMPTS   = 5
+)
+
+//PartialAuth is the user data of a session for a user who has given the right
+//password but not yet the second factor.  The user data of the full session
+//is kept in UserData.
+type PartialAuth struct {
+	UniqueId string
+	UserData interface{}
+}
+
+//IsPartialSession returns true if the session is waiting for the second factor.
+//RawDispatcher refuses requests with these sessions.
+func IsPartialSession(s Session) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.UserData().(*PartialAuth)
+	return ok
+}
+
+//secondFactorRequired is the error sent for requests with a partial session.
+func secondFactorRequired() *Error {
+	return Problem(http.StatusUnauthorized, SECOND_FACTOR_PROBLEM_TYPE, "Second factor required",
+		"the login must be completed with a second factor")
+}
+
+//isPendingUniqueId returns true if the unique id is of a partial session.
+//These are not recreated from the unique id, the user must log in again.
+func isPendingUniqueId(uniq string) bool {
+	return strings.HasPrefix(uniq, MFA_PENDING_PREFIX)
+}
+
+//storedUserData returns the user data to be encoded by session managers that
+//store it; for a partial session this is the user data it wraps.
+func storedUserData(ud interface{}) interface{} {
+	if p, ok := ud.(*PartialAuth); ok {
+		return p.UserData
+	}
+	return ud
+}
+
+//restoredUserData undoes storedUserData, given the unique id of the session.
+func restoredUserData(uniq string, ud interface{}) interface{} {
+	if isPendingUniqueId(uniq) {
+		return &PartialAuth{UniqueId: strings.TrimPrefix(uniq, MFA_PENDING_PREFIX), UserData: ud}
+	}
+	return ud
+}
+
+//TOTPCode returns the RFC 6238 code (HMAC-SHA1, six digits, 30 second period)
+//for the secret at the time given.
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpCode(secret, t.Unix()/TOTP_PERIOD)
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%1000000)
+}
+
+//TOTPURI returns the otpauth URI for the secret, which authenticator apps read
+//from a QR code.
+func TOTPURI(issuer string, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", encodeTOTPSecret(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	q.Set("period", fmt.Sprint(TOTP_PERIOD))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func encodeTOTPSecret(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+//SecondFactorState is what is stored for a user who has enrolled, or started
+//to enroll, in TOTP.  LastStep is the time step of the last code used, so a
+//code cannot be used twice.  RecoveryCodes are the hashes of the recovery
+//codes that have not been used.
+type SecondFactorState struct {
+	Secret        []byte
+	Confirmed     bool
+	LastStep      int64
+	RecoveryCodes []string
+}
+
+//SecondFactorStore keeps the second factor state of users by their unique id.
+//Load returns nil if the user has none.  Save with nil removes the state.
+type SecondFactorStore interface {
+	LoadSecondFactor(uniq string) (*SecondFactorState, error)
+	SaveSecondFactor(uniq string, state *SecondFactorState) error
+}
+
+//MemorySecondFactorStore keeps second factor state in memory.  It is useful
+//for tests.
+type MemorySecondFactorStore struct {
+	lock  sync.Mutex
+	state map[string]SecondFactorState
+}
+
+//NewMemorySecondFactorStore returns an empty store.
+func NewMemorySecondFactorStore() *MemorySecondFactorStore {
+	return &MemorySecondFactorStore{state: make(map[string]SecondFactorState)}
+}
+
+func (self *MemorySecondFactorStore) LoadSecondFactor(uniq string) (*SecondFactorState, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	s, ok := self.state[uniq]
+	if !ok {
+		return nil, nil
+	}
+	s.RecoveryCodes = append([]string(nil), s.RecoveryCodes...)
+	return &s, nil
+}
+
+func (self *MemorySecondFactorStore) SaveSecondFactor(uniq string, state *SecondFactorState) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if state == nil {
+		delete(self.state, uniq)
+	} else {
+		self.state[uniq] = *state
+	}
+	return nil
+}
+
+//SecondFactorParameters is sent by the client to the enrollment handlers.
+//XXX This has to be copied to the client side library, too. XXX
+type SecondFactorParameters struct {
+	Code string
+}
+
+//SecondFactorEnrollment is sent to the client to start enrollment.  The URI
+//is usually shown as a QR code, the Secret is for typing in by hand.
+type SecondFactorEnrollment struct {
+	Secret string
+	URI    string
+}
+
+//SecondFactorRecovery is sent to the client when enrollment is confirmed.  The
+//codes are shown to the user once; each can be used instead of a TOTP code
+//one time.
+type SecondFactorRecovery struct {
+	RecoveryCodes []string
+}
+
+//TOTPAuth adds time-based one time passwords as a second factor to
+//SimplePasswordHandler (set its SecondFactor field).  After a user who has
+//enrolled gives the right password, they get a partial session; AuthHandler
+//replaces it with a full session when they send an AUTH_OP_TOTP with a code
+//from their authenticator app, or one of their recovery codes.  Partial
+//sessions last PendingLifetime and are refused by RawDispatcher.
+//
+//Users enroll by sending a POST to EnrollHandler, which returns the otpauth
+//URI, and then a POST to ConfirmHandler with a code from the app, which
+//returns the recovery codes.  DisableHandler removes the second factor when
+//given a valid code.  The identify function given to NewTOTPAuth returns the
+//unique id of a user (the one given to Assign) from their user data, so that
+//these handlers know who is logged in.  They are not behind the RawDispatcher,
+//so set CSRF to the dispatcher's CSRFPolicy for them to be checked the same way.
+//
+//A user has MaxAttempts wrong codes, over all their partial sessions,
+//whether or not there is a LoginThrottle.  After that, the partial session is
+//destroyed and no code is accepted for the user until PendingLifetime has
+//passed since the first wrong code, or their password is reset.  The session
+//ids that were refused are remembered until they expire, since some session
+//managers (such as CookieSessionManager) cannot destroy a session.  The counts
+//are kept by each server process.
+type TOTPAuth struct {
+	Issuer          string
+	Skew            int
+	PendingLifetime time.Duration
+	MaxAttempts     int
+	CSRF            CSRFPolicy
+	store           SecondFactorStore
+	sm              SessionManager
+	cm              CookieMapper
+	identify        func(userData interface{}) string
+	lock            sync.Mutex
+	wrong           map[string]*wrongCodes
+	refused         map[string]time.Time
+}
+
+//wrongCodes counts the wrong codes given by a user.
+type wrongCodes struct {
+	count int
+	first time.Time
+}
+
+//NewTOTPAuth returns a TOTPAuth that allows codes from one period either side
+//of now, to allow for clocks that are a little wrong, and gives users five
+//minutes and TOTP_MAX_ATTEMPTS tries to enter their code.
+func NewTOTPAuth(store SecondFactorStore, sm SessionManager, cm CookieMapper, issuer string,
+	identify func(userData interface{}) string) *TOTPAuth {
+	return &TOTPAuth{
+		Issuer:          issuer,
+		Skew:            1,
+		PendingLifetime: 5 * time.Minute,
+		MaxAttempts:     TOTP_MAX_ATTEMPTS,
+		store:           store,
+		sm:              sm,
+		cm:              cm,
+		identify:        identify,
+	}
+}
+
+//Enrolled returns true if the user has confirmed a second factor.
+func (self *TOTPAuth) Enrolled(uniq string) (bool, error) {
+	state, err := self.store.LoadSecondFactor(uniq)
+	if err != nil || state == nil {
+		return false, err
+	}
+	return state.Confirmed, nil
+}
+
+//hashRecoveryCode normalizes the code, so users can type it with or without
+//dashes and in any case, and hashes it.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+//check returns true if the code is a TOTP code or recovery code of the state
+//that has not been used, and updates the state to record its use.
+func (self *TOTPAuth) check(state *SecondFactorState, code string, allowRecovery bool) bool {
+	code = strings.TrimSpace(code)
+	now := time.Now().Unix() / TOTP_PERIOD
+	for step := now - int64(self.Skew); step <= now+int64(self.Skew); step++ {
+		if step > state.LastStep && hmac.Equal([]byte(totpCode(state.Secret, step)), []byte(code)) {
+			state.LastStep = step
+			return true
+		}
+	}
+	if !allowRecovery || code == "" {
+		return false
+	}
+	hash := hashRecoveryCode(code)
+	for i, h := range state.RecoveryCodes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			state.RecoveryCodes = append(state.RecoveryCodes[:i], state.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//Verify returns true if the code is a valid TOTP code, or unused recovery
+//code, for the user.  Each code can only be used once.
+func (self *TOTPAuth) Verify(uniq string, code string) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	state, err := self.store.LoadSecondFactor(uniq)
+	if err != nil || state == nil || !state.Confirmed {
+		return false, err
+	}
+	if !self.check(state, code, true) {
+		return false, nil
+	}
+	return true, self.store.SaveSecondFactor(uniq, state)
+}
+
+//VerifyPending is Verify for the user of a partial session, which counts the
+//wrong codes of the user.  When there have been MaxAttempts of them, the
+//partial session is destroyed and refused, and an error with status 401 is
+//returned for it and for any other code given for the user.
+func (self *TOTPAuth) VerifyPending(sessionId string, p *PartialAuth, code string) (bool, error) {
+	if self.blocked(sessionId, p.UniqueId) {
+		return false, tooManyCodes()
+	}
+	ok, err := self.Verify(p.UniqueId, code)
+	if err != nil {
+		return false, err
+	}
+	self.lock.Lock()
+	if ok {
+		delete(self.wrong, p.UniqueId)
+		self.lock.Unlock()
+		return true, nil
+	}
+	w := self.wrong[p.UniqueId]
+	if w == nil {
+		w = &wrongCodes{first: time.Now()}
+		self.wrong[p.UniqueId] = w
+	}
+	w.count++
+	tooMany := w.count >= self.MaxAttempts
+	if tooMany {
+		self.refused[sessionId] = time.Now().Add(self.PendingLifetime)
+	}
+	self.lock.Unlock()
+	if !tooMany {
+		return false, nil
+	}
+	if err := self.sm.Destroy(sessionId); err != nil {
+		return false, err
+	}
+	return false, tooManyCodes()
+}
+
+//blocked returns true if the session has been refused or the user has had
+//too many wrong codes.  It also forgets the counts and refusals that are
+//older than PendingLifetime.
+func (self *TOTPAuth) blocked(sessionId string, uniq string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.wrong == nil {
+		self.wrong = make(map[string]*wrongCodes)
+		self.refused = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for id, w := range self.wrong {
+		if now.Sub(w.first) > self.PendingLifetime {
+			delete(self.wrong, id)
+		}
+	}
+	for id, expires := range self.refused {
+		if now.After(expires) {
+			delete(self.refused, id)
+		}
+	}
+	if _, ok := self.refused[sessionId]; ok {
+		return true
+	}
+	w := self.wrong[uniq]
+	return w != nil && w.count >= self.MaxAttempts
+}
+
+//ResetAttempts forgets the wrong codes of the user, so they can try again
+//at once.  SimplePasswordHandler calls this when the user's password is reset.
+func (self *TOTPAuth) ResetAttempts(uniq string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.wrong, uniq)
+}
+
+func tooManyCodes() *Error {
+	return Problem(http.StatusUnauthorized, SECOND_FACTOR_PROBLEM_TYPE, "Too many wrong codes",
+		"too many wrong codes, log in again")
+}
+
+//Pending returns the partial session with the id, or nil if there is not one.
+func (self *TOTPAuth) Pending(sessionId string) (*PartialAuth, error) {
+	sr, err := self.sm.Find(sessionId)
+	if err != nil || sr == nil || sr.Session == nil {
+		return nil, err
+	}
+	p, _ := sr.Session.UserData().(*PartialAuth)
+	return p, nil
+}
+
+//Begin creates the partial session for a user who has given the right password.
+func (self *TOTPAuth) Begin(uniq string, userData interface{}) (Session, error) {
+	return self.sm.Assign(MFA_PENDING_PREFIX+uniq, &PartialAuth{UniqueId: uniq, UserData: userData},
+		time.Now().Add(self.PendingLifetime))
+}
+
+//Complete replaces the partial session with a full one.
+func (self *TOTPAuth) Complete(sessionId string, p *PartialAuth) (Session, error) {
+	if err := self.sm.Destroy(sessionId); err != nil {
+		return nil, err
+	}
+	return self.sm.Assign(p.UniqueId, p.UserData, time.Time{})
+}
+
+//loggedIn returns the live, full session of the request, or nil.  A session
+//id that is only good for recreating a session is not enough.
+func (self *TOTPAuth) loggedIn(r *http.Request) (Session, error) {
+	id, err := self.cm.Value(r)
+	if err == NO_SUCH_COOKIE {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sr, err := self.sm.Find(strings.TrimSpace(id))
+	if err != nil || sr == nil || sr.Session == nil || IsPartialSession(sr.Session) {
+		return nil, err
+	}
+	return sr.Session, nil
+}
+
+//prepare does the common work of the handlers: it checks for a POST from a
+//logged in user that passes the CSRF check and reads the parameters.  It
+//returns "" if it has sent an error to the client.
+func (self *TOTPAuth) prepare(w http.ResponseWriter, r *http.Request, params *SecondFactorParameters) string {
+	w.Header().Add("Cache-Control", "no-cache, must-revalidate") //HTTP 1.1
+	w.Header().Add("Pragma", "no-cache")                         //HTTP 1.0
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		sendProblem(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return ""
+	}
+	session, err := self.loggedIn(r)
+	if err != nil {
+		WriteError(w, err)
+		return ""
+	}
+	if session == nil {
+		sendProblem(w, "not logged in", http.StatusUnauthorized)
+		return ""
+	}
+	if self.CSRF != nil {
+		pb, err := NewSimplePBundle(r, session, self.sm)
+		if err != nil {
+			WriteError(w, err)
+			return ""
+		}
+		if !self.CSRF.Check(r, pb) {
+			WriteError(w, Problem(http.StatusForbidden, CSRF_PROBLEM_TYPE, "CSRF check failed",
+				"Missing or invalid "+CSRF_HEADER))
+			return ""
+		}
+	}
+	uniq := self.identify(session.UserData())
+	if uniq == "" {
+		sendProblem(w, "not logged in", http.StatusUnauthorized)
+		return ""
+	}
+	if params != nil {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 512)).Decode(params); err != nil {
+			sendProblem(w, fmt.Sprintf("unable to read parameters: %v", err), http.StatusBadRequest)
+			return ""
+		}
+	}
+	return uniq
+}
+
+func sendJson(w http.ResponseWriter, i interface{}) {
+	buff, err := json.Marshal(i)
+	if err != nil {
+		sendProblem(w, fmt.Sprintf("unable to encode: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buff)
+}
+
+//EnrollHandler starts enrollment with a new secret and sends the
+//SecondFactorEnrollment.  Users who have already enrolled must disable the
+//second factor before enrolling again.
+func (self *TOTPAuth) EnrollHandler(w http.ResponseWriter, r *http.Request) {
+	uniq := self.prepare(w, r, nil)
+	if uniq == "" {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	state, err := self.store.LoadSecondFactor(uniq)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if state != nil && state.Confirmed {
+		sendProblem(w, "already enrolled", http.StatusConflict)
+		return
+	}
+	secret := make([]byte, TOTP_SECRET_SIZE)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if err := self.store.SaveSecondFactor(uniq, &SecondFactorState{Secret: secret}); err != nil {
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] user %s started second factor enrollment", uniq)
+	sendJson(w, &SecondFactorEnrollment{Secret: encodeTOTPSecret(secret), URI: TOTPURI(self.Issuer, uniq, secret)})
+}
+
+//ConfirmHandler finishes enrollment when the client sends a code from the new
+//secret, and sends the SecondFactorRecovery.
+func (self *TOTPAuth) ConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	var params SecondFactorParameters
+	uniq := self.prepare(w, r, &params)
+	if uniq == "" {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	state, err := self.store.LoadSecondFactor(uniq)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if state == nil || state.Confirmed {
+		sendProblem(w, "no enrollment in progress", http.StatusConflict)
+		return
+	}
+	if !self.check(state, params.Code, false) {
+		sendProblem(w, "wrong code", http.StatusUnauthorized)
+		return
+	}
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	state.RecoveryCodes = make([]string, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			WriteError(w, err)
+			return
+		}
+		code := base32.StdEncoding.EncodeToString(buf)
+		codes[i] = code[:4] + "-" + code[4:]
+		state.RecoveryCodes[i] = hashRecoveryCode(code)
+	}
+	state.Confirmed = true
+	if err := self.store.SaveSecondFactor(uniq, state); err != nil {
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] user %s enrolled a second factor", uniq)
+	sendJson(w, &SecondFactorRecovery{RecoveryCodes: codes})
+}
+
+//DisableHandler removes the second factor of the user, if the client sends a
+//valid code.
+func (self *TOTPAuth) DisableHandler(w http.ResponseWriter, r *http.Request) {
+	var params SecondFactorParameters
+	uniq := self.prepare(w, r, &params)
+	if uniq == "" {
+		return
+	}
+	ok, err := self.Verify(uniq, params.Code)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if !ok {
+		sendProblem(w, "wrong code", http.StatusUnauthorized)
+		return
+	}
+	if err := self.store.SaveSecondFactor(uniq, nil); err != nil {
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] user %s disabled their second factor", uniq)
+	sendJson(w, struct{}{})
+}
@@ -0,0 +1,166 @@
+package seven5
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//from RFC 6238, truncated to six digits
+	secret := []byte("12345678901234567890")
+	for when, code := range map[int64]string{59: "287082", 1111111109: "081804", 2000000000: "279037"} {
+		if c := TOTPCode(secret, time.Unix(when, 0)); c != code {
+			t.Errorf("wrong code at %d: expected %s, got %s", when, code, c)
+		}
+	}
+	uri := TOTPURI("Seven5 Test", "fred@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Seven5%20Test:fred@example.com?") ||
+		!strings.Contains(uri, "secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ") {
+		t.Errorf("bad otpauth uri: %s", uri)
+	}
+}
+
+func TestSecondFactorLogin(t *testing.T) {
+	cm, sm := setupTestSession("totptest")
+	vsm := &testValidator{SessionManager: sm}
+	handler := NewSimplePasswordHandler(vsm, cm)
+	totp := NewTOTPAuth(NewMemorySecondFactorStore(), vsm, cm, "Seven5 Test",
+		func(ud interface{}) string { return ud.(string) })
+	handler.SecondFactor = totp
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm), vsm, nil, "/rest")
+	raw.Rez(&someWire{}, &someResource{})
+
+	var cookie *http.Cookie
+	call := func(h http.HandlerFunc, method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		h(w, r)
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			if c.Name == cm.CookieName() {
+				cookie = c
+			}
+		}
+		return w
+	}
+	rest := func(w http.ResponseWriter, r *http.Request) { raw.Dispatch(nil, w, r) }
+
+	//not enrolled, so the password is enough
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Username":"fred","Password":"sekrit","Op":"login"}`); w.Body.String() != "{}" {
+		t.Fatalf("login failed: %d %s", w.Code, w.Body.String())
+	}
+	w := call(totp.EnrollHandler, "POST", "/totp/enroll", "")
+	var enrollment SecondFactorEnrollment
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil || !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Fatalf("enrollment failed: %d %s", w.Code, w.Body.String())
+	}
+	secret, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if w := call(totp.ConfirmHandler, "POST", "/totp/confirm", `{"Code":"000000x"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code accepted for confirmation: %d", w.Code)
+	}
+	w = call(totp.ConfirmHandler, "POST", "/totp/confirm", `{"Code":"`+TOTPCode(secret, time.Now())+`"}`)
+	var recovery SecondFactorRecovery
+	if err := json.Unmarshal(w.Body.Bytes(), &recovery); err != nil || len(recovery.RecoveryCodes) != RECOVERY_CODE_COUNT {
+		t.Fatalf("confirmation failed: %d %s", w.Code, w.Body.String())
+	}
+
+	//enrolled, the password gives a partial session
+	cookie = nil
+	w = call(handler.AuthHandler, "POST", "/auth", `{"Username":"fred","Password":"sekrit","Op":"login"}`)
+	var result PasswordAuthResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || !result.SecondFactorRequired {
+		t.Fatalf("expected second factor to be required: %s", w.Body.String())
+	}
+	w = call(rest, "GET", "/rest/somewire/1", "")
+	p, _ := ParseProblem(w.Body.Bytes())
+	if w.Code != http.StatusUnauthorized || p == nil || p.Type != SECOND_FACTOR_PROBLEM_TYPE {
+		t.Errorf("partial session not refused by dispatcher: %d %s", w.Code, w.Body.String())
+	}
+	if w := call(handler.MeHandler, "GET", "/me", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("partial session accepted by MeHandler: %d", w.Code)
+	}
+	if w := call(totp.EnrollHandler, "POST", "/totp/enroll", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("partial session accepted for enrollment: %d", w.Code)
+	}
+
+	//the code used to confirm cannot be used again
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+TOTPCode(secret, time.Now())+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("code accepted twice: %d", w.Code)
+	}
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+strings.ToLower(recovery.RecoveryCodes[0])+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("recovery code refused: %d %s", w.Code, w.Body.String())
+	}
+	if w := call(rest, "GET", "/rest/somewire/1", ""); w.Code != http.StatusOK {
+		t.Errorf("full session refused by dispatcher: %d %s", w.Code, w.Body.String())
+	}
+
+	//recovery codes are single use
+	cookie = nil
+	call(handler.AuthHandler, "POST", "/auth", `{"Username":"fred","Password":"sekrit","Op":"login"}`)
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+recovery.RecoveryCodes[0]+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("recovery code accepted twice: %d", w.Code)
+	}
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+recovery.RecoveryCodes[1]+`"}`); w.Code != http.StatusOK {
+		t.Errorf("second recovery code refused: %d", w.Code)
+	}
+
+	//the handlers are checked for CSRF and need a live session
+	totp.CSRF = NewSessionCSRF([]byte(strings.Repeat("k", 32)))
+	if w := call(totp.DisableHandler, "POST", "/totp/disable", `{"Code":"x"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected CSRF failure, got %d", w.Code)
+	}
+	totp.CSRF = nil
+	vsm.Destroy(cookie.Value)
+	if w := call(totp.EnrollHandler, "POST", "/totp/enroll", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("destroyed session accepted for enrollment: %d", w.Code)
+	}
+
+	//wrong codes end the partial session, with or without a throttle
+	cookie = nil
+	call(handler.AuthHandler, "POST", "/auth", `{"Username":"fred","Password":"sekrit","Op":"login"}`)
+	for i := 0; i < TOTP_MAX_ATTEMPTS; i++ {
+		w = call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"000000"}`)
+	}
+	if p, _ := ParseProblem(w.Body.Bytes()); w.Code != http.StatusUnauthorized || p == nil || p.Type != SECOND_FACTOR_PROBLEM_TYPE {
+		t.Errorf("expected too many wrong codes, got %d %s", w.Code, w.Body.String())
+	}
+	refusedId := cookie.Value
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+recovery.RecoveryCodes[2]+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("partial session survived too many wrong codes: %d", w.Code)
+	}
+	//the limit is for the user, not the session, and refused ids stay refused
+	//even if the session manager cannot destroy them
+	cookie = nil
+	call(handler.AuthHandler, "POST", "/auth", `{"Username":"fred","Password":"sekrit","Op":"login"}`)
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+recovery.RecoveryCodes[2]+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("new partial session reset the count of wrong codes: %d", w.Code)
+	}
+	totp.ResetAttempts("fred")
+	if _, err := totp.VerifyPending(refusedId, &PartialAuth{UniqueId: "fred"}, recovery.RecoveryCodes[2]); err == nil {
+		t.Errorf("refused partial session accepted a code")
+	}
+
+	//a lockout from wrong codes is removed by a password reset
+	handler.Throttle = NewLoginThrottle(NewMemoryThrottleStore())
+	handler.Throttle.UserFree = 10
+	handler.Throttle.LockoutAfter = 2
+	cookie = nil
+	call(handler.AuthHandler, "POST", "/auth", `{"Username":"fred","Password":"sekrit","Op":"login"}`)
+	for i := 0; i < 2; i++ {
+		call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"000000"}`)
+	}
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+recovery.RecoveryCodes[2]+`"}`); w.Code != http.StatusLocked {
+		t.Fatalf("expected lockout after wrong codes, got %d", w.Code)
+	}
+	call(handler.AuthHandler, "POST", "/auth", `{"UserUdid":"fred","ResetRequestUdid":"token","Password":"new","Op":"pwdreset"}`)
+	if w := call(handler.AuthHandler, "POST", "/auth", `{"Op":"totp","Code":"`+recovery.RecoveryCodes[2]+`"}`); w.Code != http.StatusOK {
+		t.Errorf("reset did not remove the lockout: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,374 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//VALIDATE_TAG is the struct tag used on wire types to declare constraints on
+//a field.  The tag value is a comma separated list of rules, for example
+//`validate:"required,min=3,max=40"`.  The rules are:
+//
+//	required    the field must not be the zero value (or an empty string/slice)
+//	min=N       numbers must be >= N, strings, slices and maps must have length >= N
+//	max=N       numbers must be <= N, strings, slices and maps must have length <= N
+//	len=N       strings, slices and maps must have length exactly N
+//	oneof=a b c the value (formatted as a string) must be one of the listed values
+//	pattern=re  strings must match the regular expression; this must be the last rule
+//	            since the expression may itself contain commas
+//
+//Fields that are structs (or pointers to structs), or slices of them, are
+//checked recursively.  Rules other than required are not checked on zero values,
+//so optional fields can still have constraints.
+const VALIDATE_TAG = "validate"
+
+//FieldError is a single problem with a single field in a wire type. Field is
+//the path to the field using the Go names, such as Address.Street or Items[2].Name.
+//Field is empty for problems that are not about one particular field.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+//ValidationError is returned when a wire type fails validation.  The dispatcher
+//sends this to the client as a problem details object with the code 422
+//(Unprocessable Entity) and the field errors in the "errors" member, so the
+//client can display the problems next to the fields.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+//Error makes ValidationError an error.
+func (self *ValidationError) Error() string {
+	msgs := []string{}
+	for _, e := range self.Errors {
+		if e.Field == "" {
+			msgs = append(msgs, e.Message)
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", e.Field, e.Message))
+		}
+	}
+	return fmt.Sprintf("validation failed: %s", strings.Join(msgs, "; "))
+}
+
+//Add appends a problem with the given field to the list.
+func (self *ValidationError) Add(field string, msg string) {
+	self.Errors = append(self.Errors, FieldError{Field: field, Message: msg})
+}
+
+//Validator is an optional interface for wire types that need to check their
+//values with code rather than (or in addition to) struct tags.  Implementations
+//should return a *ValidationError to report problems with particular fields;
+//any other error is treated as a failure of the server.
+type Validator interface {
+	Validate() error
+}
+
+//rule is one of the rules from a validate tag, with its argument already
+//parsed.
+type rule struct {
+	name  string
+	arg   string
+	bound float64
+	re    *regexp.Regexp
+}
+
+//structRules holds the rules for each field of a struct type, by field index.
+type structRules struct {
+	fields [][]rule
+}
+
+var (
+	rulesLock   sync.Mutex
+	rulesByType = make(map[reflect.Type]*structRules)
+)
+
+//CompileValidation parses the validate tags of the wire type provided, and
+//of any struct types it contains, so that mistakes in the tags are found
+//before any requests are processed.  The dispatcher calls this when a resource
+//is registered and panics if there is an error.  The result is kept, so this
+//only does the work once per type.
+func CompileValidation(wire reflect.Type) error {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	return compileType(wire)
+}
+
+//compileType finds the struct, if any, inside t and compiles its rules.  The
+//caller must hold rulesLock.
+func compileType(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if _, ok := rulesByType[t]; ok {
+		return nil
+	}
+	result := &structRules{fields: make([][]rule, t.NumField())}
+	//recursive types find themselves here
+	rulesByType[t] = result
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		var err error
+		if tag := f.Tag.Get(VALIDATE_TAG); tag != "" {
+			result.fields[i], err = parseRules(tag)
+			if err != nil {
+				err = fmt.Errorf("bad validate tag on %s.%s: %v", t.Name(), f.Name, err)
+			}
+		}
+		if err == nil {
+			err = compileType(f.Type)
+		}
+		if err != nil {
+			delete(rulesByType, t)
+			return err
+		}
+	}
+	return nil
+}
+
+//rulesFor returns the compiled rules of a struct type, compiling them if the
+//type has not been seen (for example, because it is inside an interface).
+func rulesFor(t reflect.Type) (*structRules, error) {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	if err := compileType(t); err != nil {
+		return nil, err
+	}
+	return rulesByType[t], nil
+}
+
+//parseRules breaks up a tag on commas, except that everything after pattern=
+//belongs to the pattern, and checks the argument of each rule.
+func parseRules(tag string) ([]rule, error) {
+	result := []rule{}
+	for _, r := range splitRules(tag) {
+		name, arg := r, ""
+		if eq := strings.Index(r, "="); eq > 0 {
+			name, arg = r[:eq], r[eq+1:]
+		}
+		parsed := rule{name: name, arg: arg}
+		switch name {
+		case "required", "oneof":
+		case "min", "max", "len":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad argument to %s: %s", name, arg)
+			}
+			parsed.bound = bound
+		case "pattern":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern: %v", err)
+			}
+			parsed.re = re
+		default:
+			return nil, fmt.Errorf("unknown rule %s", name)
+		}
+		result = append(result, parsed)
+	}
+	return result, nil
+}
+
+//ValidateWire checks the constraints declared by the struct tags of the wire
+//object provided and then calls its Validate method, if it has one.  It returns
+//nil if the object is valid, a *ValidationError if it is not, or whatever other
+//error was returned by Validate.  A nil wire object is valid.  If the struct
+//tags have mistakes, the error says so (see CompileValidation).
+func ValidateWire(wire interface{}) error {
+	if wire == nil {
+		return nil
+	}
+	verr := &ValidationError{}
+	if err := validateValue(reflect.ValueOf(wire), "", verr); err != nil {
+		return err
+	}
+	if v, ok := wire.(Validator); ok {
+		err := v.Validate()
+		if err != nil {
+			other, ok := err.(*ValidationError)
+			if !ok {
+				return err
+			}
+			verr.Errors = append(verr.Errors, other.Errors...)
+		}
+	}
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+//validateValue walks through structs, pointers and slices checking tags.
+func validateValue(v reflect.Value, path string, verr *ValidationError) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return validateValue(v.Elem(), path, verr)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), verr); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		rules, err := rulesFor(t)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fieldPath := f.Name
+			if path != "" {
+				fieldPath = path + "." + f.Name
+			}
+			checkRules(v.Field(i), fieldPath, rules.fields[i], verr)
+			if err := validateValue(v.Field(i), fieldPath, verr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//checkRules applies the rules of a single field.
+func checkRules(v reflect.Value, path string, rules []rule, verr *ValidationError) {
+	if len(rules) == 0 {
+		return
+	}
+	if isEmptyValue(v) {
+		for _, r := range rules {
+			if r.name == "required" {
+				verr.Add(path, "is required")
+			}
+		}
+		return
+	}
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	for _, r := range rules {
+		var msg string
+		switch r.name {
+		case "min", "max", "len":
+			msg = checkBound(v, r)
+		case "oneof":
+			msg = fmt.Sprintf("must be one of %s", strings.Join(strings.Fields(r.arg), ", "))
+			for _, allowed := range strings.Fields(r.arg) {
+				if fmt.Sprint(v.Interface()) == allowed {
+					msg = ""
+				}
+			}
+		case "pattern":
+			if v.Kind() != reflect.String || !r.re.MatchString(v.String()) {
+				msg = "is not in the expected format"
+			}
+		}
+		if msg != "" {
+			verr.Add(path, msg)
+		}
+	}
+}
+
+//splitRules breaks up a tag on commas, except that everything after pattern=
+//belongs to the pattern.
+func splitRules(tag string) []string {
+	result := []string{}
+	for tag != "" {
+		if strings.HasPrefix(tag, "pattern=") {
+			return append(result, tag)
+		}
+		comma := strings.Index(tag, ",")
+		if comma < 0 {
+			return append(result, strings.TrimSpace(tag))
+		}
+		result = append(result, strings.TrimSpace(tag[:comma]))
+		tag = strings.TrimSpace(tag[comma+1:])
+	}
+	return result
+}
+
+//checkBound returns a message if the value is outside the bound, or "".
+func checkBound(v reflect.Value, r rule) string {
+	bound, arg := r.bound, r.arg
+	var actual float64
+	isLength := false
+	switch v.Kind() {
+	case reflect.String:
+		actual, isLength = float64(len([]rune(v.String()))), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		actual, isLength = float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		actual = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		actual = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = v.Float()
+	default:
+		return ""
+	}
+	switch {
+	case r.name == "min" && actual < bound && isLength:
+		return fmt.Sprintf("must have at least %s characters or items", arg)
+	case r.name == "min" && actual < bound:
+		return fmt.Sprintf("must be at least %s", arg)
+	case r.name == "max" && actual > bound && isLength:
+		return fmt.Sprintf("must have at most %s characters or items", arg)
+	case r.name == "max" && actual > bound:
+		return fmt.Sprintf("must be at most %s", arg)
+	case r.name == "len" && actual != bound:
+		return fmt.Sprintf("must have exactly %s characters or items", arg)
+	}
+	return ""
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+//sendValidationError sends a *ValidationError to the client as a problem details
+//object with the code 422 and the field errors in the "errors" member. Other
+//errors go through SendError.
+func (self *RawDispatcher) sendValidationError(err error, w http.ResponseWriter) {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		self.SendError(err, w, "Internal error on Validate")
+		return
+	}
+	WriteError(w, validationProblem(verr))
+}
+
+//validationProblem is the 422 (Unprocessable Entity) error for a wire object
+//that failed validation.
+func validationProblem(verr *ValidationError) *Error {
+	return HTTPError(http.StatusUnprocessableEntity, verr.Error()).With("errors", verr.Errors)
+}
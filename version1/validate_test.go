@@ -0,0 +1,165 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	Street string `validate:"required"`
+	Zip    string `validate:"pattern=^[0-9]{5}$"`
+}
+
+type validatedWire struct {
+	Id        int64
+	Name      string   `validate:"required,min=2,max=8"`
+	Age       int      `validate:"min=18,max=130"`
+	Color     string   `validate:"oneof=red green blue"`
+	Tags      []string `validate:"max=2"`
+	Home      *address
+	Addresses []address
+}
+
+func (self *validatedWire) Validate() error {
+	if self.Name == "root" {
+		return &ValidationError{[]FieldError{{"Name", "is reserved"}}}
+	}
+	return nil
+}
+
+type validatedResource struct {
+}
+
+func (self *validatedResource) Post(i interface{}, p PBundle) (interface{}, error) {
+	return i, nil
+}
+
+func (self *validatedResource) Put(id int64, i interface{}, p PBundle) (interface{}, error) {
+	return i, nil
+}
+
+func checkFieldErrors(t *testing.T, err error, expected map[string]string) {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error but got %v", err)
+	}
+	if len(verr.Errors) != len(expected) {
+		t.Errorf("expected %d field errors but got %d: %v", len(expected), len(verr.Errors), verr.Errors)
+	}
+	for _, e := range verr.Errors {
+		msg, ok := expected[e.Field]
+		if !ok || !strings.Contains(e.Message, msg) {
+			t.Errorf("unexpected error on field %s: %s", e.Field, e.Message)
+		}
+	}
+}
+
+func TestValidateWire(t *testing.T) {
+	if err := ValidateWire(&validatedWire{Name: "fred"}); err != nil {
+		t.Errorf("expected no errors on a minimal object: %v", err)
+	}
+	if err := ValidateWire(nil); err != nil {
+		t.Errorf("expected no errors on a nil object: %v", err)
+	}
+	bad := &validatedWire{
+		Age:       12,
+		Color:     "purple",
+		Tags:      []string{"a", "b", "c"},
+		Home:      &address{Zip: "0210"},
+		Addresses: []address{{Street: "Main", Zip: "02139"}, {Zip: "02139"}},
+	}
+	checkFieldErrors(t, ValidateWire(bad), map[string]string{
+		"Name":                "required",
+		"Age":                 "at least 18",
+		"Color":               "one of",
+		"Tags":                "at most 2",
+		"Home.Street":         "required",
+		"Home.Zip":            "format",
+		"Addresses[1].Street": "required",
+	})
+	checkFieldErrors(t, ValidateWire(&validatedWire{Name: "x"}), map[string]string{
+		"Name": "at least 2",
+	})
+	checkFieldErrors(t, ValidateWire(&validatedWire{Name: "root"}), map[string]string{
+		"Name": "reserved",
+	})
+}
+
+type badBoundWire struct {
+	Id   int64
+	Name string `validate:"min=three"`
+}
+
+type badPatternWire struct {
+	Id    int64
+	Inner *struct {
+		Code string `validate:"pattern=[a-"`
+	}
+}
+
+func isValidationError(err error) bool {
+	_, ok := err.(*ValidationError)
+	return ok
+}
+
+func TestBadValidateTags(t *testing.T) {
+	for _, wire := range []interface{}{&badBoundWire{}, &badPatternWire{}} {
+		if err := CompileValidation(reflect.TypeOf(wire)); err == nil {
+			t.Errorf("expected error compiling rules of %T", wire)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registration of %T to panic", wire)
+				}
+			}()
+			NewRawDispatcher(nil, nil, nil, "/rest").ResourceSeparate("bad", wire, nil, nil, nil, nil, nil)
+		}()
+		//at request time, it's an error rather than a panic
+		if err := ValidateWire(wire); err == nil || isValidationError(err) {
+			t.Errorf("expected a server error for %T, not a validation error", wire)
+		}
+	}
+}
+
+func TestValidationResponse(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, "/rest")
+	rez := &validatedResource{}
+	raw.ResourceSeparate("validatedwire", &validatedWire{}, nil, nil, rez, rez, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	go func() {
+		http.ListenAndServe(":8199", mux)
+	}()
+
+	resp, err := http.Post("http://localhost:8199/rest/validatedwire", "text/json",
+		strings.NewReader(`{"Id":0, "Name":"fred", "Age":21}`))
+	checkHttpStatus(t, resp, err, http.StatusCreated)
+
+	req, _ := http.NewRequest("PUT", "http://localhost:8199/rest/validatedwire/1",
+		strings.NewReader(`{"Id":1, "Name":"fred", "Age":2, "Home":{"Zip":"abc"}}`))
+	resp, err = http.DefaultClient.Do(req)
+	checkHttpStatus(t, resp, err, http.StatusUnprocessableEntity)
+	if ct := resp.Header.Get("Content-Type"); ct != PROBLEM_CONTENT_TYPE {
+		t.Errorf("expected a problem for validation errors but got %s", ct)
+	}
+	var body struct {
+		Status int          `json:"status"`
+		Errors []FieldError `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("unable to decode validation errors: %v", err)
+	}
+	if body.Status != http.StatusUnprocessableEntity {
+		t.Errorf("wrong status in problem: %d", body.Status)
+	}
+	checkFieldErrors(t, &ValidationError{body.Errors}, map[string]string{
+		"Age":         "at least 18",
+		"Home.Street": "required",
+		"Home.Zip":    "format",
+	})
+}